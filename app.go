@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/state"
 )
 
@@ -89,6 +91,66 @@ func AppNonTransactional() AppOption {
 	}
 }
 
+// SpreadReplicas is an application option that spreads the replicas of the
+// application's bees across the failure domains identified by the given hive
+// labels (e.g., "zone" and "rack"). It is a shorthand for using
+// LabelSpreadReplication.
+func SpreadReplicas(labels ...string) AppOption {
+	return AppWithReplication(LabelSpreadReplication{Labels: labels})
+}
+
+// AppWithReplication is an application option that customizes the replication
+// strategy of a persistent application.
+func AppWithReplication(s ReplicationStrategy) AppOption {
+	return func(a *app) {
+		a.replication = s
+	}
+}
+
+// AppWithIdleTimeout is an application option that passivates the bees that
+// receive no message for d. A passive bee releases its goroutines and keeps
+// its state on the local disk under HiveConfig.StatePath. It keeps the
+// ownership of its cells, and is reactivated when the next message for its
+// cells arrives. Note that the bee local (see RcvContext.SetBeeLocal) is not
+// preserved. Bees of persistent applications are never passivated.
+func AppWithIdleTimeout(d time.Duration) AppOption {
+	return func(a *app) {
+		a.idleTimeout = d
+	}
+}
+
+// AppWithSweepInterval is an application option that sets how often the
+// expired keys (see state.Dict.PutTTL) are removed from the state of the
+// application's bees. The default interval is 10 seconds, and a non-positive
+// interval disables sweeping. Note that expired keys are invisible to the
+// handlers even before they are removed.
+func AppWithSweepInterval(d time.Duration) AppOption {
+	return func(a *app) {
+		a.sweepInterval = d
+	}
+}
+
+// AppReleaseEmptyBees is an application option that stops the bees whose
+// state becomes empty when their expired keys are removed, and releases their
+// cells. The next message mapped to those cells is handled by a new bee. This
+// option has no effect on persistent applications.
+func AppReleaseEmptyBees() AppOption {
+	return func(a *app) {
+		a.flags |= appFlagReleaseEmpty
+	}
+}
+
+// AppWithIndex is an application option that adds secondary index name on
+// dictionary dict of the application's bees. The keys of dict are indexed
+// under the index keys extracted by f from their values, and can be looked up
+// using state.Dict.Lookup. Indexes are kept up to date by transactions and,
+// since they are derived from the state, by replication and restores.
+func AppWithIndex(dict, name string, f state.IndexFn) AppOption {
+	return func(a *app) {
+		a.indexes = append(a.indexes, appIndex{dict: dict, name: name, fn: f})
+	}
+}
+
 // AppWithPlacement is an application option that customizes the default
 // placement strategy for the application.
 func AppWithPlacement(p PlacementMethod) AppOption {
@@ -181,17 +243,37 @@ const (
 	appFlagSticky appFlag = 1 << iota
 	appFlagPersistent
 	appFlagTransactional
+	appFlagReleaseEmpty
+	appFlagRewriteOutdated
 )
 
 type app struct {
-	name       string
-	hive       *hive
-	qee        *qee
-	handlers   map[string]Handler
-	flags      appFlag
-	replFactor int
-	placement  PlacementMethod
-	router     *mux.Router
+	name          string
+	hive          *hive
+	qee           *qee
+	handlers      map[string]Handler
+	flags         appFlag
+	replFactor    int
+	replication   ReplicationStrategy
+	optimizer     OptimizerPolicy
+	idleTimeout   time.Duration
+	sweepInterval time.Duration
+	quota         Quota
+	violations    QuotaViolations
+	lifecycle     []LifecycleHandler
+	indexes       []appIndex
+	placement     PlacementMethod
+	router        *mux.Router
+
+	followerReads     bool
+	maxReadLag        uint64
+	linearizableReads bool
+
+	changeFeed    bool
+	changeFilters []ChangeFilter
+
+	dictDecoders map[string]DictDecoder
+	snapshot     *raft.SnapshotConfig
 }
 
 func (a *app) String() string {
@@ -220,6 +302,9 @@ func (a *app) registerHandler(t string, h Handler) error {
 	_, ok := a.handlers[t]
 	a.handlers[t] = h
 	a.hive.registerHandler(t, a.qee, h)
+	if lh, isLH := h.(LifecycleHandler); isLH {
+		a.addLifecycleHandler(lh)
+	}
 
 	if ok {
 		return errors.New("A handler for this message type already exists.")
@@ -267,16 +352,28 @@ func (a *app) appHTTPPrefix() string {
 func (a *app) initQee() {
 	// TODO(soheil): Maybe stop the previous qee if any?
 	a.qee = &qee{
-		dataCh: newMsgChannel(a.hive.config.DataChBufSize),
-		ctrlCh: make(chan cmdAndChannel, a.hive.config.CmdChBufSize),
-		hive:   a.hive,
-		app:    a,
-		bees:   make(map[uint64]*bee),
+		dataCh:  newMsgChannel(a.hive.config.DataChBufSize),
+		ctrlCh:  make(chan cmdAndChannel, a.hive.config.CmdChBufSize),
+		hive:    a.hive,
+		app:     a,
+		bees:    make(map[uint64]*bee),
+		passive: make(map[uint64][]msgAndHandler),
 	}
 }
 
+// appIndex is a secondary index declared by AppWithIndex.
+type appIndex struct {
+	dict string
+	name string
+	fn   state.IndexFn
+}
+
 func (a *app) newState() state.State {
-	return state.NewInMem()
+	s := state.NewInMem()
+	for _, i := range a.indexes {
+		s.AddIndex(i.dict, i.name, i.fn)
+	}
+	return s
 }
 
 func (a *app) persistent() bool {
@@ -290,3 +387,7 @@ func (a *app) transactional() bool {
 func (a *app) sticky() bool {
 	return a.flags&appFlagSticky != 0
 }
+
+func (a *app) releasesEmptyBees() bool {
+	return a.flags&appFlagReleaseEmpty != 0
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
@@ -51,12 +52,24 @@ type bee struct {
 	peers      map[uint64]*proxy
 	emitInRaft bool
 
+	// stateLock serializes the changes applied by raft and the follower reads
+	// of stateL1. It must be acquired before the bee is locked.
+	stateLock sync.RWMutex
+
 	stateL1  *state.Transactional
 	stateL2  *state.Transactional
 	msgBufL1 []*msg
 	msgBufL2 []*msg
 
+	savepoints []msgSavepoint // length of the message buffer at savepoints.
+
 	local interface{}
+
+	lastActive int64 // when the bee last received a message, in UnixNano.
+	queued     int64 // number of messages enqueued but not received yet.
+	reloaded   bool  // whether the bee is reloaded rather than created.
+
+	distTxs map[uint64][]state.Op // prepared distributed transactions.
 }
 
 func (b *bee) ID() uint64 {
@@ -115,8 +128,8 @@ func (b *bee) startNode() error {
 	}
 	b.ticker = time.NewTicker(b.hive.config.RaftTick)
 	node := raft.NewNode(b.String(), b.beeID, peers, b.sendRaft, b,
-		b.statePath(), b, 1024, b.ticker.C, b.hive.config.RaftElectTicks,
-		b.hive.config.RaftHBTicks)
+		b.statePath(), b, b.app.snapshotConfig(), b.ticker.C,
+		b.hive.config.RaftElectTicks, b.hive.config.RaftHBTicks)
 	b.setRaftNode(node)
 	// This will act like a barrier.
 	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
@@ -188,7 +201,7 @@ func (b *bee) ProcessStatusChange(sch interface{}) {
 			Old: oldc,
 			New: newc,
 		}
-		if _, err := b.hive.node.Process(context.TODO(), up); err != nil {
+		if _, err := b.hive.processRaft(context.TODO(), up); err != nil {
 			glog.Errorf("%v cannot update its colony: %v", b, err)
 			return
 		}
@@ -230,7 +243,7 @@ func (b *bee) addFollower(bid uint64, hid uint64) error {
 		Old: oldc,
 		New: newc,
 	}
-	if _, err := b.hive.node.Process(context.TODO(), up); err != nil {
+	if _, err := b.hive.processRaft(context.TODO(), up); err != nil {
 		glog.Errorf("%v cannot update its colony: %v", b, err)
 		return err
 	}
@@ -282,12 +295,30 @@ func (b *bee) start() {
 		}
 	}
 	b.status = beeStatusStarted
+	b.markActive()
 	glog.V(2).Infof("%v started", b)
+	if b.reloaded {
+		b.fireEvent(BeeReloaded)
+	} else {
+		b.fireEvent(BeeStarted)
+	}
+	b.fireRoleEvent()
+	if !b.detached && !b.proxy {
+		b.loadDistTxs()
+	}
 	dataCh := b.dataCh.out()
 	batch := make([]msgAndHandler, 0, b.batchSize)
 	for b.status == beeStatusStarted {
+		// The batch size can be changed by reloading the configuration.
+		b.batchSize = b.hive.batchSize()
+		// Messages are not received while a distributed transaction is in doubt.
+		in := dataCh
+		if b.inDoubt() {
+			in = nil
+		}
 		select {
-		case d := <-dataCh:
+		case d := <-in:
+			b.markActive()
 			batch = append(batch, d)
 		loop:
 			for len(batch) < b.batchSize {
@@ -298,6 +329,7 @@ func (b *bee) start() {
 					break loop
 				}
 			}
+			atomic.AddInt64(&b.queued, -int64(len(batch)))
 			b.handleMsg(batch)
 			batch = batch[0:0]
 
@@ -334,10 +366,16 @@ func (b *bee) callRcv(mh msgAndHandler) (err error) {
 		err = errRcv
 	}()
 
+	b.hive.rcvMeter.mark(1)
 	if err := mh.handler.Rcv(mh.msg, b); err != nil {
 		b.recoverFromError(mh, err, false)
 		return errRcv
 	}
+	if err := b.checkStateQuota(); err != nil {
+		b.AbortTx()
+		b.app.reject(mh, err)
+		return errRcv
+	}
 
 	// FIXME(soheil): Provenence works only when the application is transactional.
 	var msgs []*msg
@@ -346,7 +384,7 @@ func (b *bee) callRcv(mh msgAndHandler) (err error) {
 	} else {
 		msgs = b.msgBufL1
 	}
-	b.hive.collector.collect(b.beeID, mh.msg, msgs)
+	b.hive.collector.collect(b.beeID, mh.msg, msgs, userStateSize(b.stateL1))
 	return nil
 }
 
@@ -404,6 +442,7 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	var data interface{}
 	switch cmd := cc.cmd.Data.(type) {
 	case cmdStop:
+		b.fireEvent(BeeStopping)
 		b.status = beeStatusStopped
 		b.stopNode()
 		glog.V(2).Infof("%v stopped", b)
@@ -416,12 +455,41 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 		_, err = b.raftNode().Process(context.TODO(), noOp{})
 
 	case cmdRestoreState:
-		err = b.stateL1.Restore(cmd.State)
+		if err = b.stateL1.Restore(cmd.State); err == nil {
+			b.loadDistTxs()
+		}
+
+	case cmdPassivate:
+		data, err = b.passivate(cmd.Timeout)
+
+	case cmdExpire:
+		data, err = b.expire(time.Now())
+
+	case cmdRewriteOutdated:
+		err = b.rewriteOutdated()
+
+	case cmdExportState:
+		data = b.exportState()
+
+	case cmdImportState:
+		err = b.importState(cmd.Dicts, cmd.Overwrite)
 
 	case cmdCampaign:
 		err = b.raftNode().Campaign(context.TODO())
 
+	case cmdReadIndex:
+		if err = b.replyReadIndex(cc); err == nil {
+			return
+		}
+
+	case cmdServeReads:
+		b.serveReads(cmd)
+
+	case cmdPrepareDistTx, cmdResolveDistTx, cmdCheckDistTx:
+		data, err = b.handleDistTxCmd(cmd)
+
 	case cmdHandoff:
+		b.fireEvent(BeeMigrating)
 		err = b.handoff(cmd.To)
 
 	case cmdJoinColony:
@@ -478,6 +546,10 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 
 func (b *bee) becomeLeader() {
 	b.handleMsg, b.handleCmd = b.leaderHandlers()
+	if b.status == beeStatusStarted {
+		b.fireEvent(BeeBecameLeader)
+		b.checkDistTxsLater()
+	}
 }
 
 func (b *bee) leaderHandlers() (func(mhs []msgAndHandler),
@@ -496,6 +568,9 @@ func (b *bee) dropMsg(mhs []msgAndHandler) {
 
 func (b *bee) becomeFollower() {
 	b.handleMsg, b.handleCmd = b.followerHandlers()
+	if b.status == beeStatusStarted {
+		b.fireEvent(BeeBecameFollower)
+	}
 }
 
 func (b *bee) followerHandlers() (func(mhs []msgAndHandler),
@@ -512,6 +587,11 @@ func (b *bee) followerHandlers() (func(mhs []msgAndHandler),
 	}
 
 	mfn, _ := b.proxyHandlers(c.Leader)
+	if b.app.followerReads && b.app.persistent() {
+		return func(mhs []msgAndHandler) {
+			b.handleMsgFollower(mhs, mfn)
+		}, b.handleCmdLocal
+	}
 	return mfn, b.handleCmdLocal
 }
 
@@ -574,6 +654,7 @@ func (b *bee) detachedHandlers(h DetachedHandler) (func(mhs []msgAndHandler),
 
 func (b *bee) enqueMsg(mh msgAndHandler) {
 	glog.V(3).Infof("%v enqueues message %v", b, mh.msg)
+	atomic.AddInt64(&b.queued, 1)
 	b.dataCh.in() <- mh
 }
 
@@ -642,8 +723,10 @@ func (b *bee) snooze(mh msgAndHandler, d time.Duration) {
 
 	go func() {
 		<-t.C
-		b.delTimer(t)
+		// Enqueue before deleting the timer so that the bee is not passivated
+		// in between.
 		b.enqueMsg(mh)
+		b.delTimer(t)
 	}()
 }
 
@@ -689,10 +772,44 @@ func (b *bee) SendToCell(msgData interface{}, app string, cell CellKey) {
 	b.bufferOrEmit(msg)
 }
 
+func (b *bee) SendToCells(msgData interface{}, app string,
+	cells MappedCells) MappedCells {
+
+	bees, unowned := b.hive.registry.beesForCells(app, cells)
+	b.SendToBees(msgData, bees)
+	return unowned
+}
+
 func (b *bee) SendToBee(msgData interface{}, to uint64) {
 	b.bufferOrEmit(newMsgFromData(msgData, b.beeID, to))
 }
 
+// SendToBees sends one copy of the message to each bee in to. The message is
+// emitted (or buffered in the transaction) once, and the hive enqueues it once
+// per destination hive.
+func (b *bee) SendToBees(msgData interface{}, to []uint64) {
+	sent := make(map[uint64]bool, len(to))
+	bees := make([]uint64, 0, len(to))
+	for _, id := range to {
+		if sent[id] {
+			continue
+		}
+		sent[id] = true
+		bees = append(bees, id)
+	}
+	switch len(bees) {
+	case 0:
+	case 1:
+		b.SendToBee(msgData, bees[0])
+	default:
+		b.bufferOrEmit(newMulticastMsg(msgData, b.beeID, bees))
+	}
+}
+
+func (b *bee) BroadcastToApp(msgData interface{}, app string) {
+	b.bufferOrEmit(newAppBroadcastMsg(msgData, b.beeID, app))
+}
+
 // Reply to msg with the provided reply.
 func (b *bee) ReplyTo(msg Msg, reply interface{}) error {
 	if msg.NoReply() {
@@ -745,12 +862,14 @@ func (b *bee) BeginTx() error {
 }
 
 func (b *bee) commitTxBothLayers() (err error) {
+	var chs []StateChange
 	hasL2 := b.stateL2 != nil
 	if hasL2 {
 		if err = b.stateL2.CommitTx(); err != nil {
 			goto reset
 		}
 	}
+	chs = b.changes(b.stateL1.TxOps())
 	if err = b.stateL1.CommitTx(); err != nil {
 		goto reset
 	}
@@ -762,6 +881,7 @@ func (b *bee) commitTxBothLayers() (err error) {
 			b.doEmit(b.msgBufL2[i])
 		}
 	}
+	b.emitChanges(chs)
 
 reset:
 	if hasL2 {
@@ -799,6 +919,7 @@ func (b *bee) commitTxL2() (err error) {
 
 func (b *bee) resetTx(dicts *state.Transactional, msgs *[]*msg) {
 	dicts.Reset()
+	b.savepoints = nil
 	for i := range *msgs {
 		(*msgs)[i] = nil
 	}
@@ -831,13 +952,22 @@ func (b *bee) replicate() error {
 		Tx:   stx,
 		Msgs: b.msgBufL1,
 	}
-	ctx, ccl := context.WithTimeout(context.Background(),
-		b.hive.config.RaftElectTimeout())
-	defer ccl()
-	if _, err := b.raftNode().Process(ctx, commitTx(tx)); err != nil {
+	reqs, err := b.txRequests(tx)
+	if err != nil {
 		glog.Errorf("%v cannot replicate the transaction: %v", b, err)
+		b.resetTx(b.stateL1, &b.msgBufL1)
 		return err
 	}
+	for _, req := range reqs {
+		ctx, ccl := context.WithTimeout(context.Background(),
+			b.hive.config.RaftElectTimeout())
+		_, err := b.raftNode().Process(ctx, req)
+		ccl()
+		if err != nil {
+			glog.Errorf("%v cannot replicate the transaction: %v", b, err)
+			return err
+		}
+	}
 	glog.V(2).Infof("%v successfully replicates transaction", b)
 	return nil
 }
@@ -876,43 +1006,47 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 		blacklist = append(blacklist, fb.Hive)
 	}
 	for r != 1 {
-		hives := b.hive.replStrategy.selectHives(blacklist, r-1)
+		hives := b.hive.selectFollowerHives(b.app, c, blacklist, r-1)
 		if len(hives) == 0 {
 			glog.Warningf("can only find %v hives to create followers for %v",
 				len(b.colony().Followers), b)
 			break
 		}
 
-		fch := make(chan uint64)
+		// The replication strategy may return fewer hives than requested.
+		type newFollower struct {
+			bee  uint64
+			hive uint64
+		}
+		fch := make(chan newFollower)
 
-		tries := r - 1
-		for i := 0; i < tries; i++ {
-			blacklist = append(blacklist, hives[i])
-			go func(i int) {
+		for _, h := range hives {
+			blacklist = append(blacklist, h)
+			go func(h uint64) {
 				glog.V(2).Infof("trying to create a new follower for %v on hive %v", b,
-					hives[0])
+					h)
 				cmd := cmd{
 					App:  b.app.Name(),
 					Data: cmdCreateBee{},
 				}
-				res, err := b.hive.streamer.sendCmd(cmd, hives[i])
+				res, err := b.hive.streamer.sendCmd(cmd, h)
 				if err != nil {
-					glog.Errorf("%v cannot create a new bee on %v: %v", b, hives[0], err)
-					fch <- 0
+					glog.Errorf("%v cannot create a new bee on %v: %v", b, h, err)
+					fch <- newFollower{hive: h}
 					return
 				}
-				fch <- res.(uint64)
-			}(i)
+				fch <- newFollower{bee: res.(uint64), hive: h}
+			}(h)
 		}
 
-		for i := 0; i < tries; i++ {
-			fid := <-fch
-			if fid == 0 {
+		for range hives {
+			f := <-fch
+			if f.bee == 0 {
 				continue
 			}
 
-			if err := b.addFollower(fid, hives[i]); err != nil {
-				glog.Errorf("%v cannot add %v as a follower: %v", b, fid, err)
+			if err := b.addFollower(f.bee, f.hive); err != nil {
+				glog.Errorf("%v cannot add %v as a follower: %v", b, f.bee, err)
 				continue
 			}
 			recruited++
@@ -944,7 +1078,7 @@ func (b *bee) handoffNonPersistent(to uint64) error {
 		Old: Colony{Leader: b.ID()},
 		New: Colony{Leader: to},
 	}
-	if _, err := b.hive.node.Process(context.TODO(), up); err != nil {
+	if _, err := b.hive.processRaft(context.TODO(), up); err != nil {
 		return err
 	}
 
@@ -1025,6 +1159,56 @@ func (b *bee) AbortTx() error {
 	return err
 }
 
+// msgSavepoint is the length of the message buffer of a transaction at a
+// savepoint.
+type msgSavepoint struct {
+	name string
+	len  int
+}
+
+func (b *bee) Savepoint(name string) error {
+	dicts, msgs := b.currentState()
+	if err := dicts.Savepoint(name); err != nil {
+		return err
+	}
+	b.savepoints = append(b.savepoints, msgSavepoint{name: name, len: len(*msgs)})
+	return nil
+}
+
+func (b *bee) RollbackTo(name string) error {
+	dicts, msgs := b.currentState()
+	if err := dicts.RollbackTo(name); err != nil {
+		return err
+	}
+
+	i := b.savepointIndex(name)
+	for j := b.savepoints[i].len; j < len(*msgs); j++ {
+		(*msgs)[j] = nil
+	}
+	*msgs = (*msgs)[:b.savepoints[i].len]
+	b.savepoints = b.savepoints[:i+1]
+	return nil
+}
+
+func (b *bee) ReleaseSavepoint(name string) error {
+	dicts, _ := b.currentState()
+	if err := dicts.ReleaseSavepoint(name); err != nil {
+		return err
+	}
+
+	b.savepoints = b.savepoints[:b.savepointIndex(name)]
+	return nil
+}
+
+func (b *bee) savepointIndex(name string) int {
+	for i := len(b.savepoints) - 1; i >= 0; i-- {
+		if b.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
 func (b *bee) Snooze(d time.Duration) {
 	panic(d)
 }
@@ -1034,45 +1218,66 @@ func (b *bee) Save() ([]byte, error) {
 }
 
 func (b *bee) Restore(buf []byte) error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
 	return b.stateL1.Restore(buf)
 }
 
 func (b *bee) Apply(req interface{}) (interface{}, error) {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
 	b.Lock()
 	defer b.Unlock()
 
 	switch r := req.(type) {
 	case commitTx:
 		glog.V(2).Infof("%v commits %v", b, r)
-		leader := b.isLeader()
-		if b.stateL2 != nil {
-			b.stateL2 = nil
-			glog.Errorf("%v has an L2 transaction", b)
-		}
-		if b.stateL1.TxStatus() == state.TxOpen {
-			if !leader {
-				glog.Errorf("%v is a follower and has an open transaction", b)
-			}
-			b.resetTx(b.stateL1, &b.msgBufL1)
-		}
-		if err := b.stateL1.Apply(r.Ops); err != nil {
-			return nil, err
-		}
-
-		if leader && b.emitInRaft {
-			for _, msg := range r.Msgs {
-				msg.MsgFrom = b.beeID
-				glog.V(2).Infof("%v emits %#v", b, msg)
-				b.doEmit(msg)
-			}
-		}
-		return nil, nil
+		return nil, b.applyTx(tx(r))
+	case txChunk:
+		glog.V(2).Infof("%v applies chunk %v of transaction %v", b, r.Seq, r.ID)
+		return nil, b.applyTxChunk(r)
+	case prepareDistTx, resolveDistTx:
+		glog.V(2).Infof("%v applies %#v", b, r)
+		return nil, b.applyDistTx(r)
 	case noOp:
 		return nil, nil
 	}
 	return nil, ErrUnsupportedRequest
 }
 
+// applyTx applies the replicated transaction t. The leader also emits the
+// messages of t.
+func (b *bee) applyTx(t tx) error {
+	leader := b.isLeader()
+	if b.stateL2 != nil {
+		b.stateL2 = nil
+		glog.Errorf("%v has an L2 transaction", b)
+	}
+	if b.stateL1.TxStatus() == state.TxOpen {
+		if !leader {
+			glog.Errorf("%v is a follower and has an open transaction", b)
+		}
+		b.resetTx(b.stateL1, &b.msgBufL1)
+	}
+	var chs []StateChange
+	if leader && b.emitInRaft {
+		chs = b.changes(t.Ops)
+	}
+	if err := b.stateL1.Apply(t.Ops); err != nil {
+		return err
+	}
+
+	if leader && b.emitInRaft {
+		for _, msg := range t.Msgs {
+			msg.MsgFrom = b.beeID
+			glog.V(2).Infof("%v emits %#v", b, msg)
+			b.doEmit(msg)
+		}
+		b.emitChanges(chs)
+	}
+	return nil
+}
+
 func (b *bee) ApplyConfChange(cc raftpb.ConfChange,
 	n raft.NodeInfo) error {
 
@@ -0,0 +1,198 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type bcastTestMsg string
+type bcastTestFlush struct{}
+
+func registerBroadcastApp(h Hive, ch chan uint64) App {
+	a := h.NewApp("bcastapp", AppNonTransactional())
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", string(msg.Data().(bcastTestMsg))}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.Hive().ID()
+		return nil
+	}
+	a.HandleFunc(bcastTestMsg(""), mf, rf)
+	a.HandleFunc(bcastTestFlush{}, func(msg Msg, ctx MapContext) MappedCells {
+		return nil
+	}, rf)
+	return a
+}
+
+func TestBroadcastToApp(t *testing.T) {
+	ch := make(chan uint64)
+
+	cfg1 := DefaultCfg
+	cfg1.StatePath = "/tmp/bhtest_bcast1"
+	cfg1.Addr = newHiveAddrForTest()
+	removeState(cfg1)
+	defer removeState(cfg1)
+	h1 := NewHiveWithConfig(cfg1)
+	registerBroadcastApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	cfg2 := DefaultCfg
+	cfg2.StatePath = "/tmp/bhtest_bcast2"
+	cfg2.Addr = newHiveAddrForTest()
+	cfg2.PeerAddrs = []string{cfg1.Addr}
+	removeState(cfg2)
+	defer removeState(cfg2)
+	h2 := NewHiveWithConfig(cfg2)
+	registerBroadcastApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// Create a bee on each hive.
+	h1.Emit(bcastTestMsg("k1"))
+	<-ch
+	h2.Emit(bcastTestMsg("k2"))
+	<-ch
+
+	h1.BroadcastToApp(bcastTestFlush{}, "bcastapp")
+	rcvd := make(map[uint64]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-ch:
+			rcvd[id]++
+		case <-time.After(10 * time.Second):
+			t.Fatalf("broadcast is not received: %v", rcvd)
+		}
+	}
+	if rcvd[h1.ID()] != 1 || rcvd[h2.ID()] != 1 {
+		t.Errorf("invalid broadcast receivers: %v", rcvd)
+	}
+
+	select {
+	case id := <-ch:
+		t.Errorf("broadcast is received more than once on hive %v", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMockRcvContextRecordsSends(t *testing.T) {
+	ctx := &MockRcvContext{CtxID: 1}
+	ctx.BroadcastToApp(bcastTestMsg("b"), "bcastapp")
+	if len(ctx.CtxMsgs) != 1 {
+		t.Fatalf("invalid number of messages: actual=%v want=1",
+			len(ctx.CtxMsgs))
+	}
+	m := ctx.CtxMsgs[0].(MockMsg)
+	if m.MsgApp != "bcastapp" || !m.IsBroadCast() {
+		t.Errorf("invalid broadcast: %+v", m)
+	}
+
+	cells := MappedCells{{"D", "1"}, {"D", "2"}}
+	if n := ctx.SendToCells(bcastTestMsg("c"), "bcastapp", cells); n != nil {
+		t.Errorf("invalid cells with no owner: %v", n)
+	}
+	ctx.SendToCell(bcastTestMsg("c"), "bcastapp", CellKey{"D", "3"})
+	if len(ctx.CtxCellMsgs) != 2 {
+		t.Fatalf("invalid number of cell messages: actual=%v want=2",
+			len(ctx.CtxCellMsgs))
+	}
+	if cm := ctx.CtxCellMsgs[0]; cm.App != "bcastapp" || len(cm.Cells) != 2 {
+		t.Errorf("invalid cell message: %+v", cm)
+	}
+}
+
+type mcastTestMsg string
+
+type mcastTestSend struct {
+	To   []uint64
+	Fail bool
+}
+
+func registerMulticastApp(h Hive, ch chan uint64) App {
+	a := h.NewApp("mcastapp")
+	a.HandleFunc(mcastTestMsg(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", string(msg.Data().(mcastTestMsg))}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- ctx.ID()
+			return nil
+		})
+	a.HandleFunc(mcastTestSend{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"S", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			s := msg.Data().(mcastTestSend)
+			ctx.SendToBees(mcastTestMsg(""), s.To)
+			if s.Fail {
+				return errors.New("multicast test failure")
+			}
+			return nil
+		})
+	return a
+}
+
+func TestSendToBees(t *testing.T) {
+	ch := make(chan uint64)
+
+	cfg1 := DefaultCfg
+	cfg1.StatePath = "/tmp/bhtest_mcast1"
+	cfg1.Addr = newHiveAddrForTest()
+	removeState(cfg1)
+	defer removeState(cfg1)
+	h1 := NewHiveWithConfig(cfg1)
+	registerMulticastApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	cfg2 := DefaultCfg
+	cfg2.StatePath = "/tmp/bhtest_mcast2"
+	cfg2.Addr = newHiveAddrForTest()
+	cfg2.PeerAddrs = []string{cfg1.Addr}
+	removeState(cfg2)
+	defer removeState(cfg2)
+	h2 := NewHiveWithConfig(cfg2)
+	registerMulticastApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// Create two bees on each hive.
+	var bees []uint64
+	for _, k := range []string{"k1", "k2"} {
+		h1.Emit(mcastTestMsg(k))
+		bees = append(bees, <-ch)
+		h2.Emit(mcastTestMsg(k + "'"))
+		bees = append(bees, <-ch)
+	}
+	to := append(append([]uint64{}, bees...), bees...)
+
+	// The messages of a failed transaction are dropped.
+	h1.Emit(mcastTestSend{To: to, Fail: true})
+	h1.Emit(mcastTestSend{To: to})
+	rcvd := make(map[uint64]int)
+	for range bees {
+		select {
+		case id := <-ch:
+			rcvd[id]++
+		case <-time.After(10 * time.Second):
+			t.Fatalf("multicast is not received: %v", rcvd)
+		}
+	}
+	for _, id := range bees {
+		if rcvd[id] != 1 {
+			t.Errorf("invalid multicast receivers: actual=%v want=%v", rcvd, bees)
+		}
+	}
+
+	select {
+	case id := <-ch:
+		t.Errorf("multicast is received more than once by bee %v", id)
+	case <-time.After(1 * time.Second):
+	}
+}
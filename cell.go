@@ -122,6 +122,19 @@ func (s *cellStore) cells(bee uint64) MappedCells {
 	return c
 }
 
+// release removes the cells of bee in app from the store.
+func (s *cellStore) release(app string, bee uint64) {
+	acells := s.CellBees[app]
+	for d, dict := range s.BeeCells[bee] {
+		for k := range dict {
+			if c, ok := acells[d][k]; ok && c.Leader == bee {
+				delete(acells[d], k)
+			}
+		}
+	}
+	delete(s.BeeCells, bee)
+}
+
 func (s *cellStore) updateColony(app string, oldc Colony, newc Colony) error {
 	bdicts := s.BeeCells[oldc.Leader]
 	if oldc.Leader != newc.Leader {
@@ -0,0 +1,111 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"strings"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// StateChange is emitted for each key modified by a committed transaction of an
+// application with a change feed (see AppWithChangeFeed). Other applications
+// can handle StateChange to maintain materialized views or audit trails.
+type StateChange struct {
+	App  string // The application of the bee.
+	Bee  uint64 // The bee that committed the transaction.
+	Dict string // The dictionary of the key.
+	Key  string // The modified key.
+	Old  []byte // The value before the transaction, nil if the key was absent.
+	New  []byte // The value after the transaction, nil if the key is deleted.
+}
+
+// Deleted returns whether the key is deleted by the transaction.
+func (c StateChange) Deleted() bool {
+	return c.New == nil
+}
+
+// ChangeFilter selects the keys published in a change feed. An empty Dict
+// matches all dictionaries, and an empty KeyPrefix matches all keys.
+type ChangeFilter struct {
+	Dict      string
+	KeyPrefix string
+}
+
+func (f ChangeFilter) match(dict, key string) bool {
+	return (f.Dict == "" || f.Dict == dict) && strings.HasPrefix(key, f.KeyPrefix)
+}
+
+// AppWithChangeFeed is an application option that emits a StateChange for
+// each key modified by the committed transactions of the application's bees,
+// and is only effective for transactional applications. If filters are given,
+// only the keys matching one of the filters are published. In persistent
+// applications, changes are emitted by the leader once the transaction is
+// applied. Dictionaries whose names start with "__" are internal to beehive
+// and are never published (see internalDict).
+func AppWithChangeFeed(filters ...ChangeFilter) AppOption {
+	return func(a *app) {
+		a.changeFeed = true
+		a.changeFilters = filters
+	}
+}
+
+func (a *app) publishes(dict, key string) bool {
+	if !a.changeFeed || internalDict(dict) {
+		return false
+	}
+	if len(a.changeFilters) == 0 {
+		return true
+	}
+	for _, f := range a.changeFilters {
+		if f.match(dict, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// changes returns the state changes that ops make to the committed state of
+// the bee. It must be called before ops are applied.
+func (b *bee) changes(ops []state.Op) []StateChange {
+	if !b.app.changeFeed {
+		return nil
+	}
+
+	var chs []StateChange
+	for _, o := range ops {
+		if !b.app.publishes(o.D, o.K) {
+			continue
+		}
+		old, err := b.stateL1.State.Dict(o.D).Get(o.K)
+		v, ok, err := o.Result(old, err == nil)
+		if err != nil {
+			// The operation is not applied.
+			continue
+		}
+		ch := StateChange{
+			App:  b.app.Name(),
+			Bee:  b.ID(),
+			Dict: o.D,
+			Key:  o.K,
+			Old:  old,
+		}
+		if ok {
+			ch.New = v
+			if ch.New == nil {
+				ch.New = []byte{}
+			}
+		}
+		chs = append(chs, ch)
+	}
+	return chs
+}
+
+func (b *bee) emitChanges(chs []StateChange) {
+	for _, ch := range chs {
+		b.doEmit(newMsgFromData(ch, b.ID(), 0))
+	}
+}
+
+func init() {
+	gob.Register(StateChange{})
+}
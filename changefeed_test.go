@@ -0,0 +1,81 @@
+package beehive
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type changeFeedTestPut struct {
+	Dict string
+	Key  string
+	Val  string
+}
+
+type changeFeedTestDel string
+
+func TestChangeFeed(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_changefeed"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	src := h.NewApp("source", Transactional(),
+		AppWithChangeFeed(ChangeFilter{Dict: "D"}))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	src.HandleFunc(changeFeedTestPut{}, mf, func(msg Msg, ctx RcvContext) error {
+		p := msg.Data().(changeFeedTestPut)
+		return ctx.Dict(p.Dict).Put(p.Key, []byte(p.Val))
+	})
+	src.HandleFunc(changeFeedTestDel(""), mf, func(msg Msg,
+		ctx RcvContext) error {
+
+		return ctx.Dict("D").Del(string(msg.Data().(changeFeedTestDel)))
+	})
+
+	changes := make(chan StateChange)
+	audit := h.NewApp("audit")
+	audit.HandleFunc(StateChange{}, func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"A", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		changes <- msg.Data().(StateChange)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	expect := func(key string, old, new []byte) {
+		select {
+		case c := <-changes:
+			if c.App != "source" || c.Dict != "D" || c.Key != key ||
+				!bytes.Equal(c.Old, old) || !bytes.Equal(c.New, new) ||
+				c.Deleted() != (new == nil) {
+				t.Errorf("invalid change: %+v", c)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no change for %v", key)
+		}
+	}
+
+	h.Emit(changeFeedTestPut{Dict: "D", Key: "k", Val: "v1"})
+	expect("k", nil, []byte("v1"))
+	h.Emit(changeFeedTestPut{Dict: "D", Key: "k", Val: "v2"})
+	expect("k", []byte("v1"), []byte("v2"))
+
+	// Dictionary E is filtered out.
+	h.Emit(changeFeedTestPut{Dict: "E", Key: "k", Val: "v"})
+	h.Emit(changeFeedTestDel("k"))
+	expect("k", []byte("v2"), nil)
+
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change: %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,8 +2,10 @@ package beehive
 
 import (
 	"encoding/gob"
+	"time"
 
 	"github.com/kandoo/beehive/raft"
+	"github.com/kandoo/beehive/state"
 )
 
 type cmdAddFollower struct {
@@ -12,50 +14,90 @@ type cmdAddFollower struct {
 }
 type cmdAddHive struct{ Info raft.NodeInfo }
 type cmdCampaign struct{}
+type cmdCheckDistTx struct{ ID uint64 }
 type cmdCreateBee struct{}
+type cmdExpire struct{}
+type cmdExportState struct{}
 type cmdFindBee struct{ ID uint64 }
 type cmdHandoff struct{ To uint64 }
 type cmdRestoreState struct{ State []byte }
+type cmdRewriteOutdated struct{}
+type cmdImportState struct {
+	Dicts     map[string]map[string]dictValue
+	Overwrite bool
+}
 type cmdJoinColony struct{ Colony Colony }
 type cmdAddMappedCells struct{ Cells MappedCells }
+type cmdBroadcast struct{ Msg msg }
+type cmdReadIndex struct{}
 type cmdRefreshRole struct{}
+type cmdResolveDistTx struct {
+	ID     uint64
+	Commit bool
+}
 type cmdLiveHives struct{}
 type cmdMigrate struct {
 	Bee uint64
 	To  uint64
 }
-type cmdNewHiveID struct{ Addr string }
+type cmdNewHiveID struct {
+	Addr   string
+	Labels map[string]string
+}
 type cmdPing struct{}
+type cmdPrepareDistTx struct {
+	ID  uint64
+	Ops []state.Op
+}
+type cmdProcessRegistry struct{ Req interface{} }
+type cmdPromote struct{}
+type cmdRegistryUpdates struct{ Since uint64 }
 type cmdReloadBee struct {
 	ID     uint64
 	Colony Colony
 }
 type cmdStart struct{}
 type cmdStartDetached struct{ Handler DetachedHandler }
+type cmdPassivate struct{ Timeout time.Duration }
 type cmdStop struct{}
 type cmdSync struct{}
+type cmdUpdateHive struct{ Info HiveInfo }
 
 func init() {
 	gob.Register(cmdAddFollower{})
 	gob.Register(cmdAddHive{})
 	gob.Register(cmdAddHive{})
 	gob.Register(cmdAddMappedCells{})
+	gob.Register(cmdBroadcast{})
 	gob.Register(cmdCampaign{})
+	gob.Register(cmdCheckDistTx{})
 	gob.Register(cmdCreateBee{})
 	gob.Register(cmdCreateBee{})
+	gob.Register(cmdExpire{})
+	gob.Register(cmdExportState{})
 	gob.Register(cmdFindBee{})
 	gob.Register(cmdFindBee{})
 	gob.Register(cmdHandoff{})
+	gob.Register(cmdImportState{})
 	gob.Register(cmdJoinColony{})
 	gob.Register(cmdLiveHives{})
 	gob.Register(cmdMigrate{})
 	gob.Register(cmdNewHiveID{})
 	gob.Register(cmdPing{})
+	gob.Register(cmdPrepareDistTx{})
+	gob.Register(cmdProcessRegistry{})
+	gob.Register(cmdPromote{})
+	gob.Register(cmdRegistryUpdates{})
+	gob.Register(cmdReadIndex{})
 	gob.Register(cmdRefreshRole{})
+	gob.Register(cmdResolveDistTx{})
 	gob.Register(cmdReloadBee{})
 	gob.Register(cmdRestoreState{})
+	gob.Register(cmdRewriteOutdated{})
 	gob.Register(cmdStartDetached{})
 	gob.Register(cmdStart{})
+	gob.Register(cmdPassivate{})
 	gob.Register(cmdStop{})
 	gob.Register(cmdSync{})
+	gob.Register(cmdUpdateHive{})
 }
@@ -52,10 +52,14 @@ func (c *ComposedHandler) callMap(h bh.Handler, msg bh.Msg, ctx bh.MapContext) (
 	return
 }
 
-// Rcv method of the composed handler.
+// Rcv method of the composed handler. In transactional applications, the
+// changes of a handler that fails are rolled back before continuing to the next
+// handler.
 func (c *ComposedHandler) Rcv(msg bh.Msg, ctx bh.RcvContext) error {
 	var err error
 	for i := range c.Handlers {
+		sp := "composition/" + strconv.Itoa(i)
+		spErr := ctx.Savepoint(sp)
 		if c.Isolate {
 			rctx := composedRcvContext{RcvContext: ctx, prefix: strconv.Itoa(i)}
 			err = c.callRcv(c.Handlers[i], msg, rctx)
@@ -85,6 +89,14 @@ func (c *ComposedHandler) Rcv(msg bh.Msg, ctx bh.RcvContext) error {
 				return nil
 			}
 		}
+
+		if spErr != nil {
+			continue
+		}
+		if err != nil {
+			ctx.RollbackTo(sp)
+		}
+		ctx.ReleaseSavepoint(sp)
 	}
 	return nil
 }
@@ -163,3 +163,38 @@ func TestEverything(t *testing.T) {
 	testComposition(t, handlers, composed, []int{1, 1, 0}, []int{1, 1, 1}, false,
 		cells, false)
 }
+
+func TestAnyRollsBackFailedHandler(t *testing.T) {
+	ctx := newMockContext()
+	handlers := []*mockHandler{
+		&mockHandler{
+			mapFunc: localMap,
+			rcvFunc: func(msg bh.Msg, ctx bh.RcvContext) error {
+				ctx.Dict("D").Put("failed", []byte{})
+				return errors.New("error in rcv")
+			},
+		},
+		&mockHandler{
+			mapFunc: localMap,
+			rcvFunc: func(msg bh.Msg, ctx bh.RcvContext) error {
+				ctx.Dict("D").Put("succeeded", []byte{})
+				return nil
+			},
+		},
+	}
+
+	composed := &ComposedHandler{
+		Handlers: []bh.Handler{handlers[0], handlers[1]},
+		Composer: ComposeAny,
+	}
+	ctx.BeginTx()
+	if err := composed.Rcv(nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Dict("D").Get("failed"); err == nil {
+		t.Error("changes of the failed handler are not rolled back")
+	}
+	if _, err := ctx.Dict("D").Get("succeeded"); err != nil {
+		t.Errorf("changes of the successful handler are lost: %v", err)
+	}
+}
@@ -28,15 +28,24 @@ func (c mockContext) App() string {
 }
 
 func (c mockContext) LocalMappedCells() bh.MappedCells {
-	return bh.MappedCells{{"D", "K"}}
+	return bh.MappedCells{{Dict: "D", Key: "K"}}
 }
 
 func (c mockContext) ID() uint64 {
 	return 0
 }
 
-func (c mockContext) Emit(msgData interface{})                 {}
-func (c mockContext) SendToBee(msgData interface{}, to uint64) {}
+func (c mockContext) Emit(msgData interface{})                       {}
+func (c mockContext) SendToBee(msgData interface{}, to uint64)       {}
+func (c mockContext) BroadcastToApp(msgData interface{}, app string) {}
+func (c mockContext) SendToBees(msgData interface{}, to []uint64)    {}
+func (c mockContext) SendToCells(msgData interface{}, app string,
+	cells bh.MappedCells) bh.MappedCells {
+	return nil
+}
+func (c mockContext) SendToCell(msgData interface{}, app string,
+	cell bh.CellKey) {
+}
 func (c mockContext) SendToCellKey(msgData interface{}, to string,
 	dk bh.CellKey) {
 }
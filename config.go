@@ -0,0 +1,198 @@
+package beehive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// ConfigReload is the result of reloading the configuration of a hive.
+type ConfigReload struct {
+	Applied         []string `json:"applied"`          // fields applied.
+	RequiresRestart []string `json:"requires_restart"` // fields ignored.
+}
+
+func (r ConfigReload) String() string {
+	return fmt.Sprintf("applied=%v requires_restart=%v", r.Applied,
+		r.RequiresRestart)
+}
+
+var (
+	// ErrNoConfigFile is returned when the hive has no configuration file to
+	// reload.
+	ErrNoConfigFile = errors.New("no configuration file")
+	// ErrInvalidConfig is returned when a reloaded configuration is invalid.
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// reloadableConfigFields are the fields of HiveConfig that can be changed
+// while the hive is running. Any other field requires a restart. Note that a
+// reloaded ConnTimeout only applies to new connections: existing proxies and
+// batchers keep the client they were created with.
+var reloadableConfigFields = map[string]bool{
+	"BatchSize":         true,
+	"OptimizeThresh":    true,
+	"OptimizeDryRun":    true,
+	"MigrationCooldown": true,
+	"MigrationRetries":  true,
+	"MaxMigrations":     true,
+	"ConnTimeout":       true,
+	"BatcherTimeout":    true,
+	"ConfigFile":        true,
+	"LogVerbosity":      true,
+}
+
+func validateReloadedConfig(cfg HiveConfig) error {
+	switch {
+	case cfg.BatchSize <= 0:
+		return fmt.Errorf("%v: batch size must be positive", ErrInvalidConfig)
+	case cfg.ConnTimeout <= 0:
+		return fmt.Errorf("%v: connection timeout must be positive",
+			ErrInvalidConfig)
+	case cfg.BatcherTimeout <= 0:
+		return fmt.Errorf("%v: batcher timeout must be positive",
+			ErrInvalidConfig)
+	case cfg.MigrationCooldown < 0 || cfg.MigrationRetries < 0 ||
+		cfg.MaxMigrations < 0:
+		return fmt.Errorf("%v: migration settings must not be negative",
+			ErrInvalidConfig)
+	}
+	return nil
+}
+
+func (h *hive) ReloadConfig(cfg HiveConfig) (ConfigReload, error) {
+	var r ConfigReload
+	if err := validateReloadedConfig(cfg); err != nil {
+		return r, err
+	}
+
+	h.cfgM.Lock()
+	defer h.cfgM.Unlock()
+
+	oldv := reflect.ValueOf(&h.config).Elem()
+	newv := reflect.ValueOf(cfg)
+	t := oldv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i).Name
+		if reflect.DeepEqual(oldv.Field(i).Interface(),
+			newv.Field(i).Interface()) {
+			continue
+		}
+
+		if !reloadableConfigFields[f] {
+			r.RequiresRestart = append(r.RequiresRestart, f)
+			continue
+		}
+
+		oldv.Field(i).Set(newv.Field(i))
+		r.Applied = append(r.Applied, f)
+
+		switch f {
+		case "BatchSize":
+			atomic.StoreInt64(&h.batch, int64(cfg.BatchSize))
+		case "ConnTimeout":
+			h.client = newHTTPClient(cfg.ConnTimeout)
+		case "LogVerbosity":
+			if cfg.LogVerbosity < 0 {
+				break
+			}
+			v := strconv.Itoa(cfg.LogVerbosity)
+			if err := flag.Set("v", v); err != nil {
+				glog.Errorf("%v cannot set log verbosity to %v: %v", h, v, err)
+			}
+		}
+	}
+
+	if len(r.RequiresRestart) != 0 {
+		glog.Warningf("%v needs a restart to apply %v", h, r.RequiresRestart)
+	}
+	return r, nil
+}
+
+// reloadConfigFile reloads the configuration from the config file of the hive.
+func (h *hive) reloadConfigFile() (ConfigReload, error) {
+	cfg := h.Config()
+	if cfg.ConfigFile == "" {
+		return ConfigReload{}, ErrNoConfigFile
+	}
+
+	b, err := ioutil.ReadFile(cfg.ConfigFile)
+	if err != nil {
+		return ConfigReload{}, err
+	}
+
+	if cfg, err = parseConfig(bytes.NewReader(b), cfg); err != nil {
+		return ConfigReload{}, err
+	}
+	return h.ReloadConfig(cfg)
+}
+
+// parseConfig parses a configuration in r and overlays it on base. Each line
+// in r is in the form of "name=value", where name is a command line flag of
+// the hive (e.g., "batch=512"). Empty lines and lines starting with '#' are
+// ignored.
+func parseConfig(r io.Reader, base HiveConfig) (HiveConfig, error) {
+	cfg := base
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindConfigFlags(fs, &cfg)
+	// bindConfigFlags resets the fields to their defaults.
+	cfg = base
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return base, fmt.Errorf("%v: line %v: %q", ErrInvalidConfig, n, l)
+		}
+
+		k := strings.TrimLeft(strings.TrimSpace(kv[0]), "-")
+		if err := fs.Set(k, strings.TrimSpace(kv[1])); err != nil {
+			return base, fmt.Errorf("%v: line %v: %v", ErrInvalidConfig, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return base, err
+	}
+	return cfg, nil
+}
+
+func (h *hive) httpClient() *http.Client {
+	h.cfgM.RLock()
+	defer h.cfgM.RUnlock()
+	return h.client
+}
+
+// batchSize returns the batch size of the bees. It is read without locking
+// cfgM, since bees read it for each batch of messages.
+func (h *hive) batchSize() int {
+	return int(atomic.LoadInt64(&h.batch))
+}
+
+func (h *hive) batcherTimeout() time.Duration {
+	h.cfgM.RLock()
+	defer h.cfgM.RUnlock()
+	return h.config.BatcherTimeout
+}
+
+func (h *hive) optimizeThresh() uint64 {
+	h.cfgM.RLock()
+	defer h.cfgM.RUnlock()
+	return uint64(h.config.OptimizeThresh)
+}
@@ -0,0 +1,62 @@
+package beehive
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	base := DefaultCfg
+	base.BatchSize = 10
+	cfg, err := parseConfig(strings.NewReader(`
+		# a comment.
+		batch=512
+		-batchertimeout = 2ms
+	`), base)
+	if err != nil {
+		t.Fatalf("cannot parse config: %v", err)
+	}
+	if cfg.BatchSize != 512 {
+		t.Errorf("invalid batch size: actual=%v want=512", cfg.BatchSize)
+	}
+	if cfg.BatcherTimeout != 2*time.Millisecond {
+		t.Errorf("invalid batcher timeout: actual=%v want=2ms", cfg.BatcherTimeout)
+	}
+	if cfg.Addr != base.Addr || cfg.RaftTick != base.RaftTick {
+		t.Errorf("config is not overlaid on the base config: %#v", cfg)
+	}
+
+	if _, err := parseConfig(strings.NewReader("nosuchflag=1"), base); err == nil {
+		t.Error("no error for an invalid flag")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfg := DefaultCfg
+	h := &hive{config: cfg}
+	cfg.BatchSize = 1
+	cfg.OptimizeThresh = 100
+	cfg.RaftTick = 2 * time.Second
+	r, err := h.ReloadConfig(cfg)
+	if err != nil {
+		t.Fatalf("cannot reload config: %v", err)
+	}
+	if len(r.Applied) != 2 {
+		t.Errorf("invalid applied fields: %v", r.Applied)
+	}
+	if len(r.RequiresRestart) != 1 || r.RequiresRestart[0] != "RaftTick" {
+		t.Errorf("invalid fields requiring restart: %v", r.RequiresRestart)
+	}
+	if h.batchSize() != 1 || h.optimizeThresh() != 100 {
+		t.Errorf("reloadable fields are not applied: %#v", h.Config())
+	}
+	if h.Config().RaftTick != DefaultCfg.RaftTick {
+		t.Error("a field requiring restart is applied")
+	}
+
+	cfg.BatchSize = 0
+	if _, err := h.ReloadConfig(cfg); err == nil {
+		t.Error("no error for an invalid config")
+	}
+}
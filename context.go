@@ -38,8 +38,16 @@ type RcvContext interface {
 	// SendToCell sends a message to the bee of the give app that owns the
 	// given cell.
 	SendToCell(msgData interface{}, app string, cell CellKey)
+	// SendToCells sends one copy of a message to each bee of the given app that
+	// owns any of the given cells, and returns the cells that have no owner.
+	SendToCells(msgData interface{}, app string, cells MappedCells) MappedCells
 	// SendToBee sends a message to the given bee.
 	SendToBee(msgData interface{}, to uint64)
+	// SendToBees sends one copy of a message to each of the given bees.
+	SendToBees(msgData interface{}, to []uint64)
+	// BroadcastToApp sends a message to the leaders of all colonies of the
+	// given app, on all hives.
+	BroadcastToApp(msgData interface{}, app string)
 	// ReplyTo replies to a message: Sends a message from the current bee to the
 	// bee that emitted msg.
 	ReplyTo(msg Msg, replyData interface{}) error
@@ -76,4 +84,16 @@ type RcvContext interface {
 	CommitTx() error
 	// Aborts the transaction.
 	AbortTx() error
+
+	// Savepoint marks the changes and the messages of the current transaction
+	// as savepoint name. Savepoints let handlers undo part of their work
+	// without aborting the whole transaction.
+	Savepoint(name string) error
+	// RollbackTo discards the changes and the messages of the current
+	// transaction after savepoint name. The savepoint is kept, but the
+	// savepoints created after it are released.
+	RollbackTo(name string) error
+	// ReleaseSavepoint releases savepoint name and the savepoints created after
+	// it, keeping the changes and the messages of the transaction.
+	ReleaseSavepoint(name string) error
 }
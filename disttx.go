@@ -0,0 +1,421 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+// A distributed transaction atomically writes cells owned by different
+// colonies of an application, using two-phase commit coordinated by the bee
+// that commits the transaction:
+//
+// 1. The coordinator sends the operations staged for each colony to its
+//    leader. The leader records them as prepared, through raft in persistent
+//    applications, and votes for the transaction. A bee does not receive
+//    messages while it has a prepared transaction, and votes against any other
+//    transaction.
+// 2. The coordinator records its decision in the registry and sends it to the
+//    participants, which apply or discard the prepared operations.
+//
+// Only the first decision for a transaction is recorded in the registry. A
+// participant joins the transaction in the registry before preparing it, and
+// refuses to prepare a transaction that is already decided. A participant that
+// does not receive the decision in time, for example because the coordinator
+// has failed, asks the registry and decides to abort if there is no decision
+// yet. The registry forgets a decision once all the participants have resolved
+// the transaction.
+
+var (
+	// ErrDistTxAborted is returned when a distributed transaction is aborted.
+	ErrDistTxAborted = errors.New("distributed transaction aborted")
+	// ErrDistTxConflict is returned when a distributed transaction writes a
+	// cell that is also written in the open transaction of its coordinator.
+	ErrDistTxConflict = errors.New(
+		"distributed transaction conflicts with the open transaction")
+)
+
+const (
+	// distTxTimeout is how long the coordinator waits for the participants in
+	// each phase.
+	distTxTimeout = 5 * time.Second
+	// distTxInDoubtTimeout is how long a participant waits for the decision
+	// before asking the registry.
+	distTxInDoubtTimeout = 3 * distTxTimeout
+	// distTxDict is the dictionary in which participants store their prepared
+	// transactions.
+	distTxDict = "__dist_tx__"
+)
+
+// DistTx is a distributed transaction on the cells of an application. The
+// cells must be owned by bees, for example by sending them a message first.
+type DistTx struct {
+	b     *bee
+	app   string
+	cells []CellKey
+	ops   map[CellKey]state.Op
+}
+
+// BeginDistTx begins a distributed transaction on the cells of app, which is
+// coordinated by the bee of ctx. The transaction is committed by calling
+// Commit, typically in the Rcv function of a handler. Note that Commit blocks
+// the coordinator, which does not receive any message meanwhile, for up to
+// twice distTxTimeout (10s) plus the registry round trips.
+func BeginDistTx(ctx RcvContext, app string) (*DistTx, error) {
+	b, ok := ctx.(*bee)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot coordinate distributed transactions",
+			ctx)
+	}
+	return &DistTx{
+		b:   b,
+		app: app,
+		ops: make(map[CellKey]state.Op),
+	}, nil
+}
+
+// Put stages storing v in cell.
+func (t *DistTx) Put(cell CellKey, v []byte) {
+	t.stage(cell, state.Op{T: state.Put, D: cell.Dict, K: cell.Key, V: v})
+}
+
+// Del stages deleting cell.
+func (t *DistTx) Del(cell CellKey) {
+	t.stage(cell, state.Op{T: state.Del, D: cell.Dict, K: cell.Key})
+}
+
+func (t *DistTx) stage(cell CellKey, o state.Op) {
+	if _, ok := t.ops[cell]; !ok {
+		t.cells = append(t.cells, cell)
+	}
+	t.ops[cell] = o
+}
+
+// Commit atomically applies the staged operations on the bees that own the
+// cells. It blocks until the transaction is decided, and returns
+// ErrDistTxAborted if any of the bees cannot prepare the transaction. The
+// operations on the cells of the coordinator are applied outside its open
+// transaction, and Commit returns ErrDistTxConflict if that transaction writes
+// any of them.
+func (t *DistTx) Commit() error {
+	if len(t.cells) == 0 {
+		return nil
+	}
+
+	a, ok := t.b.hive.app(t.app)
+	if !ok {
+		return fmt.Errorf("no such application %v", t.app)
+	}
+
+	var bees []uint64
+	parts := make(map[uint64][]state.Op)
+	for _, c := range t.cells {
+		owners, _ := t.b.hive.registry.beesForCells(t.app, MappedCells{c})
+		if len(owners) == 0 {
+			return fmt.Errorf("cell %v of %v is not owned by any bee", c, t.app)
+		}
+		bid := owners[0]
+		if _, ok := parts[bid]; !ok {
+			bees = append(bees, bid)
+		}
+		parts[bid] = append(parts[bid], t.ops[c])
+	}
+	if ops, ok := parts[t.b.ID()]; ok && t.b.stagesAnyOf(ops) {
+		return ErrDistTxConflict
+	}
+
+	res, err := t.b.hive.processRaft(context.TODO(), newDistTxID{})
+	if err != nil {
+		return err
+	}
+	id := res.(uint64)
+
+	glog.V(2).Infof("%v prepares distributed transaction %v on %v", t.b, id,
+		bees)
+	prepared := t.call(a.qee, bees, func(bid uint64) interface{} {
+		return cmdPrepareDistTx{ID: id, Ops: parts[bid]}
+	})
+
+	res, err = t.b.hive.processRaft(context.TODO(),
+		decideDistTx{ID: id, Commit: len(prepared) == len(bees)})
+	if err != nil {
+		// The participants will ask the registry for the decision.
+		return err
+	}
+	commit := res.(bool)
+
+	glog.V(2).Infof("%v resolves distributed transaction %v: commit=%v", t.b,
+		id, commit)
+	resolved := t.call(a.qee, bees, func(bid uint64) interface{} {
+		return cmdResolveDistTx{ID: id, Commit: commit}
+	})
+	// The participants that do not resolve the transaction now forget it when
+	// they recover it.
+	if len(resolved) != 0 {
+		if _, err := t.b.hive.processRaft(context.TODO(),
+			forgetDistTx{ID: id, Bees: resolved}); err != nil {
+			glog.Errorf("%v cannot forget distributed transaction %v: %v", t.b, id,
+				err)
+		}
+	}
+
+	if !commit {
+		return ErrDistTxAborted
+	}
+	return nil
+}
+
+// distTxResult is the result of a distributed transaction command on a bee.
+type distTxResult struct {
+	bee uint64
+	err error
+}
+
+// call sends the commands created by cmdFn to bees in parallel, and returns
+// the bees that successfully handled the command before the timeout.
+func (t *DistTx) call(q *qee, bees []uint64,
+	cmdFn func(bid uint64) interface{}) (done []uint64) {
+
+	ch := make(chan distTxResult, len(bees))
+	for _, bid := range bees {
+		c := cmdFn(bid)
+		if bid == t.b.ID() {
+			// The coordinator is blocked in this call and handles its own command.
+			_, err := t.b.handleDistTxCmd(c)
+			ch <- distTxResult{bee: bid, err: err}
+			continue
+		}
+		go func(bid uint64) {
+			_, err := q.sendCmdToBee(bid, c)
+			ch <- distTxResult{bee: bid, err: err}
+		}(bid)
+	}
+
+	timeout := time.After(distTxTimeout)
+	for _ = range bees {
+		select {
+		case res := <-ch:
+			if res.err != nil {
+				glog.Errorf("%v cannot run distributed transaction on %v: %v", t.b,
+					res.bee, res.err)
+				continue
+			}
+			done = append(done, res.bee)
+		case <-timeout:
+			glog.Errorf("%v times out on distributed transaction", t.b)
+			return done
+		}
+	}
+	return done
+}
+
+// stagesAnyOf returns whether the open transactions of the bee write any of
+// the cells written by ops.
+func (b *bee) stagesAnyOf(ops []state.Op) bool {
+	cells := make(map[CellKey]bool, len(ops))
+	for _, o := range ops {
+		cells[CellKey{Dict: o.D, Key: o.K}] = true
+	}
+	for _, s := range []*state.Transactional{b.stateL1, b.stateL2} {
+		if s == nil || s.TxStatus() != state.TxOpen {
+			continue
+		}
+		for _, o := range s.TxOps() {
+			if cells[CellKey{Dict: o.D, Key: o.K}] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareDistTx is the raft request to prepare a distributed transaction on a
+// bee.
+type prepareDistTx struct {
+	ID  uint64
+	Ops []state.Op
+}
+
+// resolveDistTx is the raft request to commit or abort a prepared distributed
+// transaction.
+type resolveDistTx struct {
+	ID     uint64
+	Commit bool
+}
+
+// handleDistTxCmd handles the distributed transaction commands of the bee.
+func (b *bee) handleDistTxCmd(c interface{}) (interface{}, error) {
+	switch c := c.(type) {
+	case cmdPrepareDistTx:
+		return nil, b.prepareDistTx(c.ID, c.Ops)
+	case cmdResolveDistTx:
+		return nil, b.proposeDistTx(resolveDistTx{ID: c.ID, Commit: c.Commit})
+	case cmdCheckDistTx:
+		return nil, b.checkDistTx(c.ID)
+	}
+	return nil, ErrInvalidCmd
+}
+
+func (b *bee) prepareDistTx(id uint64, ops []state.Op) error {
+	if b.detached || b.proxy || !b.isLeader() {
+		return fmt.Errorf("%v is not a leader", b)
+	}
+	if b.inDoubt() {
+		return fmt.Errorf("%v has a distributed transaction in doubt", b)
+	}
+	res, err := b.hive.processRaft(context.TODO(),
+		joinDistTx{ID: id, Bee: b.ID()})
+	if err != nil {
+		return err
+	}
+	if !res.(bool) {
+		return fmt.Errorf("distributed transaction %v is already decided", id)
+	}
+	if err := b.proposeDistTx(prepareDistTx{ID: id, Ops: ops}); err != nil {
+		return err
+	}
+	b.checkDistTxLater(id)
+	return nil
+}
+
+// proposeDistTx applies a prepareDistTx or a resolveDistTx request on the bee,
+// and replicates it if the application is persistent.
+func (b *bee) proposeDistTx(req interface{}) error {
+	if node := b.raftNode(); b.app.persistent() && node != nil {
+		ctx, ccl := context.WithTimeout(context.Background(),
+			b.hive.config.RaftElectTimeout())
+		defer ccl()
+		_, err := node.Process(ctx, req)
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return b.applyDistTx(req)
+}
+
+// applyDistTx applies req on the state of the bee, bypassing any open
+// transaction. The bee must be locked.
+func (b *bee) applyDistTx(req interface{}) error {
+	d := b.stateL1.State.Dict(distTxDict)
+	switch r := req.(type) {
+	case prepareDistTx:
+		if b.distTxs == nil {
+			b.distTxs = make(map[uint64][]state.Op)
+		}
+		b.distTxs[r.ID] = r.Ops
+		return d.PutGob(strconv.FormatUint(r.ID, 10), r)
+
+	case resolveDistTx:
+		ops, ok := b.distTxs[r.ID]
+		if !ok {
+			return nil
+		}
+		delete(b.distTxs, r.ID)
+		if r.Commit {
+			var chs []StateChange
+			if b.isLeader() {
+				chs = b.changes(ops)
+			}
+			if err := state.NewTransactional(b.stateL1.State).Apply(ops); err != nil {
+				return err
+			}
+			b.emitChanges(chs)
+		}
+		return d.Del(strconv.FormatUint(r.ID, 10))
+	}
+	return ErrUnsupportedRequest
+}
+
+// inDoubt returns whether the bee has a prepared distributed transaction.
+func (b *bee) inDoubt() bool {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.distTxs) != 0
+}
+
+// loadDistTxs reloads the prepared distributed transactions from the state of
+// the bee, and schedules their recovery if the bee is the leader.
+func (b *bee) loadDistTxs() {
+	b.Lock()
+	b.distTxs = make(map[uint64][]state.Op)
+	b.stateL1.State.Dict(distTxDict).ForEach(func(k string, v []byte) {
+		var p prepareDistTx
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&p); err != nil {
+			glog.Errorf("%v cannot decode distributed transaction %v: %v", b, k, err)
+			return
+		}
+		b.distTxs[p.ID] = p.Ops
+	})
+	b.Unlock()
+
+	b.checkDistTxsLater()
+}
+
+// checkDistTxsLater schedules the recovery of all the prepared distributed
+// transactions of the bee, if it is the leader.
+func (b *bee) checkDistTxsLater() {
+	if b.detached || b.proxy || !b.isLeader() {
+		return
+	}
+	b.Lock()
+	ids := make([]uint64, 0, len(b.distTxs))
+	for id := range b.distTxs {
+		ids = append(ids, id)
+	}
+	b.Unlock()
+	for _, id := range ids {
+		glog.V(2).Infof("%v has distributed transaction %v in doubt", b, id)
+		b.checkDistTxLater(id)
+	}
+}
+
+func (b *bee) checkDistTxLater(id uint64) {
+	time.AfterFunc(distTxInDoubtTimeout, func() {
+		b.enqueCmd(newCmdAndChannel(cmdCheckDistTx{ID: id}, b.app.Name(), b.ID(),
+			nil))
+	})
+}
+
+// checkDistTx resolves distributed transaction id, if it is still in doubt,
+// using the decision recorded in the registry. If there is no decision, the
+// transaction is aborted.
+func (b *bee) checkDistTx(id uint64) error {
+	if b.detached || b.proxy || !b.isLeader() {
+		return nil
+	}
+	b.Lock()
+	_, ok := b.distTxs[id]
+	b.Unlock()
+	if !ok {
+		return nil
+	}
+
+	res, err := b.hive.processRaft(context.TODO(),
+		decideDistTx{ID: id, Commit: false})
+	if err != nil {
+		b.checkDistTxLater(id)
+		return err
+	}
+	glog.V(2).Infof("%v recovers distributed transaction %v: commit=%v", b, id,
+		res)
+	if err := b.proposeDistTx(resolveDistTx{ID: id,
+		Commit: res.(bool)}); err != nil {
+		return err
+	}
+	_, err = b.hive.processRaft(context.TODO(),
+		forgetDistTx{ID: id, Bees: []uint64{b.ID()}})
+	return err
+}
+
+func init() {
+	gob.Register(prepareDistTx{})
+	gob.Register(resolveDistTx{})
+}
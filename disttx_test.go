@@ -0,0 +1,150 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type distTxTestGet string
+type distTxTestWrite struct {
+	Keys  []string
+	Val   string
+	Local bool // whether to write the cell of the coordinator in its tx.
+}
+
+func TestDistTx(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_disttx"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	a := h.NewApp("disttx")
+	vals := make(chan string)
+	a.HandleFunc(distTxTestGet(""), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", string(msg.Data().(distTxTestGet))}}
+	}, func(msg Msg, ctx RcvContext) error {
+		v, _ := ctx.Dict("D").Get(string(msg.Data().(distTxTestGet)))
+		vals <- string(v)
+		return nil
+	})
+	errs := make(chan error)
+	a.HandleFunc(distTxTestWrite{}, func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"C", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		w := msg.Data().(distTxTestWrite)
+		if w.Local {
+			ctx.Dict("C").Put("0", []byte(w.Val))
+		}
+		tx, err := BeginDistTx(ctx, "disttx")
+		if err != nil {
+			errs <- err
+			return nil
+		}
+		// The coordinator is a participant too.
+		tx.Put(CellKey{"C", "0"}, []byte(w.Val))
+		for _, k := range w.Keys {
+			tx.Put(CellKey{"D", k}, []byte(w.Val))
+		}
+		errs <- tx.Commit()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	get := func(k string) string {
+		h.Emit(distTxTestGet(k))
+		select {
+		case v := <-vals:
+			return v
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no value for %v", k)
+		}
+		return ""
+	}
+
+	for _, k := range []string{"a", "b"} {
+		if v := get(k); v != "" {
+			t.Fatalf("invalid initial value for %v: %v", k, v)
+		}
+	}
+
+	h.Emit(distTxTestWrite{Keys: []string{"a", "b"}, Val: "1"})
+	if err := <-errs; err != nil {
+		t.Fatalf("cannot commit distributed transaction: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if v := get(k); v != "1" {
+			t.Errorf("invalid value for %v: actual=%v want=1", k, v)
+		}
+	}
+
+	// Put the bee of "a" in doubt with a transaction without a coordinator.
+	info, _, err := h.(*hive).registry.beeForCells("disttx",
+		MappedCells{{"D", "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := a.(*app).qee
+	res, err := h.(*hive).processRaft(context.TODO(), newDistTxID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := res.(uint64)
+	if _, err := q.sendCmdToBee(info.ID,
+		cmdPrepareDistTx{ID: orphan}); err != nil {
+		t.Fatalf("cannot prepare orphan transaction: %v", err)
+	}
+
+	h.Emit(distTxTestWrite{Keys: []string{"a", "b"}, Val: "2"})
+	if err := <-errs; err != ErrDistTxAborted {
+		t.Fatalf("invalid error for conflicting transaction: %v", err)
+	}
+	if v := get("b"); v != "1" {
+		t.Errorf("aborted transaction is applied on b: %v", v)
+	}
+
+	// The bee in doubt does not receive messages until the transaction is
+	// recovered.
+	h.Emit(distTxTestGet("a"))
+	select {
+	case v := <-vals:
+		t.Fatalf("bee in doubt receives a message: %v", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := q.sendCmdToBee(info.ID,
+		cmdCheckDistTx{ID: orphan}); err != nil {
+		t.Fatalf("cannot recover orphan transaction: %v", err)
+	}
+	select {
+	case v := <-vals:
+		if v != "1" {
+			t.Errorf("invalid value for a after recovery: %v", v)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("bee does not receive messages after recovery")
+	}
+
+	// The decision is forgotten once the participants have resolved the
+	// transaction, and the transaction cannot be prepared anymore.
+	if txs := h.(*hive).registry.Txs; len(txs) != 0 {
+		t.Errorf("decisions are not forgotten in the registry: %v", txs)
+	}
+	if _, err := q.sendCmdToBee(info.ID,
+		cmdPrepareDistTx{ID: orphan}); err == nil {
+		t.Error("a decided transaction is prepared")
+	}
+
+	h.Emit(distTxTestWrite{Keys: []string{"a"}, Val: "3", Local: true})
+	if err := <-errs; err != ErrDistTxConflict {
+		t.Errorf("invalid error for a conflicting local write: %v", err)
+	}
+	if v := get("a"); v != "1" {
+		t.Errorf("conflicting transaction is applied on a: %v", v)
+	}
+}
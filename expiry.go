@@ -0,0 +1,103 @@
+package beehive
+
+import (
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Keys stored with a TTL (see state.Dict.PutTTL) are invisible once they
+// expire. The qee periodically asks its bees to remove their expired keys.
+// Bees remove them in a transaction, so that, in persistent applications,
+// the removal is replicated to the followers like any other state change.
+
+// defaultSweepInterval is the default interval at which expired keys are
+// removed from the state of bees.
+const defaultSweepInterval = 10 * time.Second
+
+// expire removes the keys expired at now from the state of the bee. If the
+// state of the bee becomes empty and its app releases empty bees, the bee is
+// stopped. expire returns whether the bee is stopped.
+func (b *bee) expire(now time.Time) (bool, error) {
+	if b.detached || b.proxy || !b.isLeader() || b.status != beeStatusStarted {
+		return false, nil
+	}
+
+	ops := b.stateL1.Expired(now)
+	if len(ops) == 0 {
+		return false, nil
+	}
+
+	glog.V(2).Infof("%v removes %v expired keys", b, len(ops))
+	if err := b.BeginTx(); err != nil {
+		return false, err
+	}
+	for _, o := range ops {
+		b.Dict(o.D).Del(o.K)
+	}
+	if err := b.CommitTx(); err != nil {
+		return false, err
+	}
+
+	if !b.app.releasesEmptyBees() || b.app.persistent() || !b.stateL1.Empty() {
+		return false, nil
+	}
+	b.Lock()
+	snoozed := len(b.timers) != 0
+	b.Unlock()
+	if snoozed {
+		return false, nil
+	}
+
+	// As in passivation, the qee is blocked on this command and no message can
+	// be enqueued for the bee.
+	if !b.dataCh.stopIfEmpty() {
+		return false, nil
+	}
+
+	b.fireEvent(BeeStopping)
+	b.status = beeStatusStopped
+	glog.V(2).Infof("%v is stopped with an empty state", b)
+	return true, nil
+}
+
+// expireKeys removes the expired keys of the local bees, and releases the
+// bees that are stopped because their state became empty.
+func (q *qee) expireKeys() {
+	q.RLock()
+	bees := make([]*bee, 0, len(q.bees))
+	for _, b := range q.bees {
+		if !b.detached && !b.proxy {
+			bees = append(bees, b)
+		}
+	}
+	q.RUnlock()
+
+	for _, b := range bees {
+		res, err := b.processCmd(cmdExpire{})
+		if err != nil {
+			glog.Errorf("%v cannot remove expired keys of %v: %v", q, b, err)
+			continue
+		}
+		if !res.(bool) {
+			continue
+		}
+		q.releaseBee(b)
+	}
+}
+
+// releaseBee releases the cells of stopped bee b, and removes it from the
+// registry.
+func (q *qee) releaseBee(b *bee) {
+	q.Lock()
+	delete(q.bees, b.ID())
+	q.Unlock()
+
+	rc := releaseCells{App: q.app.Name(), Bee: b.ID()}
+	if _, err := q.hive.processRaft(context.TODO(), rc); err != nil {
+		glog.Errorf("%v cannot release the cells of %v: %v", q, b, err)
+		return
+	}
+	q.hive.delBeeFromRegistry(b.ID())
+}
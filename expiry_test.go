@@ -0,0 +1,77 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type expiryTestMsg string
+
+func TestExpireKeys(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_expiry"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	sweep := 100 * time.Millisecond
+	ttl := 200 * time.Millisecond
+	a := h.NewApp("expiry", AppWithSweepInterval(sweep), AppReleaseEmptyBees())
+	type res struct {
+		id    uint64
+		found bool
+	}
+	ch := make(chan res)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", string(msg.Data().(expiryTestMsg))}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		d := ctx.Dict("D")
+		k := string(msg.Data().(expiryTestMsg))
+		_, err := d.Get(k)
+		state.PutTTL(d, k, []byte{}, ttl)
+		ch <- res{id: ctx.ID(), found: err == nil}
+		return nil
+	}
+	a.HandleFunc(expiryTestMsg(""), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(expiryTestMsg("k"))
+	r1 := <-ch
+	if r1.found {
+		t.Fatal("key is found before being put")
+	}
+	h.Emit(expiryTestMsg("k"))
+	if r := <-ch; !r.found || r.id != r1.id {
+		t.Fatalf("invalid result before expiry: %+v", r)
+	}
+
+	q := a.(*app).qee
+	for i := 0; ; i++ {
+		if _, ok := q.beeByID(r1.id); !ok {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("bee %v is not released", r1.id)
+		}
+		time.Sleep(sweep)
+	}
+	if _, err := h.(*hive).registry.bee(r1.id); err == nil {
+		t.Errorf("released bee %v is still in the registry", r1.id)
+	}
+
+	h.Emit(expiryTestMsg("k"))
+	r2 := <-ch
+	if r2.found {
+		t.Error("expired key is found")
+	}
+	if r2.id == r1.id {
+		t.Errorf("message is handled by the released bee %v", r1.id)
+	}
+}
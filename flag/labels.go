@@ -0,0 +1,45 @@
+package flag
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels implements a comma separated list of "key=value" pairs for golang
+// flag.
+type Labels struct {
+	M *map[string]string
+}
+
+func (v Labels) String() string {
+	if v.M == nil {
+		return ""
+	}
+	l := make([]string, 0, len(*v.M))
+	for k, val := range *v.M {
+		l = append(l, k+"="+val)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+func (v Labels) Get() interface{} {
+	return *v.M
+}
+
+func (v Labels) Set(val string) error {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(val, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return fmt.Errorf("invalid label %q", kv)
+		}
+		m[strings.TrimSpace(p[0])] = strings.TrimSpace(p[1])
+	}
+	*v.M = m
+	return nil
+}
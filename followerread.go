@@ -0,0 +1,236 @@
+package beehive
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Followers of persistent applications proxy messages to their leader. In
+// applications with follower reads, followers handle the messages of
+// read-only handlers using their own replica of the state, as long as they
+// are not lagging behind the leader and have heard from the leader within an
+// election timeout, which bounds the staleness of a partitioned follower. In
+// the linearizable mode, followers ask the leader for its read index, which
+// the leader confirms in a round of heartbeats, and re-queue the reads until
+// they apply that index.
+
+// ErrNotLeader is returned when a command that requires the leader is sent to
+// a follower.
+var ErrNotLeader = errors.New("bee is not the leader")
+
+// ReadOnlyHandler is a handler whose Rcv function does not modify the state of
+// the bee. Followers can handle the messages of read-only handlers in
+// applications with follower reads (see AppWithFollowerReads).
+type ReadOnlyHandler interface {
+	Handler
+	// ReadOnly returns whether the handler is read-only.
+	ReadOnly() bool
+}
+
+// ReadOnly marks h as a read-only handler.
+func ReadOnly(h Handler) Handler {
+	return readOnlyHandler{h}
+}
+
+// ReadOnlyFunc returns a read-only handler using the map and receive
+// functions.
+func ReadOnlyFunc(m MapFunc, r RcvFunc) Handler {
+	return ReadOnly(&funcHandler{m, r})
+}
+
+type readOnlyHandler struct {
+	Handler
+}
+
+func (h readOnlyHandler) ReadOnly() bool {
+	return true
+}
+
+func isReadOnly(h Handler) bool {
+	rh, ok := h.(ReadOnlyHandler)
+	return ok && rh.ReadOnly()
+}
+
+// AppWithFollowerReads is an application option that lets the followers of a
+// persistent application handle the messages of read-only handlers (see
+// ReadOnly), if they have applied all but maxLag of the raft entries committed
+// by the leader. Otherwise, the messages are handled by the leader. Note that
+// the leader's commit index is as last reported to the follower, and
+// followers that have not heard from the leader within an election timeout
+// proxy their reads to the leader.
+func AppWithFollowerReads(maxLag uint64) AppOption {
+	return func(a *app) {
+		a.followerReads = true
+		a.maxReadLag = maxLag
+	}
+}
+
+// AppWithLinearizableFollowerReads is an application option that lets the
+// followers of a persistent application handle the messages of read-only
+// handlers only after they apply all the raft entries applied by the leader
+// when the messages are received. This costs a round trip to the leader and a
+// round of heartbeats on the leader for each batch of messages. Meanwhile, the
+// follower handles other messages, which may be handled before the reads.
+func AppWithLinearizableFollowerReads() AppOption {
+	return func(a *app) {
+		a.followerReads = true
+		a.linearizableReads = true
+	}
+}
+
+// handleMsgFollower handles the read-only messages of mhs locally, if the bee
+// can serve reads, and proxies the rest to the leader using proxy.
+func (b *bee) handleMsgFollower(mhs []msgAndHandler,
+	proxy func(mhs []msgAndHandler)) {
+
+	var reads, writes []msgAndHandler
+	for _, mh := range mhs {
+		if isReadOnly(mh.handler) {
+			reads = append(reads, mh)
+		} else {
+			writes = append(writes, mh)
+		}
+	}
+
+	if len(reads) != 0 && b.app.linearizableReads {
+		b.readLinearizable(reads, proxy)
+		reads = nil
+	} else if len(reads) != 0 && !b.canRead() {
+		writes = mhs
+		reads = nil
+	}
+	if len(writes) != 0 {
+		proxy(writes)
+	}
+	if len(reads) != 0 {
+		b.read(reads)
+	}
+}
+
+// read handles the read-only messages of mhs using the local state.
+func (b *bee) read(mhs []msgAndHandler) {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	for _, mh := range mhs {
+		glog.V(2).Infof("%v reads message %v", b, mh.msg)
+		b.stateL1.BeginTx()
+		b.callRcv(mh)
+		if len(b.stateL1.TxOps()) != 0 {
+			glog.Errorf("%v discards the changes of read-only message %v", b,
+				mh.msg)
+			b.resetTx(b.stateL1, &b.msgBufL1)
+			continue
+		}
+		for _, m := range b.msgBufL1 {
+			b.doEmit(m)
+		}
+		b.resetTx(b.stateL1, &b.msgBufL1)
+	}
+}
+
+// canRead returns whether the follower is recent enough to handle read-only
+// messages.
+func (b *bee) canRead() bool {
+	node := b.raftNode()
+	if node == nil {
+		return false
+	}
+	// A follower that does not hear from the leader may be partitioned, and
+	// its commit index may be arbitrarily stale.
+	if node.Leader() == 0 ||
+		node.SinceLeaderContact() > b.hive.config.RaftElectTimeout() {
+		return false
+	}
+	return node.Committed() <= node.Applied()+b.app.maxReadLag
+}
+
+// cmdServeReads is a local command that serves linearizable follower reads
+// once the bee applies the read index of the leader. It is never sent to other
+// hives.
+type cmdServeReads struct {
+	Index uint64
+	Err   error
+	Since time.Time
+	Reads []msgAndHandler
+	Proxy func(mhs []msgAndHandler)
+}
+
+// readLinearizable asks the leader for its read index, and then serves the
+// read-only messages of mhs using serveReads. The bee is not blocked in the
+// meantime.
+func (b *bee) readLinearizable(mhs []msgAndHandler,
+	proxy func(mhs []msgAndHandler)) {
+
+	leader := b.colony().Leader
+	go func() {
+		c := cmdServeReads{
+			Since: time.Now(),
+			Reads: mhs,
+			Proxy: proxy,
+		}
+		var res interface{}
+		info, err := b.hive.registry.bee(leader)
+		if err == nil {
+			res, err = b.hive.streamer.sendCmd(cmd{
+				To:   leader,
+				App:  b.app.Name(),
+				Data: cmdReadIndex{},
+			}, info.Hive)
+		}
+		if err == nil {
+			c.Index = res.(uint64)
+		}
+		c.Err = err
+		b.enqueCmd(newCmdAndChannel(c, b.app.Name(), b.ID(), nil))
+	}()
+}
+
+// serveReads handles the reads of c, if the bee has applied the read index.
+// Otherwise, it re-queues c until the bee applies the index or an election
+// timeout passes, in which case the reads are proxied to the leader.
+func (b *bee) serveReads(c cmdServeReads) {
+	if c.Err != nil {
+		glog.Warningf("%v cannot get the read index: %v", b, c.Err)
+		c.Proxy(c.Reads)
+		return
+	}
+
+	node := b.raftNode()
+	if node == nil {
+		c.Proxy(c.Reads)
+		return
+	}
+	if node.Applied() >= c.Index {
+		b.read(c.Reads)
+		return
+	}
+	if time.Since(c.Since) > b.hive.config.RaftElectTimeout() {
+		c.Proxy(c.Reads)
+		return
+	}
+	time.AfterFunc(b.hive.config.RaftTick, func() {
+		b.enqueCmd(newCmdAndChannel(c, b.app.Name(), b.ID(), nil))
+	})
+}
+
+// replyReadIndex replies the read index of the leader to cc, once the leader
+// confirms its leadership. The bee is not blocked in the meantime.
+func (b *bee) replyReadIndex(cc cmdAndChannel) error {
+	node := b.raftNode()
+	if node == nil || !b.isLeader() {
+		return ErrNotLeader
+	}
+	go func() {
+		ctx, ccl := context.WithTimeout(context.Background(),
+			b.hive.config.RaftElectTimeout())
+		defer ccl()
+		idx, err := node.ReadIndex(ctx)
+		if cc.ch != nil {
+			cc.ch <- cmdResult{Data: idx, Err: err}
+		}
+	}()
+	return nil
+}
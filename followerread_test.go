@@ -0,0 +1,141 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type followerReadPut string
+type followerReadGet struct{}
+
+type followerReadRes struct {
+	id  uint64
+	val string
+}
+
+func registerFollowerReadApp(h Hive, ch chan followerReadRes,
+	opt AppOption) App {
+
+	a := h.NewApp("followerread", Persistent(3), opt)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	a.HandleFunc(followerReadPut(""), mf, func(msg Msg, ctx RcvContext) error {
+		ctx.Dict("D").Put("0", []byte(msg.Data().(followerReadPut)))
+		ch <- followerReadRes{id: ctx.ID()}
+		return nil
+	})
+	a.Handle(followerReadGet{}, ReadOnlyFunc(mf,
+		func(msg Msg, ctx RcvContext) error {
+			v, _ := ctx.Dict("D").Get("0")
+			ch <- followerReadRes{id: ctx.ID(), val: string(v)}
+			return nil
+		}))
+	return a
+}
+
+func TestFollowerReads(t *testing.T) {
+	testFollowerReads(t, AppWithLinearizableFollowerReads(), true)
+}
+
+func TestFollowerReadsWithLag(t *testing.T) {
+	// Followers hear from the leader in heartbeats, and serve reads that may
+	// be stale.
+	testFollowerReads(t, AppWithFollowerReads(0), false)
+}
+
+// testFollowerReads tests follower reads with opt. If linearizable is true, it
+// also checks that follower reads return the latest value.
+func testFollowerReads(t *testing.T, opt AppOption, linearizable bool) {
+	ch := make(chan followerReadRes)
+	var hives []Hive
+	var apps []App
+	for i := 0; i < 3; i++ {
+		cfg := DefaultCfg
+		cfg.StatePath = "/tmp/bhtest_followerread" + strconv.Itoa(i)
+		cfg.Addr = newHiveAddrForTest()
+		if i != 0 {
+			cfg.PeerAddrs = []string{hives[0].(*hive).config.Addr}
+		}
+		removeState(cfg)
+		defer removeState(cfg)
+		h := NewHiveWithConfig(cfg)
+		apps = append(apps, registerFollowerReadApp(h, ch, opt))
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	hives[0].Emit(followerReadPut("v1"))
+	leader := (<-ch).id
+	hives[0].Emit(followerReadPut("v2"))
+	<-ch
+
+	var col Colony
+	for i := 0; ; i++ {
+		b, err := hives[0].(*hive).registry.bee(leader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if col = b.Colony; len(col.Followers) != 0 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("colony has no follower: %v", col)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	follower := col.Followers[0]
+	recv := func() followerReadRes {
+		select {
+		case r := <-ch:
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("no response")
+		}
+		return followerReadRes{}
+	}
+
+	hives[0].SendToBee(followerReadGet{}, follower)
+	if r := recv(); r.id != follower || (linearizable && r.val != "v2") {
+		t.Errorf("invalid follower read: actual=%+v want=%v/v2", r, follower)
+	}
+
+	if linearizable {
+		// Follower reads do not append entries to the raft log of the leader.
+		var lb *bee
+		for _, a := range apps {
+			if b, ok := a.(*app).qee.beeByID(leader); ok && b.raftNode() != nil {
+				lb = b
+			}
+		}
+		if lb == nil {
+			t.Fatalf("cannot find leader %v", leader)
+		}
+		node := lb.raftNode()
+		for node.Applied() != node.Committed() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		applied := node.Applied()
+		hives[0].SendToBee(followerReadGet{}, follower)
+		if r := recv(); r.id != follower || r.val != "v2" {
+			t.Errorf("invalid follower read: actual=%+v want=%v/v2", r, follower)
+		}
+		if a := node.Applied(); a != applied {
+			t.Errorf("follower read changes the leader's log: %v != %v", a, applied)
+		}
+	}
+
+	// Messages of other handlers are still handled by the leader.
+	hives[0].SendToBee(followerReadPut("v3"), follower)
+	if r := recv(); r.id != leader {
+		t.Errorf("follower %v handles a write", r.id)
+	}
+	hives[0].SendToBee(followerReadGet{}, follower)
+	if r := recv(); r.id != follower || (linearizable && r.val != "v3") {
+		t.Errorf("invalid follower read: actual=%+v want=%v/v3", r, follower)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 	bhflag "github.com/kandoo/beehive/flag"
+	bhgob "github.com/kandoo/beehive/gob"
 	"github.com/kandoo/beehive/raft"
 )
 
@@ -45,6 +46,8 @@ type Hive interface {
 	SendToCellKey(msgData interface{}, to string, dk CellKey)
 	// Sends a message to a sepcific bee.
 	SendToBee(msgData interface{}, to uint64)
+	// Sends a message to the leaders of all colonies of an app on all hives.
+	BroadcastToApp(msgData interface{}, app string)
 	// Replies to a message.
 	ReplyTo(msg Msg, replyData interface{}) error
 
@@ -52,6 +55,10 @@ type Hive interface {
 	// only on messages that have no active handler. Such messages are almost
 	// always replies to some detached handler.
 	RegisterMsg(msg interface{})
+
+	// ReloadConfig applies the fields of cfg that can be changed at runtime, and
+	// reports the fields that require a restart of the hive.
+	ReloadConfig(cfg HiveConfig) (ConfigReload, error)
 }
 
 // HiveConfig represents the configuration of a hive.
@@ -67,6 +74,11 @@ type HiveConfig struct {
 
 	Instrument     bool // whether to instrument apps on the hive.
 	OptimizeThresh uint // when to notify the optimizer (in msg/s).
+	OptimizeDryRun bool // whether the optimizer only recommends migrations.
+
+	MigrationCooldown time.Duration // when a migrated bee can migrate again.
+	MigrationRetries  int           // number of retries of a failed migration.
+	MaxMigrations     int           // max concurrent migrations (0 for all).
 
 	RegLockTimeout time.Duration // when to retry to lock an entry in a registry.
 	RaftTick       time.Duration // the raft tick interval.
@@ -77,6 +89,22 @@ type HiveConfig struct {
 	ConnTimeout    time.Duration // timeout for connections between hives.
 	BatcherPerHost int           // number of parallel batchers per host.
 	BatcherTimeout time.Duration // timeout used in the batchers.
+
+	ConfigFile   string // file to reload the configuration from on SIGHUP.
+	LogVerbosity int    // glog verbosity, applied only when changed on reload.
+
+	RegVoters int // number of voters in the registry's raft group (0 for all).
+
+	MaxTxSize   int // max bytes of a replicated transaction (0 for no limit).
+	TxChunkSize int // max bytes of a raft entry of a transaction (0 for all).
+
+	RegSnapshot raft.SnapshotConfig // snapshots of the registry.
+	BeeSnapshot raft.SnapshotConfig // default snapshots of persistent bees.
+
+	Labels map[string]string // labels of the hive (e.g., zone and rack).
+
+	// Replication is the default replication strategy of persistent apps.
+	Replication ReplicationStrategy `json:"-"`
 }
 
 // RaftElectTimeout returns the raft election timeout as
@@ -98,17 +126,21 @@ func NewHiveWithConfig(cfg HiveConfig) Hive {
 		meta:   m,
 		status: hiveStopped,
 		config: cfg,
+		batch:  int64(cfg.BatchSize),
 		dataCh: newMsgChannel(cfg.DataChBufSize),
 		ctrlCh: make(chan cmdAndChannel),
 		apps:   make(map[string]*app, 0),
 		qees:   make(map[string][]qeeAndHandler),
 		ticker: time.NewTicker(cfg.RaftTick),
 		client: newHTTPClient(cfg.ConnTimeout),
+		done:   make(chan struct{}),
 	}
 
 	h.streamer = newLoadBalancer(h, cfg.BatcherPerHost)
 	h.registry = newRegistry(h.String())
-	h.replStrategy = newRndReplication(h)
+	h.registry.hiveUpdated = func(info HiveInfo) {
+		h.streamer.resetHive(info.ID)
+	}
 	h.server = newServer(h, cfg.Addr)
 
 	if h.config.Instrument {
@@ -133,40 +165,87 @@ func NewHive() Hive {
 }
 
 func init() {
-	flag.StringVar(&DefaultCfg.Addr, "laddr", "localhost:7767",
+	bindConfigFlags(flag.CommandLine, &DefaultCfg)
+}
+
+// bindConfigFlags defines the flags of the hive configuration on fs. Note that
+// it sets the fields of cfg to their default values.
+func bindConfigFlags(fs *flag.FlagSet, cfg *HiveConfig) {
+	fs.StringVar(&cfg.Addr, "laddr", "localhost:7767",
 		"the listening address used to communicate with other nodes")
-	flag.Var(&bhflag.CSV{S: &DefaultCfg.PeerAddrs}, "paddrs",
+	fs.Var(&bhflag.CSV{S: &cfg.PeerAddrs}, "paddrs",
 		"address of peers. Seperate entries with a comma")
-	flag.Var(&bhflag.CSV{S: &DefaultCfg.RegAddrs}, "raddrs",
+	fs.Var(&bhflag.CSV{S: &cfg.RegAddrs}, "raddrs",
 		"address of etcd machines. Separate entries with a comma ','")
-	flag.IntVar(&DefaultCfg.DataChBufSize, "chsize", 1024,
+	fs.IntVar(&cfg.DataChBufSize, "chsize", 1024,
 		"buffer size of data channels")
-	flag.IntVar(&DefaultCfg.CmdChBufSize, "cmdchsize", 128,
+	fs.IntVar(&cfg.CmdChBufSize, "cmdchsize", 128,
 		"buffer size of command channels")
-	flag.IntVar(&DefaultCfg.BatchSize, "batch", 1024,
+	fs.IntVar(&cfg.BatchSize, "batch", 1024,
 		"number of messages to batch per transaction")
-	flag.BoolVar(&DefaultCfg.Instrument, "instrument", false,
+	fs.BoolVar(&cfg.Instrument, "instrument", false,
 		"whether to insturment apps")
-	flag.UintVar(&DefaultCfg.OptimizeThresh, "optthresh", 10,
+	fs.UintVar(&cfg.OptimizeThresh, "optthresh", 10,
 		"when the local stat collector should notify the optimizer (in msg/s).")
-	flag.StringVar(&DefaultCfg.StatePath, "statepath", "/tmp/beehive",
+	fs.BoolVar(&cfg.OptimizeDryRun, "optdryrun", false,
+		"whether the optimizer only recommends migrations to be approved")
+	fs.DurationVar(&cfg.MigrationCooldown, "migcooldown", 1*time.Minute,
+		"how long the optimizer does not migrate a migrated bee again")
+	fs.IntVar(&cfg.MigrationRetries, "migretries", 3,
+		"number of times the optimizer retries a failed migration")
+	fs.IntVar(&cfg.MaxMigrations, "maxmigrations", 4,
+		"maximum number of concurrent migrations (0 means no limit)")
+	fs.StringVar(&cfg.StatePath, "statepath", "/tmp/beehive",
 		"where to store persistent state data")
-	flag.DurationVar(&DefaultCfg.RegLockTimeout, "reglocktimeout",
+	fs.DurationVar(&cfg.RegLockTimeout, "reglocktimeout",
 		10*time.Millisecond, "timeout to retry locking an entry in the registry")
-	flag.DurationVar(&DefaultCfg.RaftTick, "rafttick", 100*time.Millisecond,
+	fs.DurationVar(&cfg.RaftTick, "rafttick", 100*time.Millisecond,
 		"raft tick period")
-	flag.IntVar(&DefaultCfg.RaftElectTicks, "raftelectionticks", 5,
+	fs.IntVar(&cfg.RaftElectTicks, "raftelectionticks", 5,
 		"number of raft ticks to start an election (ie, election timeout)")
-	flag.IntVar(&DefaultCfg.RaftHBTicks, "rafthbticks", 1,
+	fs.IntVar(&cfg.RaftHBTicks, "rafthbticks", 1,
 		"number of raft ticks to fire a heartbeat (ie, heartbeat timeout)")
-	flag.IntVar(&DefaultCfg.MaxConnPerHost, "maxconn", 32,
+	fs.IntVar(&cfg.MaxConnPerHost, "maxconn", 32,
 		"maximum number of parallel data connectons to a remote host")
-	flag.DurationVar(&DefaultCfg.ConnTimeout, "conntimeout", 60*time.Second,
+	fs.DurationVar(&cfg.ConnTimeout, "conntimeout", 60*time.Second,
 		"timeout for trying to connect to other hives")
-	flag.IntVar(&DefaultCfg.BatcherPerHost, "batchers", 1,
+	fs.IntVar(&cfg.BatcherPerHost, "batchers", 1,
 		"number of parallel batchers per host")
-	flag.DurationVar(&DefaultCfg.BatcherTimeout, "batchertimeout",
+	fs.DurationVar(&cfg.BatcherTimeout, "batchertimeout",
 		1*time.Millisecond, "timeout used for batching")
+	fs.StringVar(&cfg.ConfigFile, "config", "",
+		"the configuration file reloaded on SIGHUP")
+	fs.IntVar(&cfg.LogVerbosity, "logv", -1,
+		"log verbosity applied on reload (-1 keeps the value of -v)")
+	fs.IntVar(&cfg.RegVoters, "regvoters", 0,
+		"number of hives voting in the registry (0 means all the hives)")
+	fs.IntVar(&cfg.MaxTxSize, "maxtxsize", 0,
+		"maximum bytes of a replicated transaction (0 means no limit)")
+	fs.IntVar(&cfg.TxChunkSize, "txchunksize", 0,
+		"maximum bytes of a raft entry; larger transactions are chunked (0 "+
+			"means no chunking)")
+	bindSnapshotFlags(fs, "reg", "the registry", &cfg.RegSnapshot)
+	bindSnapshotFlags(fs, "bee", "persistent bees", &cfg.BeeSnapshot)
+	fs.Var(&bhflag.Labels{M: &cfg.Labels}, "labels",
+		"labels of the hive (e.g., zone=z1,rack=r1)")
+}
+
+// bindSnapshotFlags defines the flags of snapshot configuration cfg on fs,
+// prefixing their names with prefix.
+func bindSnapshotFlags(fs *flag.FlagSet, prefix, of string,
+	cfg *raft.SnapshotConfig) {
+
+	fs.Uint64Var(&cfg.Count, prefix+"snapcount", raft.DefaultSnapCount,
+		"number of raft entries between the snapshots of "+of)
+	fs.Uint64Var(&cfg.Bytes, prefix+"snapbytes", 0,
+		"bytes of raft entries that trigger a snapshot of "+of+
+			" (0 means no limit)")
+	fs.UintVar(&cfg.MaxSnapFiles, prefix+"maxsnaps", raft.DefaultMaxSnapFiles,
+		"number of snapshot files kept for "+of)
+	fs.UintVar(&cfg.MaxWALFiles, prefix+"maxwals", raft.DefaultMaxWALFiles,
+		"number of WAL files kept for "+of)
+	fs.BoolVar(&cfg.Compress, prefix+"snapcompress", false,
+		"whether to compress the snapshots of "+of)
 }
 
 type qeeAndHandler struct {
@@ -190,8 +269,11 @@ type hive struct {
 	id     uint64
 	meta   hiveMeta
 	config HiveConfig
+	cfgM   sync.RWMutex // guards the fields of config that can be reloaded.
+	batch  int64        // config.BatchSize, read atomically by the bees.
 
 	status hiveStatus
+	done   chan struct{} // closed when the hive is stopped.
 
 	dataCh *msgChannel
 	ctrlCh chan cmdAndChannel
@@ -203,14 +285,16 @@ type hive struct {
 	server   *server
 	listener net.Listener
 
-	node     *raft.Node
+	node     *raft.Node // nil if the hive is an observer of the registry.
 	registry *registry
+	syncM    sync.Mutex // serializes registry syncs and promotion.
 	ticker   *time.Ticker
 	client   *http.Client
 	streamer streamer
 
-	replStrategy replicationStrategy
-	collector    collector
+	collector collector
+	rcvMeter  rateMeter // measures the messages received by local bees.
+	loads     loadCache
 }
 
 func (h *hive) ID() uint64 {
@@ -222,6 +306,8 @@ func (h *hive) String() string {
 }
 
 func (h *hive) Config() HiveConfig {
+	h.cfgM.RLock()
+	defer h.cfgM.RUnlock()
 	return h.config
 }
 
@@ -289,7 +375,10 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 		h.status = hiveStopped
 		h.stopListener()
 		h.stopQees()
-		h.node.Stop()
+		if n := h.raftNode(); n != nil {
+			n.Stop()
+		}
+		close(h.done)
 		cc.ch <- cmdResult{}
 
 	case cmdPing:
@@ -300,18 +389,48 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 		cc.ch <- cmdResult{Err: err}
 
 	case cmdNewHiveID:
-		r, err := h.node.Process(context.TODO(), newHiveID{d.Addr})
+		r, err := h.processRaft(context.TODO(), newHiveID{d.Addr, d.Labels})
 		cc.ch <- cmdResult{
 			Data: r,
 			Err:  err,
 		}
 
 	case cmdAddHive:
-		err := h.node.AddNode(context.TODO(), d.Info.ID, d.Info.Addr)
+		voter, err := h.addHive(d.Info)
+		cc.ch <- cmdResult{
+			Data: voter,
+			Err:  err,
+		}
+
+	case cmdUpdateHive:
+		_, err := h.processRaft(context.TODO(), updateHive(d.Info))
 		cc.ch <- cmdResult{
 			Err: err,
 		}
 
+	case cmdProcessRegistry:
+		// Processed in a goroutine to not block the hive on behalf of observers.
+		go func(ch chan cmdResult) {
+			r, err := h.processRaft(context.TODO(), d.Req)
+			res := registryResult{Data: r, Seq: h.registry.seq()}
+			if err != nil {
+				res.Err = bhgob.Error(err.Error())
+			}
+			ch <- cmdResult{Data: res}
+		}(cc.ch)
+
+	case cmdRegistryUpdates:
+		us, err := h.registry.updatesSince(d.Since)
+		cc.ch <- cmdResult{
+			Data: us,
+			Err:  err,
+		}
+
+	case cmdPromote:
+		cc.ch <- cmdResult{
+			Err: h.promote(),
+		}
+
 	case cmdLiveHives:
 		cc.ch <- cmdResult{
 			Data: h.registry.hives(),
@@ -331,12 +450,16 @@ func (h *hive) processCmd(data interface{}) (interface{}, error) {
 }
 
 func (h *hive) stepRaft(ctx context.Context, msg raftpb.Message) error {
-	return h.node.Step(ctx, msg)
+	n := h.raftNode()
+	if n == nil {
+		return ErrNotVoter
+	}
+	return n.Step(ctx, msg)
 }
 
 func (h *hive) raftBarrier() error {
 	ctx, _ := context.WithTimeout(context.Background(), 300*h.config.RaftTick)
-	_, err := h.node.Process(ctx, noOp{})
+	_, err := h.processRaft(ctx, noOp{})
 	return err
 }
 
@@ -361,6 +484,10 @@ func (h *hive) bee(id uint64) (BeeInfo, error) {
 
 func (h *hive) handleMsg(m *msg) {
 	switch {
+	case m.isAppBroadcast():
+		h.broadcastToApp(m)
+	case m.isMulticast():
+		h.multicast(m)
 	case m.IsUnicast():
 		i, err := h.bee(m.MsgTo)
 		if err != nil {
@@ -382,6 +509,67 @@ func (h *hive) handleMsg(m *msg) {
 	}
 }
 
+// broadcastToApp delivers m to the qees of its application on all hives. The
+// other hives receive m as a cmdBroadcast that their qees handle locally, so
+// each qee receives m exactly once.
+func (h *hive) broadcastToApp(m *msg) {
+	a, ok := h.app(m.MsgApp)
+	if !ok {
+		glog.Errorf("%v cannot broadcast %v: no such application", h, m)
+		return
+	}
+	hdl := a.handler(m.Type())
+	if hdl == nil {
+		glog.Errorf("%v cannot broadcast %v: %v has no handler", h, m, a)
+		return
+	}
+
+	c := cmd{
+		App:  a.Name(),
+		Data: cmdBroadcast{Msg: *m},
+	}
+	for _, hi := range h.registry.hives() {
+		if hi.ID == h.ID() {
+			continue
+		}
+		go func(to uint64) {
+			if _, err := h.streamer.sendCmd(c, to); err != nil {
+				glog.Errorf("%v cannot broadcast %v to hive %v: %v", h, m, to, err)
+			}
+		}(hi.ID)
+	}
+	a.qee.enqueMsg(msgAndHandler{msg: m, handler: hdl})
+}
+
+// multicast delivers m to each of its bees. The bees of this hive receive a
+// unicast copy of m, and every other hive receives one copy of m, through its
+// batcher, with the bees that it hosts.
+func (h *hive) multicast(m *msg) {
+	remote := make(map[uint64][]uint64)
+	for _, id := range m.MsgBees {
+		bi, err := h.bee(id)
+		if err != nil {
+			glog.Errorf("%v cannot send %v to bee %v: %v", h, m, id, err)
+			continue
+		}
+		if bi.Hive != h.ID() {
+			remote[bi.Hive] = append(remote[bi.Hive], id)
+			continue
+		}
+		um := *m
+		um.MsgBees = nil
+		um.MsgTo = id
+		h.handleMsg(&um)
+	}
+	for _, bees := range remote {
+		rm := *m
+		rm.MsgBees = bees
+		if err := h.streamer.sendMsg([]msg{rm}); err != nil {
+			glog.Errorf("%v cannot send %v: %v", h, &rm, err)
+		}
+	}
+}
+
 func (h *hive) startQees() {
 	for _, a := range h.apps {
 		go a.qee.start()
@@ -393,15 +581,32 @@ func (h *hive) startRaftNode() {
 	if len(h.meta.Peers) != 0 {
 		h.registry.initHives(h.meta.Peers)
 	} else {
-		peers = append(peers, raft.NodeInfo(h.info()).Peer())
+		peers = append(peers, h.info().nodeInfo().Peer())
 	}
-	h.node = raft.NewNode(h.String(), h.id, peers, h.sendRaft, h,
-		h.config.StatePath, h.registry, 1024, h.ticker.C, h.config.RaftElectTicks,
-		h.config.RaftHBTicks)
+	if h.meta.Observer {
+		go h.observe()
+		return
+	}
+	h.newRaftNode(peers)
+}
+
+func (h *hive) newRaftNode(peers []etcdraft.Peer) {
+	n := raft.NewNode(h.String(), h.id, peers, h.sendRaft, h,
+		h.config.StatePath, h.registry, h.config.RegSnapshot, h.ticker.C,
+		h.config.RaftElectTicks, h.config.RaftHBTicks)
+	h.Lock()
+	h.node = n
+	h.Unlock()
+}
+
+func (h *hive) raftNode() *raft.Node {
+	h.Lock()
+	defer h.Unlock()
+	return h.node
 }
 
 func (h *hive) delBeeFromRegistry(id uint64) error {
-	_, err := h.node.Process(context.TODO(), delBee(id))
+	_, err := h.processRaft(context.TODO(), delBee(id))
 	if err != nil {
 		glog.Errorf("%v cannot delete bee %v from registory", h, id)
 	}
@@ -441,6 +646,10 @@ func (h *hive) ProcessStatusChange(sch interface{}) {
 }
 
 func (h *hive) Start() error {
+	if err := h.checkSchemas(); err != nil {
+		glog.Errorf("%v cannot start: %v", h, err)
+		return err
+	}
 	h.status = hiveStarted
 	h.registerSignals()
 	h.startRaftNode()
@@ -449,10 +658,19 @@ func (h *hive) Start() error {
 		h.Stop()
 		return err
 	}
+	if h.meta.addrChanged {
+		h.announceAddr()
+	}
 	if err := h.raftBarrier(); err != nil {
 		glog.Fatalf("error when joining the cluster: %v", err)
 	}
 	glog.V(2).Infof("%v is in sync with the cluster", h)
+	if err := h.maybeUpdateInfo(); err != nil {
+		glog.Errorf("%v cannot update its info in the registry: %v", h, err)
+	}
+	if h.config.RegVoters != 0 {
+		go h.maintainVoters()
+	}
 	h.startQees()
 	h.reloadState()
 
@@ -471,10 +689,51 @@ func (h *hive) Start() error {
 	return nil
 }
 
+// announceAddr asks one of the peers to update the address of this hive in the
+// registry. This is required because the other hives cannot reach this hive on
+// its old address, and the hive would not be able to sync with the cluster.
+func (h *hive) announceAddr() {
+	addrs := make([]string, 0, len(h.meta.Peers)+len(h.config.PeerAddrs))
+	for _, p := range h.meta.Peers {
+		if p.ID != h.id {
+			addrs = append(addrs, p.Addr)
+		}
+	}
+	addrs = append(addrs, h.config.PeerAddrs...)
+
+	c := cmd{Data: cmdUpdateHive{Info: h.info()}}
+	for _, a := range addrs {
+		if a == h.config.Addr {
+			continue
+		}
+		p := newProxyWithRetry(h.httpClient(), a, 100*time.Millisecond, 3)
+		if _, err := sendCmd(p, c); err != nil {
+			glog.Warningf("%v cannot announce its address to %v: %v", h, a, err)
+			continue
+		}
+		glog.Infof("%v announced its new address through %v", h, a)
+		return
+	}
+	glog.Warningf("%v cannot announce its new address to any peer", h)
+}
+
+// maybeUpdateInfo updates the address and the labels of this hive in the
+// registry, if the registry has stale information.
+func (h *hive) maybeUpdateInfo() error {
+	i, err := h.registry.hive(h.id)
+	if err != nil ||
+		(i.Addr == h.config.Addr && sameLabels(i.Labels, h.config.Labels)) {
+		return nil
+	}
+	_, err = h.processRaft(context.TODO(), updateHive(h.info()))
+	return err
+}
+
 func (h *hive) info() HiveInfo {
 	return HiveInfo{
-		ID:   h.id,
-		Addr: h.config.Addr,
+		ID:     h.id,
+		Addr:   h.config.Addr,
+		Labels: h.config.Labels,
 	}
 }
 
@@ -504,9 +763,10 @@ func (h *hive) sendCmd(cmd interface{}) (interface{}, error) {
 
 func (h *hive) NewApp(name string, options ...AppOption) App {
 	a := &app{
-		name:     name,
-		hive:     h,
-		handlers: make(map[string]Handler),
+		name:          name,
+		hive:          h,
+		handlers:      make(map[string]Handler),
+		sweepInterval: defaultSweepInterval,
 	}
 	a.initQee()
 	h.registerApp(a)
@@ -539,6 +799,10 @@ func (h *hive) SendToBee(msgData interface{}, to uint64) {
 	h.enqueMsg(newMsgFromData(msgData, 0, to))
 }
 
+func (h *hive) BroadcastToApp(msgData interface{}, app string) {
+	h.enqueMsg(newAppBroadcastMsg(msgData, 0, app))
+}
+
 // Reply to thatMsg with the provided replyData.
 func (h *hive) ReplyTo(thatMsg Msg, replyData interface{}) error {
 	m := thatMsg.(*msg)
@@ -558,8 +822,19 @@ func (h *hive) registerSignals() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	go func() {
-		<-h.sigCh
-		h.Stop()
+		for sig := range h.sigCh {
+			if sig != syscall.SIGHUP {
+				h.Stop()
+				return
+			}
+
+			r, err := h.reloadConfigFile()
+			if err != nil {
+				glog.Errorf("%v cannot reload its configuration: %v", h, err)
+				continue
+			}
+			glog.Infof("%v reloaded its configuration: %v", h, r)
+		}
 	}()
 }
 
@@ -591,7 +866,7 @@ func (h *hive) newProxyToHiveWithRetry(to uint64, backoffStep time.Duration,
 	if err != nil {
 		return nil, err
 	}
-	return newProxyWithRetry(h.client, a, backoffStep, maxRetries), nil
+	return newProxyWithRetry(h.httpClient(), a, backoffStep, maxRetries), nil
 }
 
 func (h *hive) sendRaft(msgs []raftpb.Message) {
@@ -0,0 +1,108 @@
+package beehive
+
+import (
+	"reflect"
+	"runtime/debug"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// BeeEvent is a lifecycle event of a bee.
+type BeeEvent int
+
+const (
+	// BeeStarted is fired when a new bee starts.
+	BeeStarted BeeEvent = iota
+	// BeeReloaded is fired instead of BeeStarted when a bee is reloaded: after
+	// the hive restarts, or when a passive bee is reactivated.
+	BeeReloaded
+	// BeeBecameLeader is fired when the bee becomes the leader of its colony.
+	BeeBecameLeader
+	// BeeBecameFollower is fired when the bee becomes a follower in its colony.
+	BeeBecameFollower
+	// BeeMigrating is fired right before the bee hands off its colony to
+	// another bee as part of a migration.
+	BeeMigrating
+	// BeeStopping is fired before the bee stops, either because the hive is
+	// stopping or because the bee is passivated.
+	BeeStopping
+)
+
+func (e BeeEvent) String() string {
+	switch e {
+	case BeeStarted:
+		return "started"
+	case BeeReloaded:
+		return "reloaded"
+	case BeeBecameLeader:
+		return "became-leader"
+	case BeeBecameFollower:
+		return "became-follower"
+	case BeeMigrating:
+		return "migrating"
+	case BeeStopping:
+		return "stopping"
+	}
+	return "unknown"
+}
+
+// LifecycleHandler is an optional interface that handlers can implement to be
+// notified of the lifecycle events of the bees of their application. For
+// example, a handler can warm up its bee local (see RcvContext.SetBeeLocal)
+// when its bee starts, or flush external side effects before a migration.
+//
+// OnBeeEvent is called in the goroutine of the bee, once per handler even if
+// the handler is registered for several messages. Note that OnBeeEvent is not
+// called in a transaction, and state changes made in OnBeeEvent are not
+// replicated.
+type LifecycleHandler interface {
+	OnBeeEvent(e BeeEvent, ctx RcvContext)
+}
+
+// addLifecycleHandler adds h to the lifecycle handlers of the app, unless it
+// is already added.
+func (a *app) addLifecycleHandler(h LifecycleHandler) {
+	if reflect.TypeOf(h).Comparable() {
+		for _, lh := range a.lifecycle {
+			if reflect.TypeOf(lh).Comparable() && lh == h {
+				return
+			}
+		}
+	}
+	a.lifecycle = append(a.lifecycle, h)
+}
+
+// fireEvent calls the lifecycle handlers of the bee's app for e.
+func (b *bee) fireEvent(e BeeEvent) {
+	if b.detached || b.proxy {
+		return
+	}
+	for _, h := range b.app.lifecycle {
+		b.callOnBeeEvent(h, e)
+	}
+}
+
+func (b *bee) callOnBeeEvent(h LifecycleHandler, e BeeEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("%v recovers from an error in handling event %v: %v\n%s",
+				b, e, r, debug.Stack())
+		}
+	}()
+
+	glog.V(2).Infof("%v fires lifecycle event %v", b, e)
+	h.OnBeeEvent(e, b)
+}
+
+// fireRoleEvent fires the event of the bee's current role in its colony, if
+// any.
+func (b *bee) fireRoleEvent() {
+	c := b.colony()
+	switch {
+	case c.IsNil():
+	case c.Leader == b.ID():
+		b.fireEvent(BeeBecameLeader)
+	case c.IsFollower(b.ID()):
+		b.fireEvent(BeeBecameFollower)
+	}
+}
@@ -0,0 +1,80 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type lifecycleTestMsg int
+type lifecycleTestMsg2 int
+
+type lifecycleTestHandler struct {
+	events chan BeeEvent
+	rcvd   chan struct{}
+}
+
+func (h *lifecycleTestHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func (h *lifecycleTestHandler) Rcv(msg Msg, ctx RcvContext) error {
+	h.rcvd <- struct{}{}
+	return nil
+}
+
+func (h *lifecycleTestHandler) OnBeeEvent(e BeeEvent, ctx RcvContext) {
+	h.events <- e
+}
+
+func TestLifecycleHandler(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_lifecycle"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	timeout := 100 * time.Millisecond
+	a := h.NewApp("lifecycle", AppWithIdleTimeout(timeout))
+	lh := &lifecycleTestHandler{
+		events: make(chan BeeEvent, 16),
+		rcvd:   make(chan struct{}, 16),
+	}
+	a.Handle(lifecycleTestMsg(0), lh)
+	a.Handle(lifecycleTestMsg2(0), lh)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	expect := func(want ...BeeEvent) {
+		for _, w := range want {
+			select {
+			case e := <-lh.events:
+				if e != w {
+					t.Fatalf("invalid event: actual=%v want=%v", e, w)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("no event: want=%v", w)
+			}
+		}
+	}
+
+	h.Emit(lifecycleTestMsg(0))
+	<-lh.rcvd
+	expect(BeeStarted, BeeBecameLeader)
+
+	// Passivation stops the bee, and the next message reloads it.
+	expect(BeeStopping)
+	h.Emit(lifecycleTestMsg2(0))
+	<-lh.rcvd
+	expect(BeeReloaded, BeeBecameLeader)
+
+	select {
+	case e := <-lh.events:
+		if e != BeeStopping {
+			t.Errorf("unexpected event: %v", e)
+		}
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+package beehive
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateMeter measures the rate of events per second.
+type rateMeter struct {
+	count uint64 // accessed atomically.
+
+	sync.Mutex
+	last      time.Time
+	lastCount uint64
+	lastRate  float64
+}
+
+func (m *rateMeter) mark(n uint64) {
+	atomic.AddUint64(&m.count, n)
+}
+
+// rate returns the rate of events since the previous call. The rate is updated
+// at most once per second.
+func (m *rateMeter) rate() float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	if d := now.Sub(m.last); d >= time.Second {
+		c := atomic.LoadUint64(&m.count)
+		if !m.last.IsZero() {
+			m.lastRate = float64(c-m.lastCount) / d.Seconds()
+		}
+		m.last = now
+		m.lastCount = c
+	}
+	return m.lastRate
+}
+
+// loadCacheTTL is the period in which the message rates of remote hives are
+// refreshed.
+const loadCacheTTL = 5 * time.Second
+
+// loadCache caches the message rates of remote hives.
+type loadCache struct {
+	sync.Mutex
+	rates    map[uint64]float64
+	updated  time.Time
+	updating bool
+}
+
+// msgRates returns the message rates of the live hives. The rates of remote
+// hives are cached and refreshed in the background.
+func (h *hive) msgRates() map[uint64]float64 {
+	c := &h.loads
+	c.Lock()
+	if !c.updating && time.Since(c.updated) > loadCacheTTL {
+		c.updating = true
+		go h.refreshMsgRates()
+	}
+	rates := make(map[uint64]float64, len(c.rates)+1)
+	for id, r := range c.rates {
+		rates[id] = r
+	}
+	c.Unlock()
+
+	rates[h.id] = h.rcvMeter.rate()
+	return rates
+}
+
+func (h *hive) refreshMsgRates() {
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	rates := make(map[uint64]float64)
+	for _, i := range h.registry.hives() {
+		if i.ID == h.id {
+			continue
+		}
+		wg.Add(1)
+		go func(i HiveInfo) {
+			defer wg.Done()
+			s, err := newProxy(h.httpClient(), i.Addr).state()
+			if err != nil {
+				return
+			}
+			m.Lock()
+			rates[i.ID] = s.MsgRate
+			m.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	c := &h.loads
+	c.Lock()
+	c.rates = rates
+	c.updated = time.Now()
+	c.updating = false
+	c.Unlock()
+}
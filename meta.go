@@ -10,56 +10,145 @@ import (
 	"github.com/kandoo/beehive/raft"
 )
 
-type HiveInfo raft.NodeInfo
+// HiveInfo stores the ID, the address and the labels of a hive.
+type HiveInfo struct {
+	ID     uint64            `json:"id"`
+	Addr   string            `json:"addr"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (i HiveInfo) nodeInfo() raft.NodeInfo {
+	return raft.NodeInfo{ID: i.ID, Addr: i.Addr}
+}
+
+// Label returns the value of label k of the hive.
+func (i HiveInfo) Label(k string) string {
+	return i.Labels[k]
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
 
 type hiveMeta struct {
 	Hive  HiveInfo
 	Peers map[uint64]HiveInfo
+	// Observer is set when the hive is not a voter in the registry's raft group.
+	Observer bool
+
+	// addrChanged is set when the address of the hive is different than the one
+	// stored in the meta file.
+	addrChanged bool
 }
 
-func peersInfo(addrs []string) map[uint64]HiveInfo {
+// peersInfo returns the live hives of the cluster and the voters of the
+// registry from the first peer that responds. If timeout is 0, it waits
+// indefinitely. Otherwise it returns nil when no peer responds within timeout.
+func peersInfo(addrs []string, timeout time.Duration) (
+	hives map[uint64]HiveInfo, voters map[uint64]bool) {
+
 	if len(addrs) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	ch := make(chan []HiveInfo, len(addrs))
+	ch := make(chan hiveState, len(addrs))
 	client := newHTTPClient(10 * time.Second)
 	for _, a := range addrs {
 		go func(a string) {
 			p := newProxy(client, a)
 			if s, err := p.state(); err == nil {
-				ch <- s.Peers
+				ch <- s
 			}
 		}(a)
 	}
 
+	var tch <-chan time.Time
+	if timeout != 0 {
+		tch = time.After(timeout)
+	}
+
 	// Return the first one.
-	hives := <-ch
-	glog.V(2).Infof("found live hives: %v", hives)
-	infos := make(map[uint64]HiveInfo)
-	for _, h := range hives {
-		infos[h.ID] = h
+	var s hiveState
+	select {
+	case s = <-ch:
+	case <-tch:
+		glog.Warningf("no response from peers %v in %v", addrs, timeout)
+		return nil, nil
+	}
+	glog.V(2).Infof("found live hives: %v", s.Peers)
+	hives = make(map[uint64]HiveInfo)
+	for _, h := range s.Peers {
+		hives[h.ID] = h
 	}
-	return infos
+	voters = make(map[uint64]bool)
+	for _, v := range s.Voters {
+		voters[v] = true
+	}
+	return hives, voters
 }
 
-func hiveIDFromPeers(addr string, paddrs []string) uint64 {
+// reconcilePeers updates the stored peers of m with the live hives reported by
+// the peers in paddrs. The address of this hive always comes from m.Hive. It
+// returns the voters of the registry reported by the peers.
+func reconcilePeers(m *hiveMeta, paddrs []string) (voters map[uint64]bool) {
+	live, voters := peersInfo(paddrs, peersInfoTimeout)
+	if live != nil {
+		if m.Peers == nil {
+			m.Peers = make(map[uint64]HiveInfo)
+		}
+		for id, i := range live {
+			if old, ok := m.Peers[id]; ok && old.Addr != i.Addr {
+				glog.Infof("hive %v has moved from %v to %v", id, old.Addr, i.Addr)
+			}
+			m.Peers[id] = i
+		}
+	}
+
+	if _, ok := m.Peers[m.Hive.ID]; ok {
+		m.Peers[m.Hive.ID] = m.Hive
+	}
+	return voters
+}
+
+// peersInfoTimeout is the timeout used to fetch the peers of a restarting
+// hive. The hive starts with its stored peers if no peer responds.
+const peersInfoTimeout = 10 * time.Second
+
+// hiveIDFromPeers allocates a new hive ID and adds the hive to the cluster
+// through one of the peers. It also returns whether the hive is added as a
+// voter of the registry.
+func hiveIDFromPeers(addr string, labels map[string]string, paddrs []string) (
+	id uint64, voter bool) {
+
 	if len(paddrs) == 0 {
-		return 1
+		return 1, true
 	}
 
-	ch := make(chan uint64, len(paddrs))
+	type idAndVoter struct {
+		id    uint64
+		voter bool
+	}
+	ch := make(chan idAndVoter, len(paddrs))
 	client := newHTTPClient(10 * time.Second)
 	for _, a := range paddrs {
 		glog.Infof("requesting hive ID from %v", a)
 		go func(a string) {
 			p := newProxyWithRetry(client, a, 100*time.Millisecond, 5)
-			id, err := sendCmd(p, cmd{Data: cmdNewHiveID{Addr: addr}})
+			id, err := sendCmd(p, cmd{Data: cmdNewHiveID{Addr: addr,
+				Labels: labels}})
 			if err != nil {
 				glog.Error(err)
 				return
 			}
-			_, err = sendCmd(p, cmd{
+			res, err := sendCmd(p, cmd{
 				Data: cmdAddHive{
 					Info: raft.NodeInfo{
 						ID:   id.(uint64),
@@ -71,11 +160,13 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 				glog.Error(err)
 				return
 			}
-			ch <- id.(uint64)
+			// Older hives do not report whether the hive is a voter.
+			v, ok := res.(bool)
+			ch <- idAndVoter{id: id.(uint64), voter: v || !ok}
 		}(a)
 		select {
-		case id := <-ch:
-			return id
+		case iv := <-ch:
+			return iv.id, iv.voter
 		case <-time.After(1 * time.Second):
 			glog.Infof("timeout in requesting hive ID from %v", a)
 			continue
@@ -83,7 +174,7 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 	}
 
 	glog.Fatalf("cannot get a new hive ID from peers")
-	return 1
+	return 1, true
 }
 
 func meta(cfg HiveConfig) hiveMeta {
@@ -91,12 +182,12 @@ func meta(cfg HiveConfig) hiveMeta {
 
 	var dec *gob.Decoder
 	metapath := path.Join(cfg.StatePath, "meta")
+	var voters map[uint64]bool
 	f, err := os.Open(metapath)
 	if err != nil {
-		// TODO(soheil): We should also update our peer addresses when we have an
-		// existing meta.
-		m.Peers = peersInfo(cfg.PeerAddrs)
+		m.Peers, _ = peersInfo(cfg.PeerAddrs, 0)
 		m.Hive.Addr = cfg.Addr
+		m.Hive.Labels = cfg.Labels
 		if len(cfg.PeerAddrs) == 0 {
 			// The initial ID is 1. There is no raft node up yet to allocate an ID. So
 			// we must do this when the hive starts.
@@ -104,7 +195,9 @@ func meta(cfg HiveConfig) hiveMeta {
 			goto save
 		}
 
-		m.Hive.ID = hiveIDFromPeers(cfg.Addr, cfg.PeerAddrs)
+		var voter bool
+		m.Hive.ID, voter = hiveIDFromPeers(cfg.Addr, cfg.Labels, cfg.PeerAddrs)
+		m.Observer = !voter
 		goto save
 	}
 
@@ -112,8 +205,22 @@ func meta(cfg HiveConfig) hiveMeta {
 	if err = dec.Decode(&m); err != nil {
 		glog.Fatalf("Cannot decode meta: %v", err)
 	}
-	m.Hive.Addr = cfg.Addr
 	f.Close()
+	if m.Hive.Addr != cfg.Addr {
+		glog.Infof("hive %v has moved from %v to %v", m.Hive.ID, m.Hive.Addr,
+			cfg.Addr)
+		m.Hive.Addr = cfg.Addr
+		m.addrChanged = true
+	}
+	m.Hive.Labels = cfg.Labels
+	voters = reconcilePeers(&m, cfg.PeerAddrs)
+	if cfg.RegVoters != 0 && !m.Observer && len(voters) != 0 &&
+		!voters[m.Hive.ID] {
+		// The hive was removed from the registry's raft group while it was down.
+		glog.Infof("hive %v is no longer a voter and restarts as an observer",
+			m.Hive.ID)
+		m.Observer = true
+	}
 
 save:
 	saveMeta(m, cfg)
@@ -6,9 +6,13 @@ import (
 )
 
 func TestHiveIDFromPeers(t *testing.T) {
-	if id := hiveIDFromPeers("", nil); id != 1 {
+	id, voter := hiveIDFromPeers("", nil, nil)
+	if id != 1 {
 		t.Errorf("%v is not a valid default hive ID", id)
 	}
+	if !voter {
+		t.Error("the first hive is not a voter")
+	}
 }
 
 func TestDefaultMeta(t *testing.T) {
@@ -27,3 +31,37 @@ func TestDefaultMeta(t *testing.T) {
 		t.Errorf("%v is not a valid default hive ID", m.Hive.ID)
 	}
 }
+
+func TestMetaAddrChange(t *testing.T) {
+	cfg := HiveConfig{
+		Addr:      "127.0.0.1:1",
+		StatePath: "/tmp/metatest/",
+	}
+	os.Mkdir(cfg.StatePath, 0700)
+	defer os.RemoveAll(cfg.StatePath)
+	m := meta(cfg)
+	if m.addrChanged {
+		t.Error("address is changed for a new hive")
+	}
+
+	m.Peers = map[uint64]HiveInfo{
+		m.Hive.ID: m.Hive,
+		2:         {ID: 2, Addr: "127.0.0.1:2"},
+	}
+	saveMeta(m, cfg)
+
+	cfg.Addr = "127.0.0.1:3"
+	m = meta(cfg)
+	if !m.addrChanged {
+		t.Error("address change is not detected")
+	}
+	if m.Hive.Addr != cfg.Addr {
+		t.Errorf("invalid address: actual=%v want=%v", m.Hive.Addr, cfg.Addr)
+	}
+	if p := m.Peers[m.Hive.ID]; p.Addr != cfg.Addr {
+		t.Errorf("invalid address in peers: actual=%v want=%v", p.Addr, cfg.Addr)
+	}
+	if p := m.Peers[2]; p.Addr != "127.0.0.1:2" {
+		t.Errorf("invalid peer address: actual=%v want=127.0.0.1:2", p.Addr)
+	}
+}
@@ -0,0 +1,254 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// The optimizer tracks the migration of each bee in its stats:
+//
+//	none -> pending -> in-progress -> done -> (cooldown) -> none
+//	                        |
+//	                        +-> pending (retry) ... -> failed -> (cooldown) -> none
+//
+// A migration is pending until there is a free slot (see
+// HiveConfig.MaxMigrations), and in progress until the local collector of the
+// bee reports its result. Failed migrations are retried at most
+// HiveConfig.MigrationRetries times. Migrated bees, and bees whose migration
+// has failed, are not migrated again for HiveConfig.MigrationCooldown.
+
+// migrationState is the state of the migration of a bee.
+type migrationState int
+
+const (
+	migrationNone migrationState = iota
+	migrationPending
+	migrationInProgress
+	migrationDone
+	migrationFailed
+)
+
+func (s migrationState) String() string {
+	switch s {
+	case migrationNone:
+		return "none"
+	case migrationPending:
+		return "pending"
+	case migrationInProgress:
+		return "in-progress"
+	case migrationDone:
+		return "done"
+	case migrationFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+const (
+	// migrationTimeout is the time after which an in-progress migration with no
+	// result is considered failed.
+	migrationTimeout = 1 * time.Minute
+	// migrationRetryDelay is the time the optimizer waits before retrying a
+	// failed migration.
+	migrationRetryDelay = 5 * time.Second
+)
+
+// migrating returns whether the bee is being migrated.
+func (os optimizerStat) migrating() bool {
+	return os.Migration == migrationPending ||
+		os.Migration == migrationInProgress
+}
+
+// migrationResult is emitted by the local collector of a bee once its
+// migration is finished.
+type migrationResult struct {
+	Bee    uint64
+	To     uint64
+	NewBee uint64
+	Err    string
+}
+
+// migrations drives the migration state machine of the bees in the optimizer
+// dict.
+type migrations struct {
+	ctx   RcvContext
+	dict  state.Dict
+	stats map[uint64]optimizerStat
+	cfg   HiveConfig
+	now   time.Time
+}
+
+func newMigrations(ctx RcvContext) *migrations {
+	dict := ctx.Dict(dictOptimizer)
+	return &migrations{
+		ctx:   ctx,
+		dict:  dict,
+		stats: getOptimizerStats(dict),
+		cfg:   ctx.Hive().(*hive).Config(),
+		now:   time.Now(),
+	}
+}
+
+func (m *migrations) put(os optimizerStat) error {
+	m.stats[os.Bee] = os
+	return m.dict.PutGob(formatBeeID(os.Bee), &os)
+}
+
+// coolingDown returns whether bee b was migrated, or failed to migrate, in
+// the last HiveConfig.MigrationCooldown.
+func (m *migrations) coolingDown(b uint64) bool {
+	os := m.stats[b]
+	switch os.Migration {
+	case migrationDone, migrationFailed:
+		return m.now.Sub(os.Updated) < m.cfg.MigrationCooldown
+	}
+	return false
+}
+
+// expire fails the timed out migrations and ends the expired cooldowns.
+func (m *migrations) expire() {
+	for _, os := range m.stats {
+		switch os.Migration {
+		case migrationInProgress:
+			if m.now.Sub(os.Updated) < migrationTimeout {
+				continue
+			}
+			glog.Warningf("%v times out migrating bee %v to hive %v", m.ctx, os.Bee,
+				os.To)
+			m.fail(os)
+		case migrationDone, migrationFailed:
+			if m.coolingDown(os.Bee) {
+				continue
+			}
+			os.Migration = migrationNone
+			os.Updated = m.now
+			m.put(os)
+		}
+	}
+}
+
+// fail records a failed attempt of the migration of os.
+func (m *migrations) fail(os optimizerStat) {
+	os.Attempts++
+	if os.Attempts <= m.cfg.MigrationRetries {
+		os.Migration = migrationPending
+	} else {
+		glog.Errorf("%v gives up migrating bee %v to hive %v after %v attempts",
+			m.ctx, os.Bee, os.To, os.Attempts)
+		os.Migration = migrationFailed
+		os.Attempts = 0
+	}
+	os.Updated = m.now
+	m.put(os)
+}
+
+// start marks the migration of bee b to hive to as pending.
+func (m *migrations) start(b, to uint64) error {
+	os := m.stats[b]
+	os.Bee = b
+	os.Migration = migrationPending
+	os.To = to
+	os.Attempts = 0
+	os.Updated = m.now
+	return m.put(os)
+}
+
+// dispatch initiates the pending migrations, as long as there are less than
+// HiveConfig.MaxMigrations migrations in progress.
+func (m *migrations) dispatch() {
+	inProgress := 0
+	var pending []optimizerStat
+	for _, os := range m.stats {
+		switch os.Migration {
+		case migrationInProgress:
+			inProgress++
+		case migrationPending:
+			if os.Attempts != 0 && m.now.Sub(os.Updated) < migrationRetryDelay {
+				continue
+			}
+			pending = append(pending, os)
+		}
+	}
+	sort.Sort(statsByUpdate(pending))
+
+	for _, os := range pending {
+		if max := m.cfg.MaxMigrations; max != 0 && inProgress >= max {
+			glog.V(2).Infof("%v has %v migrations in progress, deferring the rest",
+				m.ctx, inProgress)
+			return
+		}
+		glog.Infof("%v initiates migration of bee %v to hive %v (attempt %v)",
+			m.ctx, os.Bee, os.To, os.Attempts+1)
+		m.ctx.SendToBee(cmdMigrate{Bee: os.Bee, To: os.To}, os.Collector)
+		os.Migration = migrationInProgress
+		os.Updated = m.now
+		m.put(os)
+		inProgress++
+	}
+}
+
+// finish records the result of a migration.
+func (m *migrations) finish(res migrationResult) error {
+	os, ok := m.stats[res.Bee]
+	if !ok {
+		glog.V(2).Infof("%v receives the result of an untracked migration: %+v",
+			m.ctx, res)
+		return nil
+	}
+
+	if res.Err != "" {
+		if os.Migration != migrationInProgress || os.To != res.To {
+			glog.V(2).Infof("%v ignores stale migration result %+v", m.ctx, res)
+			return nil
+		}
+		glog.Warningf("%v cannot migrate bee %v to hive %v: %v", m.ctx, res.Bee,
+			res.To, res.Err)
+		m.fail(os)
+		return nil
+	}
+
+	glog.Infof("%v has migrated bee %v to hive %v as bee %v", m.ctx, res.Bee,
+		res.To, res.NewBee)
+	delete(m.stats, res.Bee)
+	if err := m.dict.Del(formatBeeID(res.Bee)); err != nil {
+		return err
+	}
+	nos := m.stats[res.NewBee]
+	nos.Bee = res.NewBee
+	nos.Migration = migrationDone
+	nos.To = res.To
+	nos.Attempts = 0
+	nos.Updated = m.now
+	return m.put(nos)
+}
+
+type statsByUpdate []optimizerStat
+
+func (s statsByUpdate) Len() int      { return len(s) }
+func (s statsByUpdate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s statsByUpdate) Less(i, j int) bool {
+	if !s[i].Updated.Equal(s[j].Updated) {
+		return s[i].Updated.Before(s[j].Updated)
+	}
+	return s[i].Bee < s[j].Bee
+}
+
+// migrationTracker feeds the results of migrations back into the optimizer.
+type migrationTracker struct{}
+
+func (t migrationTracker) Rcv(msg Msg, ctx RcvContext) error {
+	return newMigrations(ctx).finish(msg.Data().(migrationResult))
+}
+
+func (t migrationTracker) Map(msg Msg, ctx MapContext) MappedCells {
+	return optimizerCentrlizedCells
+}
+
+func init() {
+	gob.Register(migrationResult{})
+	gob.Register(migrationState(0))
+}
@@ -45,9 +45,19 @@ type MockRcvContext struct {
 	CtxDicts *state.InMem
 	CtxID    uint64
 	CtxMsgs  []Msg
+	// CtxCellMsgs are the messages sent to cells using SendToCell and
+	// SendToCells.
+	CtxCellMsgs []MockCellMsg
 	// TODO(soheil): add message handling methods.
 }
 
+// MockCellMsg is a message sent to the owners of Cells in App.
+type MockCellMsg struct {
+	Data  interface{}
+	App   string
+	Cells MappedCells
+}
+
 func (m MockRcvContext) Hive() Hive {
 	return m.CtxHive
 }
@@ -75,8 +85,29 @@ func (m *MockRcvContext) Emit(msgData interface{}) {
 	m.CtxMsgs = append(m.CtxMsgs, msg)
 }
 
-func (m MockRcvContext) SendToCell(msgData interface{}, app string,
+func (m *MockRcvContext) SendToCell(msgData interface{}, app string,
 	cell CellKey) {
+
+	m.SendToCells(msgData, app, MappedCells{cell})
+}
+
+// SendToCells records the message in CtxCellMsgs. As the mock has no
+// registry, all cells are considered owned.
+func (m *MockRcvContext) SendToCells(msgData interface{}, app string,
+	cells MappedCells) MappedCells {
+
+	m.CtxCellMsgs = append(m.CtxCellMsgs, MockCellMsg{
+		Data:  msgData,
+		App:   app,
+		Cells: cells,
+	})
+	return nil
+}
+
+func (m *MockRcvContext) SendToBees(msgData interface{}, to []uint64) {
+	for _, id := range to {
+		m.SendToBee(msgData, id)
+	}
 }
 
 func (m *MockRcvContext) SendToBee(msgData interface{}, to uint64) {
@@ -88,6 +119,15 @@ func (m *MockRcvContext) SendToBee(msgData interface{}, to uint64) {
 	m.CtxMsgs = append(m.CtxMsgs, msg)
 }
 
+func (m *MockRcvContext) BroadcastToApp(msgData interface{}, app string) {
+	msg := MockMsg{
+		MsgData: msgData,
+		MsgFrom: m.ID(),
+		MsgApp:  app,
+	}
+	m.CtxMsgs = append(m.CtxMsgs, msg)
+}
+
 func (m *MockRcvContext) ReplyTo(msg Msg, replyData interface{}) error {
 	if msg.NoReply() {
 		return errors.New("cannot reply")
@@ -128,3 +168,15 @@ func (m MockRcvContext) CommitTx() error {
 func (m MockRcvContext) AbortTx() error {
 	return nil
 }
+
+func (m MockRcvContext) Savepoint(name string) error {
+	return nil
+}
+
+func (m MockRcvContext) RollbackTo(name string) error {
+	return nil
+}
+
+func (m MockRcvContext) ReleaseSavepoint(name string) error {
+	return nil
+}
@@ -36,6 +36,8 @@ type msg struct {
 	MsgData interface{}
 	MsgFrom uint64
 	MsgTo   uint64
+	MsgApp  string   // if set, the message is broadcast to all bees of MsgApp.
+	MsgBees []uint64 // if set, the message is sent to each of MsgBees.
 }
 
 func (m msg) NoReply() bool {
@@ -67,9 +69,28 @@ func (m msg) From() uint64 {
 }
 
 func (m msg) String() string {
+	if m.MsgApp != "" {
+		return fmt.Sprintf("%v -> %v/*\t%v(%#v)", m.From(), m.MsgApp, m.Type(),
+			m.Data())
+	}
+	if len(m.MsgBees) != 0 {
+		return fmt.Sprintf("%v -> %v\t%v(%#v)", m.From(), m.MsgBees, m.Type(),
+			m.Data())
+	}
 	return fmt.Sprintf("%v -> %v\t%v(%#v)", m.From(), m.To(), m.Type(), m.Data())
 }
 
+// isAppBroadcast returns whether the message is broadcast to all bees of an
+// application.
+func (m msg) isAppBroadcast() bool {
+	return m.MsgApp != ""
+}
+
+// isMulticast returns whether the message is sent to an explicit set of bees.
+func (m msg) isMulticast() bool {
+	return len(m.MsgBees) != 0
+}
+
 // MsgType returns the message type for d.
 func MsgType(d interface{}) string {
 	if t, ok := d.(Typed); ok {
@@ -86,6 +107,22 @@ func newMsgFromData(data interface{}, from uint64, to uint64) *msg {
 	}
 }
 
+func newAppBroadcastMsg(data interface{}, from uint64, app string) *msg {
+	return &msg{
+		MsgData: data,
+		MsgFrom: from,
+		MsgApp:  app,
+	}
+}
+
+func newMulticastMsg(data interface{}, from uint64, to []uint64) *msg {
+	return &msg{
+		MsgData: data,
+		MsgFrom: from,
+		MsgBees: to,
+	}
+}
+
 type msgAndHandler struct {
 	msg     *msg
 	handler Handler
@@ -100,18 +137,20 @@ func init() {
 }
 
 type msgChannel struct {
-	chin  chan msgAndHandler
-	chout chan msgAndHandler
-	buf   []msgAndHandler
-	start int
-	end   int
+	chin   chan msgAndHandler
+	chout  chan msgAndHandler
+	stopch chan chan bool
+	buf    []msgAndHandler
+	start  int
+	end    int
 }
 
 func newMsgChannel(bufSize int) *msgChannel {
 	q := &msgChannel{
-		chin:  make(chan msgAndHandler, bufSize),
-		chout: make(chan msgAndHandler, bufSize),
-		buf:   make([]msgAndHandler, bufSize),
+		chin:   make(chan msgAndHandler, bufSize),
+		chout:  make(chan msgAndHandler, bufSize),
+		stopch: make(chan chan bool),
+		buf:    make([]msgAndHandler, bufSize),
 	}
 	go q.pipe()
 	return q
@@ -125,7 +164,9 @@ func (q *msgChannel) pipe() {
 		if dequed {
 			chout = q.chout
 		} else {
-			q.maybeFastPipe()
+			if q.maybeFastPipe() {
+				return
+			}
 			chout = nil
 		}
 		select {
@@ -138,11 +179,33 @@ func (q *msgChannel) pipe() {
 		case chout <- first:
 			q.maybeWriteMore()
 			first, dequed = q.deque()
+		case ch := <-q.stopch:
+			if !dequed && q.stop(ch) {
+				return
+			}
 		}
 	}
 }
 
-func (q *msgChannel) maybeFastPipe() {
+// stop stops the pipe if the channel is empty, and reports the result on ch.
+func (q *msgChannel) stop(ch chan bool) bool {
+	stopped := q.empty() && len(q.chin) == 0 && len(q.chout) == 0
+	ch <- stopped
+	return stopped
+}
+
+// stopIfEmpty stops the channel if it has no message, and returns whether the
+// channel is stopped. The caller must ensure that there is no concurrent
+// reader or writer.
+func (q *msgChannel) stopIfEmpty() bool {
+	ch := make(chan bool)
+	q.stopch <- ch
+	return <-ch
+}
+
+// maybeFastPipe pipes the messages directly from the input to the output
+// channel. It returns true if the channel is stopped meanwhile.
+func (q *msgChannel) maybeFastPipe() (stopped bool) {
 	cw := cap(q.chout)
 	cr := cap(q.chin)
 	for {
@@ -155,12 +218,18 @@ func (q *msgChannel) maybeFastPipe() {
 				runtime.Gosched()
 				continue
 			}
-			return
+			return false
 		}
 
 		for i := 0; i < w; i++ {
-			mh := <-q.chin
-			q.chout <- mh
+			select {
+			case mh := <-q.chin:
+				q.chout <- mh
+			case ch := <-q.stopch:
+				if q.stop(ch) {
+					return true
+				}
+			}
 		}
 	}
 }
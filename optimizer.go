@@ -0,0 +1,217 @@
+package beehive
+
+import (
+	"fmt"
+	"sort"
+)
+
+// OptimizerInput is the input of optimizer policies, collected from all the
+// hives of the cluster.
+type OptimizerInput struct {
+	// Traffic is the bee traffic matrix: Traffic[b][f] is the number of messages
+	// that bee b has received from bee f.
+	Traffic map[uint64]map[uint64]uint64
+	// Bees contains the information of the bees in the traffic matrix.
+	Bees map[uint64]BeeInfo
+	// StateSizes is the number of bytes used by the keys and the values in the
+	// state of bees, if known.
+	StateSizes map[uint64]int
+	// HiveLoads is the load of live hives.
+	HiveLoads map[uint64]HiveLoad
+	// Sticky contains the bees that must not be migrated (i.e., the bees of
+	// sticky applications).
+	Sticky map[uint64]bool
+	// Migrating contains the bees that are being migrated. Their hives might
+	// be stale in Bees.
+	Migrating map[uint64]bool
+
+	// foreign contains the bees planned by other policies. They are not
+	// candidates of the default policy, so that they do not blacklist hives.
+	foreign map[uint64]bool
+}
+
+// Migration represents the migration of a bee to another hive.
+type Migration struct {
+	Bee    uint64 `json:"bee"`
+	To     uint64 `json:"to"`
+	Reason string `json:"reason"`
+	// Traffic is the number of messages the bee has exchanged with each hive,
+	// if the policy uses it.
+	Traffic map[uint64]uint64 `json:"traffic,omitempty"`
+	// Score is the score of the migration, if the policy scores migrations.
+	Score int `json:"score,omitempty"`
+}
+
+// OptimizerPolicy represents an optimization algorithm that decides which bees
+// to migrate. The optimizer calls Plan periodically, when the hives are
+// instrumented. Note that a policy is called by one hive at a time, and can
+// keep its own state across rounds.
+//
+// Migrations of sticky or migrating bees, and migrations to the current hive
+// of a bee or to hives not in HiveLoads are ignored.
+type OptimizerPolicy interface {
+	// Plan returns the bees to migrate based on in.
+	Plan(in OptimizerInput) []Migration
+}
+
+// AppWithOptimizerPolicy is an application option that customizes the
+// optimizer policy of the application's bees. The migrations that policy p
+// plans for the bees of other applications are ignored.
+func AppWithOptimizerPolicy(p OptimizerPolicy) AppOption {
+	return func(a *app) {
+		a.optimizer = p
+	}
+}
+
+// NewDefaultOptimizerPolicy returns the default optimizer policy. It migrates
+// a bee to the hive that exchanges more than twice the messages exchanged with
+// the local hive of the bee, once that is observed in more than minScore
+// rounds. In each round, a hive is either the source or the destination of
+// migrations.
+func NewDefaultOptimizerPolicy(minScore int) OptimizerPolicy {
+	return &defaultOptimizerPolicy{
+		minScore: minScore,
+		scores:   make(map[uint64]optimizerScore),
+	}
+}
+
+type optimizerScore struct {
+	Score   int
+	LastMax uint64
+}
+
+type defaultOptimizerPolicy struct {
+	minScore int
+	scores   map[uint64]optimizerScore
+}
+
+// scoringPolicy is a policy that keeps scores across rounds. The optimizer
+// stores the scores in its dictionary, so that they survive the migration of
+// the optimizer bee.
+type scoringPolicy interface {
+	loadScores(scores map[uint64]optimizerScore)
+	savedScores() map[uint64]optimizerScore
+}
+
+func (p *defaultOptimizerPolicy) loadScores(
+	scores map[uint64]optimizerScore) {
+
+	p.scores = scores
+}
+
+func (p *defaultOptimizerPolicy) savedScores() map[uint64]optimizerScore {
+	return p.scores
+}
+
+// hiveTraffic returns the number of messages each bee has exchanged with the
+// bees of each hive.
+func hiveTraffic(in OptimizerInput) map[uint64]map[uint64]uint64 {
+	bhmx := make(map[uint64]map[uint64]uint64)
+	add := func(b, h, cnt uint64) {
+		hmx, ok := bhmx[b]
+		if !ok {
+			hmx = make(map[uint64]uint64)
+			bhmx[b] = hmx
+		}
+		hmx[h] += cnt
+	}
+
+	for b, mx := range in.Traffic {
+		if in.Migrating[b] || in.Sticky[b] {
+			continue
+		}
+		bi, ok := in.Bees[b]
+		if !ok || bi.Detached {
+			continue
+		}
+		for fromb, cnt := range mx {
+			if in.Migrating[fromb] {
+				continue
+			}
+			frombi, ok := in.Bees[fromb]
+			if !ok {
+				continue
+			}
+
+			add(b, frombi.Hive, cnt)
+			if frombi.Detached {
+				continue
+			}
+			add(fromb, bi.Hive, cnt)
+		}
+	}
+	return bhmx
+}
+
+func (p *defaultOptimizerPolicy) Plan(in OptimizerInput) []Migration {
+	sorted := make(beeHiveStat, 0, len(in.Traffic))
+	bhmx := hiveTraffic(in)
+	for b, hmx := range bhmx {
+		if in.foreign[b] {
+			continue
+		}
+		bi := in.Bees[b]
+		local := hmx[bi.Hive]
+		max := uint64(0)
+		maxh := uint64(0)
+		for h, cnt := range hmx {
+			if h == bi.Hive {
+				continue
+			}
+			if max < cnt {
+				max = cnt
+				maxh = h
+			}
+		}
+		if max <= 2*local {
+			continue
+		}
+		s := p.scores[b]
+		if max == s.LastMax {
+			continue
+		}
+		s.Score++
+		s.LastMax = max
+		p.scores[b] = s
+		if s.Score <= p.minScore {
+			continue
+		}
+		sorted = append(sorted, beeHiveCnt{
+			Bee:  b,
+			Hive: maxh,
+			Cnt:  max,
+		})
+	}
+	sort.Sort(sorted)
+
+	var plan []Migration
+	blacklist := make(map[uint64]bool)
+	for _, bhc := range sorted {
+		bi := in.Bees[bhc.Bee]
+		if blacklist[bi.Hive] {
+			continue
+		}
+		blacklist[bhc.Hive] = true
+		plan = append(plan, Migration{
+			Bee: bhc.Bee,
+			To:  bhc.Hive,
+			Reason: fmt.Sprintf("%v msgs with hive %v > 2 * %v msgs with local hive",
+				bhc.Cnt, bhc.Hive, bhmx[bhc.Bee][bi.Hive]),
+			Traffic: bhmx[bhc.Bee],
+			Score:   p.scores[bhc.Bee].Score,
+		})
+		delete(p.scores, bhc.Bee)
+	}
+	return plan
+}
+
+// validMigration returns whether m is a valid migration for in.
+func validMigration(m Migration, in OptimizerInput) bool {
+	bi, ok := in.Bees[m.Bee]
+	if !ok || bi.Detached || in.Sticky[m.Bee] || in.Migrating[m.Bee] ||
+		bi.Hive == m.To {
+		return false
+	}
+	_, ok = in.HiveLoads[m.To]
+	return ok
+}
@@ -0,0 +1,254 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Bees of applications with an idle timeout (see AppWithIdleTimeout) are
+// passivated when they receive no message for that long: the bee saves its
+// colony, cells and state under HiveConfig.StatePath and its goroutines exit.
+// The registry still maps the cells to the bee, and the qee reactivates the
+// bee from disk once a message or a command is destined to it. Messages
+// broadcast to the local bees are kept in memory for the passive bees, and are
+// delivered before any other message once the bee is reactivated. They are
+// lost if the hive stops before the bee is reactivated.
+
+// maxPassiveBroadcasts is the number of pending broadcasts that reactivates a
+// passive bee, so that the pending broadcasts of a cold bee remain bounded.
+const maxPassiveBroadcasts = 1024
+
+// passiveBee is the on-disk representation of a passive bee.
+type passiveBee struct {
+	Colony Colony
+	Cells  MappedCells
+	State  []byte
+}
+
+func passiveBeePath(cfg HiveConfig, app string, id uint64) string {
+	return path.Join(cfg.StatePath, "passive", app, fmt.Sprintf("%016X", id))
+}
+
+// passivate saves the bee on disk and stops it, if it has received no message
+// in the last timeout. It returns whether the bee is passivated.
+func (b *bee) passivate(timeout time.Duration) (bool, error) {
+	if b.detached || b.proxy || b.app.persistent() || !b.isLeader() ||
+		b.status != beeStatusStarted {
+		return false, nil
+	}
+	if b.idleFor() < timeout {
+		return false, nil
+	}
+	b.Lock()
+	snoozed := len(b.timers) != 0
+	b.Unlock()
+	if snoozed {
+		return false, nil
+	}
+
+	// BeeStopping is fired before the state is saved, so that the changes made
+	// by lifecycle handlers survive the passivation.
+	b.fireEvent(BeeStopping)
+	s, err := b.stateL1.Save()
+	if err != nil {
+		return false, err
+	}
+	pb := passiveBee{
+		Colony: b.colony(),
+		Cells:  b.mappedCells(),
+		State:  s,
+	}
+	p := passiveBeePath(b.hive.config, b.app.Name(), b.ID())
+	if err := writePassiveBee(p, pb); err != nil {
+		return false, err
+	}
+
+	// The qee is blocked on this command, so messages can only be enqueued by
+	// snoozed messages, and there is none.
+	if !b.dataCh.stopIfEmpty() {
+		os.Remove(p)
+		return false, nil
+	}
+
+	b.status = beeStatusStopped
+	glog.V(2).Infof("%v is passivated", b)
+	return true, nil
+}
+
+func (b *bee) markActive() {
+	atomic.StoreInt64(&b.lastActive, time.Now().UnixNano())
+}
+
+// idleFor returns how long the bee has not received any message.
+func (b *bee) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&b.lastActive))
+}
+
+func writePassiveBee(p string, pb passiveBee) error {
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pb); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func readPassiveBee(p string) (pb passiveBee, err error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return pb, err
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(b)).Decode(&pb)
+	return pb, err
+}
+
+// passivateIdleBees passivates the local bees that are idle for the idle
+// timeout of the application.
+func (q *qee) passivateIdleBees() {
+	q.RLock()
+	bees := make([]*bee, 0, len(q.bees))
+	for _, b := range q.bees {
+		if !b.detached && !b.proxy && b.idleFor() >= q.app.idleTimeout {
+			bees = append(bees, b)
+		}
+	}
+	q.RUnlock()
+
+	for _, b := range bees {
+		res, err := b.processCmd(cmdPassivate{Timeout: q.app.idleTimeout})
+		if err != nil {
+			glog.Errorf("%v cannot passivate %v: %v", q, b, err)
+			continue
+		}
+		if !res.(bool) {
+			continue
+		}
+		q.Lock()
+		delete(q.bees, b.ID())
+		q.passive[b.ID()] = nil
+		q.Unlock()
+	}
+}
+
+// localBee returns the local bee with id. If the bee is passive, it is
+// reactivated.
+func (q *qee) localBee(id uint64) (*bee, bool) {
+	if b, ok := q.beeByID(id); ok {
+		return b, true
+	}
+
+	b, err := q.activate(id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("%v cannot reactivate bee %v: %v", q, id, err)
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+// loadPassiveBees lists the bees passivated on disk, e.g., before the hive
+// was restarted.
+func (q *qee) loadPassiveBees() {
+	if q.app.idleTimeout <= 0 {
+		return
+	}
+
+	dir := path.Dir(passiveBeePath(q.hive.config, q.app.Name(), 0))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("%v cannot list passive bees: %v", q, err)
+		}
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		id, err := strconv.ParseUint(f.Name(), 16, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := q.bees[id]; !ok {
+			q.passive[id] = nil
+		}
+	}
+}
+
+// passiveBees returns the IDs of the passive bees of the qee.
+func (q *qee) passiveBees() []uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	ids := make([]uint64, 0, len(q.passive))
+	for id := range q.passive {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// activate reloads passive bee id from disk.
+func (q *qee) activate(id uint64) (*bee, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if b, ok := q.bees[id]; ok {
+		return b, nil
+	}
+
+	p := passiveBeePath(q.hive.config, q.app.Name(), id)
+	pb, err := readPassiveBee(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			delete(q.passive, id)
+		}
+		return nil, err
+	}
+
+	b := q.defaultLocalBee(id)
+	b.setState(q.app.newState())
+	if err := b.stateL1.Restore(pb.State); err != nil {
+		return nil, err
+	}
+	b.beeColony = pb.Colony
+	b.addMappedCells(pb.Cells)
+	b.becomeLeader()
+	b.reloaded = true
+	if err := os.Remove(p); err != nil {
+		return nil, err
+	}
+
+	q.bees[id] = b
+	pending := q.passive[id]
+	delete(q.passive, id)
+	glog.V(2).Infof("%v reactivates %v with %v pending broadcasts", q, b,
+		len(pending))
+	go b.start()
+	for _, mh := range pending {
+		q.deliver(b, mh)
+	}
+	return b, nil
+}
+
+func init() {
+	gob.Register(passiveBee{})
+}
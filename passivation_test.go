@@ -0,0 +1,219 @@
+package beehive
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+type passivationTestMsg string
+
+func TestBeePassivation(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_passivation"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	timeout := 100 * time.Millisecond
+	a := h.NewApp("passivation", AppWithIdleTimeout(timeout))
+	ch := make(chan int)
+	ids := make(chan uint64, 1)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", string(msg.Data().(passivationTestMsg))}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		d := ctx.Dict("D")
+		k := string(msg.Data().(passivationTestMsg))
+		v, _ := d.Get(k)
+		v = append(v, 0)
+		d.Put(k, v)
+		select {
+		case ids <- ctx.ID():
+		default:
+		}
+		ch <- len(v)
+		return nil
+	}
+	a.HandleFunc(passivationTestMsg(""), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(passivationTestMsg("k"))
+	if n := <-ch; n != 1 {
+		t.Fatalf("invalid count: actual=%v want=1", n)
+	}
+	id := <-ids
+
+	q := a.(*app).qee
+	p := passiveBeePath(cfg, a.Name(), id)
+	for i := 0; ; i++ {
+		if _, ok := q.beeByID(id); !ok {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("bee %v is not passivated", id)
+		}
+		time.Sleep(timeout)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Fatalf("passive bee is not stored on disk: %v", err)
+	}
+	if _, err := h.(*hive).registry.bee(id); err != nil {
+		t.Errorf("passive bee is removed from the registry: %v", err)
+	}
+
+	h.Emit(passivationTestMsg("k"))
+	if n := <-ch; n != 2 {
+		t.Errorf("state is not restored: actual=%v want=2", n)
+	}
+	if rid := <-ids; rid != id {
+		t.Errorf("invalid reactivated bee: actual=%v want=%v", rid, id)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("passive bee is not removed from disk: %v", err)
+	}
+}
+
+type passivationBroadcastMsg struct{}
+
+func TestBroadcastToPassiveBees(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_passivation_bcast"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	timeout := 100 * time.Millisecond
+	a := h.NewApp("passivation", AppWithIdleTimeout(timeout))
+	ch := make(chan string)
+	a.HandleFunc(passivationTestMsg(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", string(msg.Data().(passivationTestMsg))}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- fmt.Sprintf("msg@%v", ctx.ID())
+			return nil
+		})
+	a.HandleFunc(passivationBroadcastMsg{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- fmt.Sprintf("bcast@%v", ctx.ID())
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(passivationTestMsg("k"))
+	var id uint64
+	fmt.Sscanf(<-ch, "msg@%v", &id)
+
+	q := a.(*app).qee
+	for i := 0; ; i++ {
+		if _, ok := q.beeByID(id); !ok {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("bee %v is not passivated", id)
+		}
+		time.Sleep(timeout)
+	}
+
+	// Broadcasts do not reactivate the bee, and are delivered before the next
+	// message once the bee is reactivated.
+	h.Emit(passivationBroadcastMsg{})
+	h.Emit(passivationBroadcastMsg{})
+	select {
+	case <-ch:
+		t.Fatal("broadcast reactivates the passive bee")
+	case <-time.After(4 * timeout):
+	}
+	if _, ok := q.beeByID(id); ok {
+		t.Fatal("broadcast reactivates the passive bee")
+	}
+
+	h.Emit(passivationTestMsg("k"))
+	b := fmt.Sprintf("bcast@%v", id)
+	for _, want := range []string{b, b, fmt.Sprintf("msg@%v", id)} {
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Errorf("invalid message: actual=%v want=%v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("reactivated bee does not receive the pending broadcasts")
+		}
+	}
+}
+
+type passivationLifecycleHandler struct {
+	ch chan []byte
+}
+
+func (h *passivationLifecycleHandler) Map(msg Msg,
+	ctx MapContext) MappedCells {
+
+	return MappedCells{{"D", "k"}}
+}
+
+func (h *passivationLifecycleHandler) Rcv(msg Msg, ctx RcvContext) error {
+	v, _ := ctx.Dict("D").Get("stopping")
+	h.ch <- v
+	return nil
+}
+
+func (h *passivationLifecycleHandler) OnBeeEvent(e BeeEvent,
+	ctx RcvContext) {
+
+	if e == BeeStopping {
+		ctx.Dict("D").Put("stopping", []byte("y"))
+	}
+}
+
+func TestPassivationSavesStoppingState(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_passivation_stopping"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	timeout := 100 * time.Millisecond
+	a := h.NewApp("passivation", AppWithIdleTimeout(timeout))
+	lh := &passivationLifecycleHandler{ch: make(chan []byte)}
+	a.Handle(passivationTestMsg(""), lh)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(passivationTestMsg("k"))
+	if v := <-lh.ch; v != nil {
+		t.Fatalf("invalid value before passivation: %q", v)
+	}
+
+	q := a.(*app).qee
+	for i := 0; ; i++ {
+		if len(q.passiveBees()) != 0 {
+			break
+		}
+		if i == 50 {
+			t.Fatal("bee is not passivated")
+		}
+		time.Sleep(timeout)
+	}
+
+	h.Emit(passivationTestMsg("k"))
+	if v := <-lh.ch; string(v) != "y" {
+		t.Errorf("state written on BeeStopping is lost: %q", v)
+	}
+}
@@ -1,6 +1,12 @@
 package beehive
 
-import "math/rand"
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
 
 // PlacementMethod represents a placement algorithm that chooses a hive among
 // live hives for the given mapped cells. This interface is used only for the
@@ -29,3 +35,181 @@ func (r RandomPlacement) Place(cells MappedCells, thisHive Hive,
 
 	return liveHives[r.Intn(len(liveHives))]
 }
+
+// defaultVirtualNodes is the default number of points of a hive on the ring of
+// ConsistentHashPlacement.
+const defaultVirtualNodes = 64
+
+// ConsistentHashPlacement is a placement method that places mapped cells on
+// live hives using consistent hashing. When a hive joins or leaves the
+// cluster, only the cells placed on that hive are affected.
+type ConsistentHashPlacement struct {
+	// VirtualNodes is the number of points of each hive on the hash ring. If
+	// zero, 64 points are used.
+	VirtualNodes int
+}
+
+func (p ConsistentHashPlacement) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	v := p.VirtualNodes
+	if v <= 0 {
+		v = defaultVirtualNodes
+	}
+
+	ring := make(hashRing, 0, v*len(liveHives))
+	for i, h := range liveHives {
+		for j := 0; j < v; j++ {
+			ring = append(ring, ringPoint{
+				hash: hashOf(strconv.FormatUint(h.ID, 10), strconv.Itoa(j)),
+				hive: i,
+			})
+		}
+	}
+	sort.Sort(ring)
+
+	k := cellsHash(cells)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= k })
+	if i == len(ring) {
+		i = 0
+	}
+	return liveHives[ring[i].hive]
+}
+
+type ringPoint struct {
+	hash uint64
+	hive int
+}
+
+type hashRing []ringPoint
+
+func (r hashRing) Len() int           { return len(r) }
+func (r hashRing) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r hashRing) Less(i, j int) bool { return r[i].hash < r[j].hash }
+
+// LoadMetric is the metric used by LeastLoadedPlacement.
+type LoadMetric int
+
+const (
+	// BeeCount measures the load of a hive by the number of its bees.
+	BeeCount LoadMetric = iota
+	// MsgRate measures the load of a hive by the number of messages its bees
+	// receive per second. The rates of remote hives are refreshed periodically
+	// in the background.
+	MsgRate
+)
+
+// LeastLoadedPlacement is a placement method that places mapped cells on the
+// live hive with the least load. Ties are broken in favor of the local hive
+// and then the hive with the smallest ID.
+type LeastLoadedPlacement struct {
+	Metric LoadMetric
+}
+
+func (p LeastLoadedPlacement) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	h, ok := thisHive.(*hive)
+	if !ok {
+		return HiveInfo{ID: thisHive.ID()}
+	}
+
+	loads := h.hiveLoads()
+	var rates map[uint64]float64
+	if p.Metric == MsgRate {
+		rates = h.msgRates()
+	}
+
+	load := func(i HiveInfo) float64 {
+		if p.Metric == MsgRate {
+			return rates[i.ID]
+		}
+		return float64(loads[i.ID].Bees)
+	}
+
+	if len(liveHives) == 0 {
+		return HiveInfo{ID: thisHive.ID()}
+	}
+	best := liveHives[0]
+	for _, i := range liveHives {
+		if i.ID == thisHive.ID() {
+			best = i
+			break
+		}
+	}
+	bestl := load(best)
+	for _, i := range liveHives {
+		l := load(i)
+		if l < bestl {
+			best, bestl = i, l
+			continue
+		}
+		if l == bestl && best.ID != thisHive.ID() && i.ID < best.ID {
+			best = i
+		}
+	}
+	return best
+}
+
+// WeightedPlacement is a placement method that places mapped cells on live
+// hives proportional to the weights of the hives, using weighted rendezvous
+// hashing. The weight of a hive is the weight of the value of its Label (e.g.,
+// "class": {"large": 4, "small": 1}). When a hive joins or leaves the cluster,
+// only the cells placed on that hive are affected.
+type WeightedPlacement struct {
+	Label   string
+	Weights map[string]float64
+	// Default is the weight of hives with a label value not in Weights.
+	Default float64
+}
+
+func (p WeightedPlacement) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	k := strconv.FormatUint(cellsHash(cells), 10)
+	best := HiveInfo{ID: thisHive.ID()}
+	bests := 0.0
+	for _, i := range liveHives {
+		w, ok := p.Weights[i.Label(p.Label)]
+		if !ok {
+			w = p.Default
+		}
+		if w <= 0 {
+			continue
+		}
+
+		// Map the hash to (0, 1).
+		u := (float64(hashOf(k, strconv.FormatUint(i.ID, 10))>>11) + 0.5) /
+			(1 << 53)
+		if s := -w / math.Log(u); s > bests {
+			best, bests = i, s
+		}
+	}
+	return best
+}
+
+// cellsHash returns a hash of cells that does not depend on their order.
+func cellsHash(cells MappedCells) uint64 {
+	sorted := make(MappedCells, len(cells))
+	copy(sorted, cells)
+	sort.Sort(sorted)
+	s := make([]string, 0, 2*len(sorted))
+	for _, c := range sorted {
+		s = append(s, c.Dict, c.Key)
+	}
+	return hashOf(s...)
+}
+
+func hashOf(s ...string) uint64 {
+	h := fnv.New64a()
+	for _, p := range s {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	// FNV does not mix the last bytes into the high bits. So, we finalize the
+	// hash as in splitmix64.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
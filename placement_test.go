@@ -1,6 +1,7 @@
 package beehive
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
@@ -63,3 +64,114 @@ func TestPlacement(t *testing.T) {
 		t.Errorf("received on an incorrect hive: hiveid=%d want=%d", id, h2.ID())
 	}
 }
+
+func testHives(ids ...uint64) []HiveInfo {
+	hives := make([]HiveInfo, 0, len(ids))
+	for _, id := range ids {
+		hives = append(hives, HiveInfo{
+			ID:     id,
+			Addr:   fmt.Sprintf("hive%v", id),
+			Labels: map[string]string{"class": fmt.Sprintf("c%v", id%2)},
+		})
+	}
+	return hives
+}
+
+func testCells(n int) []MappedCells {
+	cells := make([]MappedCells, 0, n)
+	for i := 0; i < n; i++ {
+		cells = append(cells, MappedCells{{"D", fmt.Sprintf("K%v", i)}})
+	}
+	return cells
+}
+
+// testPlacementStability checks that when a hive joins or leaves, only the
+// cells placed on that hive are moved.
+func testPlacementStability(t *testing.T, p PlacementMethod) {
+	h := &hive{id: 1}
+	cells := testCells(1000)
+	place := func(hives []HiveInfo) map[int]uint64 {
+		placed := make(map[int]uint64)
+		for i, c := range cells {
+			placed[i] = p.Place(c, h, hives).ID
+		}
+		return placed
+	}
+
+	before := place(testHives(1, 2, 3, 4))
+	cnt := make(map[uint64]int)
+	for _, id := range before {
+		cnt[id]++
+	}
+	for id := uint64(1); id <= 4; id++ {
+		if cnt[id] == 0 {
+			t.Errorf("no cell is placed on hive %v", id)
+		}
+	}
+
+	joined := place(testHives(1, 2, 3, 4, 5))
+	for i, id := range joined {
+		if id != before[i] && id != 5 {
+			t.Errorf("cell %v is moved from %v to %v when hive 5 joins", i,
+				before[i], id)
+		}
+	}
+
+	left := place(testHives(1, 2, 4))
+	for i, id := range left {
+		if id != before[i] && before[i] != 3 {
+			t.Errorf("cell %v is moved from %v to %v when hive 3 leaves", i,
+				before[i], id)
+		}
+	}
+}
+
+func TestConsistentHashPlacement(t *testing.T) {
+	testPlacementStability(t, ConsistentHashPlacement{})
+}
+
+func TestWeightedPlacement(t *testing.T) {
+	p := WeightedPlacement{
+		Label:   "class",
+		Weights: map[string]float64{"c0": 3, "c1": 1},
+	}
+	testPlacementStability(t, p)
+
+	h := &hive{id: 1}
+	cnt := make(map[uint64]int)
+	for _, c := range testCells(1000) {
+		cnt[p.Place(c, h, testHives(1, 2)).ID]++
+	}
+	if cnt[2] < 2*cnt[1] {
+		t.Errorf("invalid weighted placement: %v", cnt)
+	}
+}
+
+func TestLeastLoadedPlacement(t *testing.T) {
+	h := &hive{id: 1, registry: newRegistry("test")}
+	for _, i := range testHives(1, 2, 3) {
+		h.registry.addHive(i)
+	}
+	h.registry.BeeID = 3
+	h.registry.addBee(BeeInfo{ID: 1, Hive: 1})
+	h.registry.addBee(BeeInfo{ID: 2, Hive: 2})
+
+	p := LeastLoadedPlacement{}
+	c := MappedCells{{"D", "K"}}
+	if i := p.Place(c, h, testHives(1, 2, 3)); i.ID != 3 {
+		t.Errorf("invalid placement: actual=%v want=3", i.ID)
+	}
+
+	h.registry.addBee(BeeInfo{ID: 3, Hive: 3})
+	if i := p.Place(c, h, testHives(1, 2, 3)); i.ID != 1 {
+		t.Errorf("invalid placement on equal loads: actual=%v want=1", i.ID)
+	}
+
+	h.registry.addHive(testHives(4)[0])
+	if i := p.Place(c, h, testHives(1, 2, 3, 4)); i.ID != 4 {
+		t.Errorf("invalid placement on a new hive: actual=%v want=4", i.ID)
+	}
+	if i := p.Place(c, h, testHives(2, 3)); i.ID != 2 {
+		t.Errorf("invalid placement on hives 2 and 3: actual=%v want=2", i.ID)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
@@ -27,11 +28,26 @@ type qee struct {
 	state State
 
 	bees map[uint64]*bee
+	// passive holds the broadcasts pending for each passive bee.
+	passive map[uint64][]msgAndHandler
 }
 
 func (q *qee) start() {
 	q.stopped = false
 	dataCh := q.dataCh.out()
+	var idleCh <-chan time.Time
+	if t := q.app.idleTimeout; t > 0 && !q.app.persistent() {
+		ticker := time.NewTicker(t / 2)
+		defer ticker.Stop()
+		idleCh = ticker.C
+	}
+	var sweepCh <-chan time.Time
+	if t := q.app.sweepInterval; t > 0 {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		sweepCh = ticker.C
+	}
+	q.loadPassiveBees()
 	for !q.stopped {
 		select {
 		case d := <-dataCh:
@@ -39,6 +55,15 @@ func (q *qee) start() {
 
 		case c := <-q.ctrlCh:
 			q.handleCmd(c)
+
+		case <-idleCh:
+			q.passivateIdleBees()
+
+		case <-sweepCh:
+			q.expireKeys()
+			if q.app.rewritesOutdatedValues() {
+				q.rewriteOutdated()
+			}
 		}
 	}
 }
@@ -78,7 +103,7 @@ func (q *qee) addBee(b *bee) {
 }
 
 func (q *qee) allocateNewBeeID() (BeeInfo, error) {
-	res, err := q.hive.node.Process(context.TODO(), newBeeID{})
+	res, err := q.hive.processRaft(context.TODO(), newBeeID{})
 	if err != nil {
 		return BeeInfo{}, err
 	}
@@ -92,6 +117,10 @@ func (q *qee) allocateNewBeeID() (BeeInfo, error) {
 }
 
 func (q *qee) newLocalBee(withInitColony bool) (*bee, error) {
+	if err := q.checkBeeQuota(); err != nil {
+		return nil, err
+	}
+
 	info, err := q.allocateNewBeeID()
 	if err != nil {
 		return nil, fmt.Errorf("%v cannot allocate a new bee ID: %v", q, err)
@@ -111,7 +140,7 @@ func (q *qee) newLocalBee(withInitColony bool) (*bee, error) {
 	} else {
 		b.becomeZombie()
 	}
-	if _, err := q.hive.node.Process(context.TODO(), addBee(info)); err != nil {
+	if _, err := q.hive.processRaft(context.TODO(), addBee(info)); err != nil {
 		return nil, err
 	}
 
@@ -145,7 +174,7 @@ func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
 	b := q.defaultLocalBee(info.ID)
 	b.setState(q.app.newState())
 	b.becomeDetached(h)
-	if _, err := q.hive.node.Process(context.TODO(), addBee(info)); err != nil {
+	if _, err := q.hive.processRaft(context.TODO(), addBee(info)); err != nil {
 		return nil, err
 	}
 	q.addBee(b)
@@ -160,7 +189,7 @@ func (q *qee) processCmd(data interface{}) (interface{}, error) {
 }
 
 func (q *qee) sendCmdToBee(bid uint64, data interface{}) (interface{}, error) {
-	if b, ok := q.beeByID(bid); ok {
+	if b, ok := q.localBee(bid); ok {
 		ch := make(chan cmdResult)
 		b.enqueCmd(newCmdAndChannel(data, q.app.Name(), bid, ch))
 		return (<-ch).get()
@@ -201,7 +230,7 @@ func (q *qee) stopBees() {
 
 func (q *qee) handleCmd(cc cmdAndChannel) {
 	if cc.cmd.To != 0 {
-		if b, ok := q.beeByID(cc.cmd.To); ok {
+		if b, ok := q.localBee(cc.cmd.To); ok {
 			b.enqueCmd(cc)
 			return
 		}
@@ -267,6 +296,10 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 	case cmdMigrate:
 		res, err = q.migrate(cmd.Bee, cmd.To)
 
+	case cmdBroadcast:
+		m := cmd.Msg
+		q.enqueMsg(msgAndHandler{msg: &m, handler: q.app.handler(m.Type())})
+
 	default:
 		err = fmt.Errorf("unknown queen bee command %#v", cmd)
 	}
@@ -289,6 +322,7 @@ func (q *qee) reloadBee(id uint64, col Colony) (*bee, error) {
 		return nil, err
 	}
 	b := q.defaultLocalBee(id)
+	b.reloaded = true
 	b.setState(q.app.newState())
 	b.setColony(info.Colony)
 	if b.isLeader() {
@@ -320,10 +354,46 @@ func (q *qee) isDetached(id uint64) bool {
 	return err == nil && b.Detached
 }
 
+// broadcastLocal sends mh to the local bees that lead their colonies. For
+// passive bees, mh is kept pending and is delivered when the bee is
+// reactivated (see maxPassiveBroadcasts).
+func (q *qee) broadcastLocal(mh msgAndHandler) {
+	glog.V(2).Infof("%v sends a message to all local bees: %v", q, mh.msg)
+	var full []uint64
+	q.Lock()
+	for id, b := range q.bees {
+		if b.detached || b.proxy {
+			continue
+		}
+		if b.colony().Leader != id {
+			continue
+		}
+		q.deliver(b, mh)
+	}
+	for id, pending := range q.passive {
+		q.passive[id] = append(pending, mh)
+		if len(pending)+1 >= maxPassiveBroadcasts {
+			full = append(full, id)
+		}
+	}
+	q.Unlock()
+
+	for _, id := range full {
+		if _, err := q.activate(id); err != nil {
+			glog.Errorf("%v cannot reactivate bee %v: %v", q, id, err)
+		}
+	}
+}
+
 func (q *qee) handleMsg(mh msgAndHandler) {
+	if mh.msg.isAppBroadcast() {
+		q.broadcastLocal(mh)
+		return
+	}
+
 	if mh.msg.IsUnicast() {
 		glog.V(2).Infof("unicast msg: %v", mh.msg)
-		b, ok := q.beeByID(mh.msg.To())
+		b, ok := q.localBee(mh.msg.To())
 		if !ok {
 			info, err := q.hive.registry.bee(mh.msg.To())
 			if err != nil {
@@ -346,7 +416,7 @@ func (q *qee) handleMsg(mh msgAndHandler) {
 			glog.Fatalf("handler is nil for message %v", mh.msg)
 		}
 
-		b.enqueMsg(mh)
+		q.deliver(b, mh)
 		return
 	}
 
@@ -359,24 +429,17 @@ func (q *qee) handleMsg(mh msgAndHandler) {
 	}
 
 	if cells.LocalBroadcast() {
-		q.RLock()
-		defer q.RUnlock()
-		glog.V(2).Infof("%v sends a message to all local bees: %v", q, mh.msg)
-		for id, b := range q.bees {
-			if b.detached || b.proxy {
-				continue
-			}
-			if b.colony().Leader != id {
-				continue
-			}
-			b.enqueMsg(mh)
-		}
+		q.broadcastLocal(mh)
 		return
 	}
 
 	b, err := q.beeByCells(cells)
 	if err != nil {
 		if b, err = q.placeBee(cells); err != nil {
+			if err == ErrBeeQuota {
+				q.app.reject(mh, err)
+				return
+			}
 			glog.Fatalf("%v cannot place a new bee %v", q, err)
 		}
 
@@ -402,7 +465,7 @@ func (q *qee) handleMsg(mh msgAndHandler) {
 	}
 
 	glog.V(2).Infof("message sent to bee %v: %v", b, mh.msg)
-	b.enqueMsg(mh)
+	q.deliver(b, mh)
 }
 
 func (q *qee) placeBee(cells MappedCells) (*bee, error) {
@@ -456,7 +519,7 @@ fallback:
 }
 
 func (q *qee) lock(b BeeInfo, cells MappedCells) (BeeInfo, error) {
-	res, err := q.hive.node.Process(context.TODO(), lockMappedCell{
+	res, err := q.hive.processRaft(context.TODO(), lockMappedCell{
 		Colony: b.Colony,
 		App:    b.App,
 		Cells:  cells,
@@ -492,7 +555,7 @@ func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
 		// TODO(soheil): Should we check incosistencies?
 	}
 
-	b, ok := q.beeByID(info.ID)
+	b, ok := q.localBee(info.ID)
 	if ok {
 		return b, nil
 	}
@@ -518,7 +581,7 @@ func (q *qee) migrate(bid uint64, to uint64) (newb uint64, err error) {
 	var r interface{}
 	var c cmd
 
-	oldb, ok := q.beeByID(bid)
+	oldb, ok := q.localBee(bid)
 	if !ok {
 		return Nil, fmt.Errorf("%v cannot find %v", q, bid)
 	}
@@ -589,7 +652,7 @@ func (q *qee) defaultLocalBee(id uint64) *bee {
 		hive:      q.hive,
 		app:       q.app,
 		peers:     make(map[uint64]*proxy),
-		batchSize: q.hive.config.BatchSize,
+		batchSize: q.hive.batchSize(),
 	}
 }
 
@@ -0,0 +1,230 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// Quota limits the resources used by an application. Zero values mean no
+// limit.
+type Quota struct {
+	// MaxBeesPerHive is the maximum number of bees of the application on each
+	// hive.
+	MaxBeesPerHive int `json:"max_bees_per_hive,omitempty"`
+	// MaxBees is the maximum number of bees of the application in the cluster.
+	MaxBees int `json:"max_bees,omitempty"`
+	// MaxStateBytes is the maximum size of the keys and values stored in the
+	// dictionaries of each bee. Transactions that exceed the limit are aborted.
+	// It is only enforced for transactional applications.
+	MaxStateBytes int `json:"max_state_bytes,omitempty"`
+	// MaxQueuedMsgs is the maximum number of messages queued for each bee.
+	MaxQueuedMsgs int `json:"max_queued_msgs,omitempty"`
+	// DeadLetter, if set, emits the messages rejected because of this quota as
+	// DeadLetter messages. Otherwise, they are dropped.
+	DeadLetter bool `json:"dead_letter,omitempty"`
+}
+
+// AppWithQuota is an application option that limits the resources used by the
+// application. Messages that would violate the quota are rejected, and the
+// violations are reported by the hive (see "/api/v1/quotas").
+func AppWithQuota(q Quota) AppOption {
+	return func(a *app) {
+		a.quota = q
+	}
+}
+
+var (
+	ErrBeeQuota   = errors.New("bee quota exceeded")
+	ErrStateQuota = errors.New("state quota exceeded")
+	ErrQueueQuota = errors.New("queue quota exceeded")
+)
+
+// DeadLetter is emitted for a message that is rejected because of the quota
+// of an application. Applications can handle DeadLetter to log, store or
+// retry the rejected messages.
+type DeadLetter struct {
+	App    string      // The application that rejected the message.
+	Reason string      // Why the message is rejected.
+	Data   interface{} // The data of the rejected message.
+	From   uint64      // The sender of the rejected message.
+}
+
+// QuotaViolations is the number of messages rejected because of each limit
+// of a quota.
+type QuotaViolations struct {
+	Bees       uint64 `json:"bees"`
+	StateBytes uint64 `json:"state_bytes"`
+	QueuedMsgs uint64 `json:"queued_msgs"`
+}
+
+func (v *QuotaViolations) inc(err error) {
+	switch err {
+	case ErrBeeQuota:
+		atomic.AddUint64(&v.Bees, 1)
+	case ErrStateQuota:
+		atomic.AddUint64(&v.StateBytes, 1)
+	case ErrQueueQuota:
+		atomic.AddUint64(&v.QueuedMsgs, 1)
+	}
+}
+
+func (v *QuotaViolations) get() QuotaViolations {
+	return QuotaViolations{
+		Bees:       atomic.LoadUint64(&v.Bees),
+		StateBytes: atomic.LoadUint64(&v.StateBytes),
+		QueuedMsgs: atomic.LoadUint64(&v.QueuedMsgs),
+	}
+}
+
+// reject drops mh because of err, or emits it as a dead letter if the quota of
+// the application says so.
+func (a *app) reject(mh msgAndHandler, err error) {
+	a.violations.inc(err)
+	glog.Warningf("%v rejects message %v: %v", a, mh.msg, err)
+
+	if !a.quota.DeadLetter {
+		return
+	}
+	if _, ok := mh.msg.Data().(DeadLetter); ok {
+		// Never dead letter a dead letter.
+		return
+	}
+	a.hive.Emit(DeadLetter{
+		App:    a.Name(),
+		Reason: err.Error(),
+		Data:   mh.msg.Data(),
+		From:   mh.msg.From(),
+	})
+}
+
+// checkBeeQuota returns ErrBeeQuota if the qee cannot create a new bee.
+func (q *qee) checkBeeQuota() error {
+	quota := q.app.quota
+	if quota.MaxBeesPerHive > 0 && q.numLocalBees() >= quota.MaxBeesPerHive {
+		return ErrBeeQuota
+	}
+
+	if quota.MaxBees > 0 {
+		n := 0
+		for _, b := range q.hive.registry.bees() {
+			if b.App == q.app.Name() && !b.Detached {
+				n++
+			}
+		}
+		if n >= quota.MaxBees {
+			return ErrBeeQuota
+		}
+	}
+	return nil
+}
+
+// numLocalBees returns the number of local bees that are neither detached nor
+// proxies.
+func (q *qee) numLocalBees() int {
+	q.RLock()
+	defer q.RUnlock()
+
+	n := 0
+	for _, b := range q.bees {
+		if !b.detached && !b.proxy {
+			n++
+		}
+	}
+	return n
+}
+
+// deliver enqueues mh for b, unless b has reached the maximum number of
+// queued messages.
+func (q *qee) deliver(b *bee, mh msgAndHandler) {
+	max := int64(q.app.quota.MaxQueuedMsgs)
+	if max > 0 && !b.detached && !b.proxy && b.queuedMsgs() >= max {
+		q.app.reject(mh, ErrQueueQuota)
+		return
+	}
+	b.enqueMsg(mh)
+}
+
+// checkStateQuota returns ErrStateQuota if the open transaction of the bee
+// exceeds the maximum state size of its application.
+func (b *bee) checkStateQuota() error {
+	max := b.app.quota.MaxStateBytes
+	if max <= 0 || b.detached {
+		return nil
+	}
+	dicts, _ := b.currentState()
+	if dicts.TxStatus() != state.TxOpen || userStateSize(dicts) <= max {
+		return nil
+	}
+	return ErrStateQuota
+}
+
+// internalDict returns whether dict is internal to beehive. Internal
+// dictionaries are not published in change feeds, are not accounted for in
+// state quotas, and are neither exported nor imported.
+func internalDict(dict string) bool {
+	return strings.HasPrefix(dict, "__")
+}
+
+// userStateSize returns the size of the dictionaries in dicts that are not
+// internal to beehive.
+func userStateSize(dicts *state.Transactional) int {
+	size := dicts.Size()
+	for _, n := range dicts.DictNames() {
+		if internalDict(n) {
+			size -= dicts.DictSize(n)
+		}
+	}
+	return size
+}
+
+func (b *bee) queuedMsgs() int64 {
+	return atomic.LoadInt64(&b.queued)
+}
+
+// appQuota is the JSON representation of the quota of an application on a
+// hive.
+type appQuota struct {
+	App        string          `json:"app"`
+	Quota      Quota           `json:"quota"`
+	Bees       int             `json:"bees"`
+	Violations QuotaViolations `json:"violations"`
+}
+
+type appQuotasByName []appQuota
+
+func (s appQuotasByName) Len() int           { return len(s) }
+func (s appQuotasByName) Less(i, j int) bool { return s[i].App < s[j].App }
+func (s appQuotasByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (h *v1Handler) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	quotas := make([]appQuota, 0, len(h.srv.hive.apps))
+	for _, a := range h.srv.hive.apps {
+		quotas = append(quotas, appQuota{
+			App:        a.Name(),
+			Quota:      a.quota,
+			Bees:       a.qee.numLocalBees(),
+			Violations: a.violations.get(),
+		})
+	}
+	sort.Sort(appQuotasByName(quotas))
+
+	j, err := json.Marshal(quotas)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func init() {
+	gob.Register(DeadLetter{})
+}
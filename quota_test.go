@@ -0,0 +1,84 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type quotaTestMsg struct {
+	Key  string
+	Size int
+}
+
+func TestAppQuota(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_quota"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	quota := Quota{
+		MaxBeesPerHive: 1,
+		MaxStateBytes:  16,
+		DeadLetter:     true,
+	}
+	a := h.NewApp("quota", Transactional(), AppWithQuota(quota))
+	rcvd := make(chan quotaTestMsg)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", msg.Data().(quotaTestMsg).Key}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		m := msg.Data().(quotaTestMsg)
+		ctx.Dict("D").Put(m.Key, make([]byte, m.Size))
+		rcvd <- m
+		return nil
+	}
+	a.HandleFunc(quotaTestMsg{}, mf, rf)
+
+	dead := make(chan DeadLetter)
+	dl := h.NewApp("deadletter")
+	dl.HandleFunc(DeadLetter{}, func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		dead <- msg.Data().(DeadLetter)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	expectDead := func(m quotaTestMsg, reason error) {
+		select {
+		case d := <-dead:
+			if d.App != "quota" || d.Reason != reason.Error() || d.Data != m {
+				t.Errorf("invalid dead letter: %+v", d)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no dead letter for %v", m)
+		}
+	}
+
+	m1 := quotaTestMsg{Key: "a", Size: 1}
+	h.Emit(m1)
+	if m := <-rcvd; m != m1 {
+		t.Fatalf("invalid message: actual=%v want=%v", m, m1)
+	}
+
+	// A new cell needs a new bee, and the hive already has one.
+	m2 := quotaTestMsg{Key: "b", Size: 1}
+	h.Emit(m2)
+	expectDead(m2, ErrBeeQuota)
+
+	// The transaction would exceed the state quota and is aborted.
+	m3 := quotaTestMsg{Key: "a", Size: 64}
+	h.Emit(m3)
+	<-rcvd
+	expectDead(m3, ErrStateQuota)
+
+	v := a.(*app).violations.get()
+	if v.Bees != 1 || v.StateBytes != 1 || v.QueuedMsgs != 0 {
+		t.Errorf("invalid violations: %+v", v)
+	}
+}
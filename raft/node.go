@@ -7,6 +7,8 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/pkg/pbutil"
@@ -23,7 +25,9 @@ import (
 // Most of this code is adapted from etcd/etcdserver/server.go.
 
 var (
-	ErrStopped = errors.New("node stopped")
+	ErrStopped     = errors.New("node stopped")
+	ErrNotLeader   = errors.New("node is not the leader")
+	ErrNoReadIndex = errors.New("leader has not committed in its term")
 )
 
 type SendFunc func(m []raftpb.Message)
@@ -55,6 +59,27 @@ func (i NodeInfo) MustEncode() []byte {
 type Node struct {
 	name string
 	id   uint64
+	lead uint64 // the current leader, accessed atomically.
+
+	// applied and commit are the applied and the committed indexes, accessed
+	// atomically.
+	applied uint64
+	commit  uint64
+	// leaderContact is when the node last received a message from the leader
+	// in unix nanoseconds, accessed atomically.
+	leaderContact int64
+	// term is the current term of the node, accessed atomically.
+	term uint64
+	// beat is the last heartbeat sent by the leader, accessed atomically. The
+	// followers acknowledge heartbeats, which confirms the leadership of the
+	// node for the read index.
+	beat uint64
+
+	readM  sync.Mutex
+	voters map[uint64]bool
+	acks   map[uint64]uint64 // the last heartbeat acknowledged by each voter.
+	ackCh  chan struct{}     // closed when a heartbeat is acknowledged.
+
 	node etcdraft.Node
 	line line
 	gen  gen.IDGenerator
@@ -63,7 +88,12 @@ type Node struct {
 	store       Store
 	raftStorage *etcdraft.MemoryStorage
 	storage     Storage
-	snapCount   uint64
+	snapCfg     SnapshotConfig
+	snapdir     string
+	waldir      string
+
+	snapM     sync.Mutex
+	snapStats SnapshotStats
 
 	send SendFunc
 
@@ -80,7 +110,7 @@ func init() {
 }
 
 func NewNode(name string, id uint64, peers []etcdraft.Peer, send SendFunc,
-	listener StatusListener, datadir string, store Store, snapCount uint64,
+	listener StatusListener, datadir string, store Store, snapCfg SnapshotConfig,
 	ticker <-chan time.Time, election, heartbeat int) *Node {
 
 	glog.V(2).Infof("creating a new raft node %v (%v) with peers %v", id, name,
@@ -120,9 +150,14 @@ func NewNode(name string, id uint64, peers []etcdraft.Peer, send SendFunc,
 		}
 
 		if snapshot != nil {
-			if err := store.Restore(snapshot.Data); err != nil {
+			d, err := decompressSnap(snapshot.Data)
+			if err != nil {
+				glog.Fatalf("cannot decompress snapshot: %v", err)
+			}
+			if err := store.Restore(d); err != nil {
 				glog.Fatalf("cannot restore snapshot: %v", err)
 			}
+			restoreMembers(store, snapshot.Metadata.ConfState.Nodes)
 			glog.Infof("restarting from snapshot at index %d",
 				snapshot.Metadata.Index)
 			index = snapshot.Metadata.Index
@@ -156,18 +191,24 @@ func NewNode(name string, id uint64, peers []etcdraft.Peer, send SendFunc,
 		lastIndex = ents[len(ents)-1].Index
 	}
 
+	firstID := lastIndex + 2*snapCfg.count() // avoid collisions.
 	node := &Node{
 		name:        name,
 		id:          id,
 		node:        n,
-		gen:         gen.NewSeqIDGen(lastIndex + 2*snapCount), // avoid collisions.
+		gen:         gen.NewSeqIDGen(firstID),
 		listener:    listener,
 		store:       store,
 		raftStorage: s,
 		storage:     NewStorage(w, ss),
-		snapCount:   snapCount,
+		snapCfg:     snapCfg,
+		snapdir:     snapdir,
+		waldir:      waldir,
 		send:        send,
 		ticker:      ticker,
+		voters:      make(map[uint64]bool),
+		acks:        make(map[uint64]uint64),
+		ackCh:       make(chan struct{}),
 		done:        make(chan struct{}),
 		stop:        make(chan struct{}),
 	}
@@ -276,6 +317,8 @@ func (n *Node) applyEntry(e raftpb.Entry) {
 		ID: req.ID,
 	}
 	res.Data, res.Err = n.store.Apply(req.Data)
+	// The entry must be marked as applied before the proposer is notified.
+	atomic.StoreUint64(&n.applied, e.Index)
 	n.line.call(res)
 }
 
@@ -324,6 +367,7 @@ func (n *Node) applyConfChange(e raftpb.Entry, confs *raftpb.ConfState) error {
 	}
 
 	*confs = *n.node.ApplyConfChange(cc)
+	n.setVoters(confs.Nodes)
 	if len(cc.Context) == 0 {
 		n.store.ApplyConfChange(cc, NodeInfo{})
 		return nil
@@ -361,10 +405,13 @@ func (n *Node) Start() {
 
 	snapi := snap.Metadata.Index
 	appliedi := snap.Metadata.Index
+	atomic.StoreUint64(&n.applied, appliedi)
 	confState := snap.Metadata.ConfState
+	n.setVoters(confState.Nodes)
 
 	var prevss *etcdraft.SoftState
 	var shouldStop bool
+	var snapb uint64 // bytes of the entries applied since the last snapshot.
 
 	defer func() {
 		n.node.Stop()
@@ -374,6 +421,9 @@ func (n *Node) Start() {
 		close(n.done)
 	}()
 
+	n.purgeFiles(n.snapdir, ".snap", n.snapCfg.maxSnapFiles())
+	n.purgeFiles(n.waldir, ".wal", n.snapCfg.maxWALFiles())
+
 	ready := n.node.Ready()
 	adv := make(chan struct{})
 	for {
@@ -389,6 +439,7 @@ func (n *Node) Start() {
 			ready = nil
 			go func(rd etcdraft.Ready) {
 				if rd.SoftState != nil {
+					atomic.StoreUint64(&n.lead, rd.SoftState.Lead)
 					if prevss != nil && prevss.Lead != rd.SoftState.Lead {
 						n.listener.ProcessStatusChange(LeaderChanged{
 							Old: prevss.Lead,
@@ -410,20 +461,28 @@ func (n *Node) Start() {
 					glog.Infof("saved incoming snapshot at index %d", snapi)
 				}
 
+				if !etcdraft.IsEmptyHardState(rd.HardState) {
+					atomic.StoreUint64(&n.commit, rd.HardState.Commit)
+					atomic.StoreUint64(&n.term, rd.HardState.Term)
+				}
 				if err := n.storage.Save(rd.HardState, rd.Entries); err != nil {
 					glog.Fatalf("err in raft storage save: %v", err)
 				}
 				n.raftStorage.Append(rd.Entries)
 
+				n.stampHeartbeats(rd.Messages)
 				n.send(rd.Messages)
 
 				// Recover from snapshot if it is more recent than the currently applied.
 				if !empty && rd.Snapshot.Metadata.Index > appliedi {
-					if err := n.store.Restore(rd.Snapshot.Data); err != nil {
+					if err := n.restoreStore(rd.Snapshot.Data); err != nil {
 						glog.Fatalf("error in store recovery: %v", err)
 					}
+					restoreMembers(n.store, rd.Snapshot.Metadata.ConfState.Nodes)
+					n.setVoters(rd.Snapshot.Metadata.ConfState.Nodes)
 					// FIXME(soheil): update the nodes and notify the application?
 					appliedi = rd.Snapshot.Metadata.Index
+					atomic.StoreUint64(&n.applied, appliedi)
 					glog.Infof("recovered from incoming snapshot at index %d", snapi)
 				}
 
@@ -440,6 +499,9 @@ func (n *Node) Start() {
 						ents = rd.CommittedEntries[appliedi+1-firsti:]
 					}
 					if len(ents) > 0 {
+						for _, e := range ents {
+							snapb += uint64(len(e.Data))
+						}
 						if appliedi, shouldStop = n.apply(ents, &confState); shouldStop {
 							n.Stop()
 							return
@@ -447,11 +509,13 @@ func (n *Node) Start() {
 					}
 				}
 
-				if appliedi-snapi > n.snapCount {
-					glog.Infof("start to snapshot (applied: %d, lastsnap: %d)", appliedi,
-						snapi)
+				if appliedi-snapi > n.snapCfg.count() ||
+					(n.snapCfg.Bytes > 0 && snapb > n.snapCfg.Bytes) {
+					glog.Infof("start to snapshot (applied: %d, lastsnap: %d, bytes: %d)",
+						appliedi, snapi, snapb)
 					n.snapshot(appliedi, &confState)
 					snapi = appliedi
+					snapb = 0
 				}
 
 				select {
@@ -481,15 +545,22 @@ func (n *Node) apply(es []raftpb.Entry, confState *raftpb.ConfState) (
 			glog.Fatalf("unexpected entry type")
 		}
 		appliedi = e.Index
+		atomic.StoreUint64(&n.applied, appliedi)
 	}
 	return
 }
 
 func (n *Node) snapshot(snapi uint64, confs *raftpb.ConfState) {
+	start := time.Now()
 	d, err := n.store.Save()
 	if err != nil {
 		glog.Fatalf("error in store save: %v", err)
 	}
+	if n.snapCfg.Compress {
+		if d, err = compressSnap(d); err != nil {
+			glog.Fatalf("error in snapshot compression: %v", err)
+		}
+	}
 	err = n.raftStorage.Compact(snapi, confs, d)
 	if err != nil {
 		// the snapshot was done asynchronously with the progress of raft.
@@ -512,6 +583,15 @@ func (n *Node) snapshot(snapi uint64, confs *raftpb.ConfState) {
 		glog.Fatalf("errro in save snapshot: %v", err)
 	}
 	glog.Infof("saved snapshot at index %d", snap.Metadata.Index)
+
+	dur := time.Since(start)
+	n.snapM.Lock()
+	n.snapStats.Snapshots++
+	n.snapStats.Index = snap.Metadata.Index
+	n.snapStats.Size = len(d)
+	n.snapStats.Duration = dur
+	n.snapStats.TotalTime += dur
+	n.snapM.Unlock()
 }
 
 func (n *Node) String() string {
@@ -526,10 +606,148 @@ func (n *Node) Stop() {
 	<-n.done
 }
 
+// Leader returns the ID of the current leader of the raft group, or 0 if the
+// leader is not known.
+func (n *Node) Leader() uint64 {
+	return atomic.LoadUint64(&n.lead)
+}
+
+// Applied returns the index of the last raft entry applied on the store.
+func (n *Node) Applied() uint64 {
+	return atomic.LoadUint64(&n.applied)
+}
+
+// Committed returns the index of the last raft entry known to be committed.
+// On followers, it is the commit index last reported by the leader.
+func (n *Node) Committed() uint64 {
+	return atomic.LoadUint64(&n.commit)
+}
+
 func (n *Node) Campaign(ctx context.Context) error {
 	return n.node.Campaign(ctx)
 }
 
 func (n *Node) Step(ctx context.Context, msg raftpb.Message) error {
-	return n.node.Step(ctx, msg)
+	if msg.Type == raftpb.MsgHeartbeat && msg.Reject {
+		// Followers acknowledge heartbeats by sending them back rejected, which
+		// raft never does.
+		n.ackHeartbeat(msg)
+		return nil
+	}
+
+	switch msg.Type {
+	case raftpb.MsgApp, raftpb.MsgHeartbeat, raftpb.MsgSnap:
+		// Only the leader sends these messages.
+		atomic.StoreInt64(&n.leaderContact, time.Now().UnixNano())
+	}
+	if err := n.node.Step(ctx, msg); err != nil {
+		return err
+	}
+
+	if msg.Type == raftpb.MsgHeartbeat {
+		n.send([]raftpb.Message{{
+			Type:   raftpb.MsgHeartbeat,
+			To:     msg.From,
+			From:   n.id,
+			Term:   msg.Term,
+			Index:  msg.Index,
+			Reject: true,
+		}})
+	}
+	return nil
+}
+
+// SinceLeaderContact returns how long ago the node last received a message
+// from the leader of the raft group. It is the time since the unix epoch if the
+// node has never heard from a leader.
+func (n *Node) SinceLeaderContact() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&n.leaderContact)))
+}
+
+// ReadIndex returns the commit index of the leader, once a quorum of the
+// raft group acknowledges a heartbeat sent after ReadIndex is called. This
+// confirms that the node is still the leader without appending entries to the
+// raft log, and the entries committed before the call are all included in the
+// returned index.
+func (n *Node) ReadIndex(ctx context.Context) (uint64, error) {
+	term := atomic.LoadUint64(&n.term)
+	commit := n.Committed()
+	beat := atomic.LoadUint64(&n.beat)
+	if n.Leader() != n.id {
+		return 0, ErrNotLeader
+	}
+	// A new leader may not know all the committed entries until it commits an
+	// entry in its own term.
+	if t, err := n.raftStorage.Term(commit); err != nil || t != term {
+		return 0, ErrNoReadIndex
+	}
+
+	for {
+		n.readM.Lock()
+		acks := 0
+		for id := range n.voters {
+			if id == n.id || n.acks[id] > beat {
+				acks++
+			}
+		}
+		quorum := len(n.voters)/2 + 1
+		ackCh := n.ackCh
+		n.readM.Unlock()
+
+		if acks >= quorum {
+			break
+		}
+
+		select {
+		case <-ackCh:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-n.done:
+			return 0, ErrStopped
+		}
+	}
+
+	if n.Leader() != n.id || atomic.LoadUint64(&n.term) != term {
+		return 0, ErrNotLeader
+	}
+	return commit, nil
+}
+
+// stampHeartbeats stamps the heartbeats in msgs with a new beat, which is
+// sent back by the followers when they acknowledge the heartbeats.
+func (n *Node) stampHeartbeats(msgs []raftpb.Message) {
+	var beat uint64
+	for i := range msgs {
+		if msgs[i].Type != raftpb.MsgHeartbeat {
+			continue
+		}
+		if beat == 0 {
+			beat = atomic.AddUint64(&n.beat, 1)
+		}
+		msgs[i].Index = beat
+	}
+}
+
+func (n *Node) ackHeartbeat(msg raftpb.Message) {
+	if msg.Term != atomic.LoadUint64(&n.term) {
+		return
+	}
+
+	n.readM.Lock()
+	defer n.readM.Unlock()
+	if msg.Index <= n.acks[msg.From] {
+		return
+	}
+	n.acks[msg.From] = msg.Index
+	close(n.ackCh)
+	n.ackCh = make(chan struct{})
+}
+
+func (n *Node) setVoters(nodes []uint64) {
+	n.readM.Lock()
+	defer n.readM.Unlock()
+	n.voters = make(map[uint64]bool, len(nodes))
+	for _, id := range nodes {
+		n.voters[id] = true
+	}
 }
@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/pkg/fileutil"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/snap"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/wal"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// DefaultSnapCount is the default number of entries applied between two
+// snapshots.
+const DefaultSnapCount = 1024
+
+// DefaultMaxSnapFiles and DefaultMaxWALFiles are the default numbers of
+// snapshot and WAL files kept on disk.
+const (
+	DefaultMaxSnapFiles = 5
+	DefaultMaxWALFiles  = 5
+)
+
+// purgeInterval is how often old snapshot and WAL files are purged.
+const purgeInterval = 30 * time.Second
+
+// SnapshotConfig configures when a node snapshots its store, and how many
+// snapshot and WAL files it keeps on disk.
+type SnapshotConfig struct {
+	// Count is the number of entries applied between two snapshots. Zero means
+	// DefaultSnapCount.
+	Count uint64 `json:"count,omitempty"`
+	// Bytes, if positive, also snapshots the store once the entries applied
+	// since the last snapshot exceed Bytes.
+	Bytes uint64 `json:"bytes,omitempty"`
+	// MaxSnapFiles is the number of snapshot files kept. Zero means
+	// DefaultMaxSnapFiles.
+	MaxSnapFiles uint `json:"max_snap_files,omitempty"`
+	// MaxWALFiles is the number of WAL files kept. Zero means
+	// DefaultMaxWALFiles. WAL files that are not covered by a snapshot are never
+	// removed.
+	MaxWALFiles uint `json:"max_wal_files,omitempty"`
+	// Compress compresses the snapshots of the store using gzip.
+	Compress bool `json:"compress,omitempty"`
+}
+
+func (c SnapshotConfig) count() uint64 {
+	if c.Count == 0 {
+		return DefaultSnapCount
+	}
+	return c.Count
+}
+
+func (c SnapshotConfig) maxSnapFiles() uint {
+	if c.MaxSnapFiles == 0 {
+		return DefaultMaxSnapFiles
+	}
+	return c.MaxSnapFiles
+}
+
+func (c SnapshotConfig) maxWALFiles() uint {
+	if c.MaxWALFiles == 0 {
+		return DefaultMaxWALFiles
+	}
+	return c.MaxWALFiles
+}
+
+// SnapshotStats reports the snapshots taken by a node.
+type SnapshotStats struct {
+	Snapshots uint64        `json:"snapshots"` // number of snapshots taken.
+	Index     uint64        `json:"index"`     // index of the last snapshot.
+	Size      int           `json:"size"`      // bytes of the last snapshot.
+	Duration  time.Duration `json:"duration"`  // duration of the last snapshot.
+	TotalTime time.Duration `json:"total_time"`
+}
+
+// compressedSnapPrefix prefixes compressed snapshots of the store. It never
+// prefixes a gob stream, since a gob message cannot have a length of zero.
+var compressedSnapPrefix = []byte("\x00gz")
+
+func compressSnap(d []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(compressedSnapPrefix)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(d); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressSnap returns the store data of snapshot d, which may or may not be
+// compressed.
+func decompressSnap(d []byte) ([]byte, error) {
+	if !bytes.HasPrefix(d, compressedSnapPrefix) {
+		return d, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(d[len(compressedSnapPrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// restoreStore restores the store of the node from snapshot data d.
+func (n *Node) restoreStore(d []byte) error {
+	d, err := decompressSnap(d)
+	if err != nil {
+		return err
+	}
+	return n.store.Restore(d)
+}
+
+// ReadStore reads the store of the stopped node whose data is in datadir,
+// without modifying datadir. It returns the store data of the latest snapshot,
+// if any, and the requests of the entries after the snapshot. It returns no
+// data if there is no node in datadir.
+func ReadStore(datadir string) (d []byte, reqs []interface{}, err error) {
+	waldir := path.Join(datadir, "wal")
+	if !wal.Exist(waldir) {
+		return nil, nil, nil
+	}
+
+	var index uint64
+	snapshot, err := snap.New(path.Join(datadir, "snap")).Load()
+	switch {
+	case err == nil:
+		if d, err = decompressSnap(snapshot.Data); err != nil {
+			return nil, nil, err
+		}
+		index = snapshot.Metadata.Index
+	case err != snap.ErrNoSnapshot:
+		return nil, nil, err
+	}
+
+	w, err := wal.Open(waldir, index+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range ents {
+		if e.Type != raftpb.EntryNormal || len(e.Data) == 0 {
+			continue
+		}
+		var req Request
+		if err := req.Decode(e.Data); err != nil {
+			return nil, nil, err
+		}
+		if req.Data != nil {
+			reqs = append(reqs, req.Data)
+		}
+	}
+	return d, reqs, nil
+}
+
+// purgeFiles removes the old files with suffix in dir, keeping max files,
+// until the node is stopped.
+func (n *Node) purgeFiles(dir, suffix string, max uint) {
+	errc := fileutil.PurgeFile(dir, suffix, max, purgeInterval, n.done)
+	go func() {
+		select {
+		case err := <-errc:
+			glog.Errorf("%v cannot purge %v files: %v", n, suffix, err)
+		case <-n.done:
+		}
+	}()
+}
+
+// SnapshotStats returns the statistics of the snapshots taken by the node.
+func (n *Node) SnapshotStats() SnapshotStats {
+	n.snapM.Lock()
+	defer n.snapM.Unlock()
+	return n.snapStats
+}
@@ -0,0 +1,27 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressSnap(t *testing.T) {
+	d := bytes.Repeat([]byte("beehive"), 1024)
+	c, err := compressSnap(d)
+	if err != nil {
+		t.Fatalf("cannot compress snapshot: %v", err)
+	}
+	if len(c) >= len(d) {
+		t.Errorf("snapshot is not compressed: %v >= %v", len(c), len(d))
+	}
+
+	for _, s := range [][]byte{c, d} {
+		u, err := decompressSnap(s)
+		if err != nil {
+			t.Fatalf("cannot decompress snapshot: %v", err)
+		}
+		if !bytes.Equal(u, d) {
+			t.Error("invalid decompressed snapshot")
+		}
+	}
+}
@@ -19,3 +19,16 @@ type Store interface {
 	// ApplyConfChange processes a configuration change.
 	ApplyConfChange(cc raftpb.ConfChange, n NodeInfo) error
 }
+
+// MemberStore is a store that tracks the nodes of the raft group. Once a
+// snapshot is restored, it is notified of the nodes in the snapshot.
+type MemberStore interface {
+	// RestoreMembers is called with the nodes of a restored snapshot.
+	RestoreMembers(nodes []uint64)
+}
+
+func restoreMembers(s Store, nodes []uint64) {
+	if m, ok := s.(MemberStore); ok {
+		m.RestoreMembers(nodes)
+	}
+}
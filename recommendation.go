@@ -0,0 +1,281 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	bhgob "github.com/kandoo/beehive/gob"
+	"github.com/kandoo/beehive/state"
+)
+
+// When HiveConfig.OptimizeDryRun is set, the optimizer does not migrate bees.
+// Instead, it records its decisions as recommendations that are approved or
+// rejected by an operator through the recommendations endpoint of the
+// collector app.
+
+const (
+	dictOptimizerRecs = "OptimizerRecDict"
+
+	// maxRecommendations is the maximum number of recommendations kept by the
+	// optimizer. The oldest decided recommendations are removed first.
+	maxRecommendations = 256
+)
+
+const (
+	recPending  = "pending"
+	recApproved = "approved"
+	recRejected = "rejected"
+)
+
+// recommendation is a migration decided by the optimizer in the dry-run mode.
+type recommendation struct {
+	ID        uint64
+	Migration Migration
+	From      uint64
+	Status    string
+	Time      time.Time
+}
+
+type recommendationsByID []recommendation
+
+func (s recommendationsByID) Len() int           { return len(s) }
+func (s recommendationsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s recommendationsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func getRecommendations(dict state.Dict) []recommendation {
+	var recs []recommendation
+	dict.ForEach(func(k string, v []byte) {
+		var r recommendation
+		if err := bhgob.Decode(&r, v); err != nil {
+			glog.Errorf("cannot decode recommendation: %v", err)
+			return
+		}
+		recs = append(recs, r)
+	})
+	sort.Sort(recommendationsByID(recs))
+	return recs
+}
+
+// recommend records migration m of a bee that is on hive from. If there is a
+// pending recommendation for the bee, it is replaced with m.
+func recommend(dict state.Dict, m Migration, from uint64) error {
+	recs := getRecommendations(dict)
+	for _, r := range recs {
+		if r.Status != recPending || r.Migration.Bee != m.Bee {
+			continue
+		}
+		r.Migration = m
+		r.From = from
+		r.Time = time.Now()
+		return dict.PutGob(formatBeeID(r.ID), &r)
+	}
+
+	id := uint64(1)
+	if len(recs) != 0 {
+		id = recs[len(recs)-1].ID + 1
+	}
+
+	// Remove the oldest decided recommendations, and if they are not enough,
+	// the oldest pending ones.
+	n := len(recs) - maxRecommendations + 1
+	for _, pending := range []bool{false, true} {
+		for _, r := range recs {
+			if n <= 0 {
+				break
+			}
+			if (r.Status == recPending) != pending {
+				continue
+			}
+			dict.Del(formatBeeID(r.ID))
+			n--
+		}
+	}
+
+	r := recommendation{
+		ID:        id,
+		Migration: m,
+		From:      from,
+		Status:    recPending,
+		Time:      time.Now(),
+	}
+	return dict.PutGob(formatBeeID(id), &r)
+}
+
+type recommendationsRequest struct{}
+
+type recommendationsResponse struct {
+	Recs []recommendation
+}
+
+type recommendationDecision struct {
+	ID      uint64
+	Approve bool
+}
+
+type recommendationsHandler struct{}
+
+func (h recommendationsHandler) Rcv(msg Msg, ctx RcvContext) error {
+	dict := ctx.Dict(dictOptimizerRecs)
+	d, ok := msg.Data().(recommendationDecision)
+	if !ok {
+		return ctx.ReplyTo(msg, recommendationsResponse{
+			Recs: getRecommendations(dict),
+		})
+	}
+
+	k := formatBeeID(d.ID)
+	var r recommendation
+	if err := dict.GetGob(k, &r); err != nil {
+		return fmt.Errorf("no such recommendation: %v", d.ID)
+	}
+	if r.Status != recPending {
+		return fmt.Errorf("recommendation %v is already %v", d.ID, r.Status)
+	}
+
+	if !d.Approve {
+		r.Status = recRejected
+	} else {
+		if err := approve(r, ctx); err != nil {
+			return err
+		}
+		r.Status = recApproved
+	}
+	if err := dict.PutGob(k, &r); err != nil {
+		return err
+	}
+	return ctx.ReplyTo(msg, r)
+}
+
+func (h recommendationsHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return optimizerCentrlizedCells
+}
+
+// approve starts the migration recommended in r.
+func approve(r recommendation, ctx RcvContext) error {
+	m := r.Migration
+	bi, err := beeInfoFromContext(ctx, m.Bee)
+	if err != nil {
+		return fmt.Errorf("cannot find bee %v", m.Bee)
+	}
+	if bi.Hive != r.From {
+		return fmt.Errorf("bee %v has moved to hive %v", m.Bee, bi.Hive)
+	}
+	if _, err := ctx.Hive().(*hive).registry.hive(m.To); err != nil {
+		return fmt.Errorf("cannot find hive %v", m.To)
+	}
+
+	ms := newMigrations(ctx)
+	if ms.stats[m.Bee].migrating() {
+		return fmt.Errorf("bee %v is already being migrated", m.Bee)
+	}
+
+	glog.Infof("%v approves migration of bee %v to hive %v", ctx, m.Bee, m.To)
+	if err := ms.start(m.Bee, m.To); err != nil {
+		return err
+	}
+	ms.dispatch()
+	return nil
+}
+
+// jsonRecommendation is the JSON representation of a recommendation.
+type jsonRecommendation struct {
+	ID      uint64            `json:"id"`
+	Bee     uint64            `json:"bee"`
+	From    uint64            `json:"from"`
+	To      uint64            `json:"to"`
+	Score   int               `json:"score"`
+	Traffic map[string]uint64 `json:"traffic"`
+	Reason  string            `json:"reason"`
+	Status  string            `json:"status"`
+	Time    time.Time         `json:"time"`
+}
+
+func newJSONRecommendation(r recommendation) jsonRecommendation {
+	jr := jsonRecommendation{
+		ID:      r.ID,
+		Bee:     r.Migration.Bee,
+		From:    r.From,
+		To:      r.Migration.To,
+		Score:   r.Migration.Score,
+		Traffic: make(map[string]uint64),
+		Reason:  r.Migration.Reason,
+		Status:  r.Status,
+		Time:    r.Time,
+	}
+	for h, cnt := range r.Migration.Traffic {
+		jr.Traffic[strconv.FormatUint(h, 10)] = cnt
+	}
+	return jr
+}
+
+// recommendationHttpHandler lists the recommendations on GET, and approves or
+// rejects a recommendation on POST to /recommendations/{id}/{approve|reject}.
+type recommendationHttpHandler struct {
+	sync *Sync
+}
+
+func (h *recommendationHttpHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+
+	var req interface{} = recommendationsRequest{}
+	if r.Method == "POST" {
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid recommendation id", http.StatusBadRequest)
+			return
+		}
+		d := recommendationDecision{ID: id}
+		switch vars["action"] {
+		case "approve":
+			d.Approve = true
+		case "reject":
+		default:
+			http.Error(w, "invalid action", http.StatusBadRequest)
+			return
+		}
+		req = d
+	}
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	res, err := h.sync.Process(ctx, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var jsonres interface{}
+	switch res := res.(type) {
+	case recommendationsResponse:
+		recs := make([]jsonRecommendation, 0, len(res.Recs))
+		for _, r := range res.Recs {
+			recs = append(recs, newJSONRecommendation(r))
+		}
+		jsonres = recs
+	case recommendation:
+		jsonres = newJSONRecommendation(res)
+	}
+	b, err := json.Marshal(jsonres)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func init() {
+	gob.Register(recommendation{})
+	gob.Register(recommendationDecision{})
+	gob.Register(recommendationsRequest{})
+	gob.Register(recommendationsResponse{})
+}
@@ -27,12 +27,21 @@ type noOp struct{}
 
 // newHiveID is the registry request to create a unique 64-bit hive ID.
 type newHiveID struct {
-	Addr string
+	Addr   string
+	Labels map[string]string
 }
 
 // newBeeID is the registry request to create a unique 64-bit bee ID.
 type newBeeID struct{}
 
+// updateHive is the registry request to update the address and the labels of a
+// hive.
+type updateHive HiveInfo
+
+// reviveHive is the registry request to mark a hive that was removed from the
+// raft group as dead as alive again.
+type reviveHive uint64
+
 // BeeInfo stores the metadata about a bee.
 type BeeInfo struct {
 	ID       uint64 `json:"id"`
@@ -74,6 +83,78 @@ type transferCells struct {
 	To   Colony
 }
 
+// releaseCells releases the cells of a bee, so that they can be locked by
+// other colonies.
+type releaseCells struct {
+	App string
+	Bee uint64
+}
+
+// newDistTxID is the registry request to create a unique 64-bit distributed
+// transaction ID.
+type newDistTxID struct{}
+
+// joinDistTx is the registry request to add a bee to the participants of a
+// distributed transaction. It returns false if the transaction is already
+// decided or forgotten.
+type joinDistTx struct {
+	ID  uint64
+	Bee uint64
+}
+
+// decideDistTx is the registry request to decide the outcome of a distributed
+// transaction. The first decision wins, and the request returns the decision
+// that is recorded in the registry. A transaction that is not in the registry
+// is aborted.
+type decideDistTx struct {
+	ID     uint64
+	Commit bool
+}
+
+// forgetDistTx is the registry request to remove Bees from the participants
+// of a distributed transaction once they have resolved it. The decision is
+// removed when all the participants have resolved the transaction.
+type forgetDistTx struct {
+	ID   uint64
+	Bees []uint64
+}
+
+// distTxInfo is the state of a distributed transaction in the registry.
+type distTxInfo struct {
+	Decided bool
+	Commit  bool
+	Bees    map[uint64]bool // participants that have not resolved the tx.
+}
+
+// registryUpdate is an update applied to the registry. It is either a request
+// or, if Conf is set, a config change of the registry's raft group.
+type registryUpdate struct {
+	Seq  uint64
+	Req  interface{}
+	Conf bool
+	CC   raftpb.ConfChange
+	Node raft.NodeInfo
+}
+
+// registryUpdates is the response to cmdRegistryUpdates. If Snapshot is set,
+// it must be restored before applying Updates.
+type registryUpdates struct {
+	Snapshot []byte
+	Updates  []registryUpdate
+}
+
+// registryResult is the response to cmdProcessRegistry. Seq is the sequence of
+// the registry after the request is applied.
+type registryResult struct {
+	Data interface{}
+	Err  error
+	Seq  uint64
+}
+
+// maxRegistryUpdates is the number of recent updates kept in the registry for
+// the observers. Observers that are further behind receive a snapshot.
+const maxRegistryUpdates = 1024
+
 type registry struct {
 	m    sync.RWMutex
 	name string
@@ -83,6 +164,21 @@ type registry struct {
 	Hives  map[uint64]HiveInfo
 	Bees   map[uint64]BeeInfo
 	Store  cellStore
+	Voters map[uint64]bool // hives in the raft group of the registry.
+	Dead   map[uint64]bool // hives removed from the raft group as dead.
+	Seq    uint64          // number of updates applied to the registry.
+	TxID   uint64
+	Txs    map[uint64]distTxInfo // distributed transactions in progress.
+
+	// updates are the most recent updates applied to the registry.
+	updates []registryUpdate
+	// skipUntil is the sequence until which updates are already reflected in
+	// the registry. It is set when an observer is promoted to a voter and
+	// replays the raft log.
+	skipUntil uint64
+
+	// hiveUpdated, if set, is called when the address of a hive changes.
+	hiveUpdated func(info HiveInfo)
 }
 
 func newRegistry(name string) *registry {
@@ -93,6 +189,9 @@ func newRegistry(name string) *registry {
 		Hives:  make(map[uint64]HiveInfo),
 		Bees:   make(map[uint64]BeeInfo),
 		Store:  newCellStore(),
+		Voters: make(map[uint64]bool),
+		Dead:   make(map[uint64]bool),
+		Txs:    make(map[uint64]distTxInfo),
 	}
 }
 
@@ -107,20 +206,79 @@ func (r *registry) Restore(b []byte) error {
 	r.m.Lock()
 	defer r.m.Unlock()
 	glog.V(2).Info("registry restored")
-	return bhgob.Decode(r, b)
+
+	// Decode into a fresh registry, since gob merges maps.
+	nr := newRegistry(r.name)
+	if err := bhgob.Decode(nr, b); err != nil {
+		return err
+	}
+	r.HiveID = nr.HiveID
+	r.BeeID = nr.BeeID
+	r.Hives = nr.Hives
+	r.Bees = nr.Bees
+	r.Store = nr.Store
+	r.Voters = nr.Voters
+	r.Dead = nr.Dead
+	r.Seq = nr.Seq
+	r.TxID = nr.TxID
+	r.Txs = nr.Txs
+	r.updates = nil
+	r.skipUntil = 0
+	return nil
+}
+
+// RestoreMembers seeds the voters of a registry restored from a snapshot that
+// has no voters (i.e., a snapshot taken before voters were tracked) with the
+// nodes of the raft group. Otherwise, the raft members would be mistaken for
+// observers and promoted, which wipes their raft state.
+func (r *registry) RestoreMembers(nodes []uint64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.Voters) != 0 {
+		return
+	}
+	glog.V(2).Infof("%v seeds its voters with raft nodes %v", r, nodes)
+	for _, n := range nodes {
+		r.Voters[n] = true
+	}
+}
+
+// next advances the sequence of the registry and records u as the update with
+// that sequence. It returns false if the update is already reflected in the
+// registry and must be skipped.
+func (r *registry) next(u registryUpdate) bool {
+	r.Seq++
+	u.Seq = r.Seq
+	if len(r.updates) == maxRegistryUpdates {
+		r.updates = append(r.updates[1:], u)
+	} else {
+		r.updates = append(r.updates, u)
+	}
+	return r.skipUntil < r.Seq
 }
 
 func (r *registry) Apply(req interface{}) (interface{}, error) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
+	if !r.next(registryUpdate{Req: req}) {
+		glog.V(2).Infof("%v skips request %v: %#v", r, r.Seq, req)
+		return nil, nil
+	}
+
 	switch tr := req.(type) {
 	case noOp:
 		return nil, nil
 	case newHiveID:
-		return r.newHiveID(tr.Addr), nil
+		return r.newHiveID(tr.Addr, tr.Labels), nil
 	case newBeeID:
 		return r.newBeeID(), nil
+	case updateHive:
+		return nil, r.updateHive(HiveInfo(tr))
+	case reviveHive:
+		delete(r.Dead, uint64(tr))
+		return nil, nil
 	case addBee:
 		return nil, r.addBee(BeeInfo(tr))
 	case delBee:
@@ -133,6 +291,17 @@ func (r *registry) Apply(req interface{}) (interface{}, error) {
 		return r.lock(tr)
 	case transferCells:
 		return nil, r.transfer(tr)
+	case releaseCells:
+		return nil, r.release(tr)
+	case newDistTxID:
+		return r.newDistTxID(), nil
+	case joinDistTx:
+		return r.joinDistTx(tr), nil
+	case decideDistTx:
+		return r.decideDistTx(tr), nil
+	case forgetDistTx:
+		r.forgetDistTx(tr)
+		return nil, nil
 	}
 
 	glog.Errorf("%v cannot handle %v", r, req)
@@ -146,6 +315,14 @@ func (r *registry) String() string {
 func (r *registry) ApplyConfChange(cc raftpb.ConfChange,
 	n raft.NodeInfo) error {
 
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if !r.next(registryUpdate{Conf: true, CC: cc, Node: n}) {
+		glog.V(2).Infof("%v skips conf change %v: %#v", r, r.Seq, cc)
+		return nil
+	}
+
 	glog.V(2).Infof("%v applies conf change %#v for %v", r, cc, n)
 	switch cc.Type {
 	case raftpb.ConfChangeAddNode:
@@ -153,21 +330,122 @@ func (r *registry) ApplyConfChange(cc raftpb.ConfChange,
 			glog.Fatalf("invalid data in the config change: %v != %v", n, cc.NodeID)
 		}
 		if n.Addr != "" {
-			r.addHive(HiveInfo(n))
+			// Keep the labels of the hive, if it is already added by newHiveID.
+			info := r.Hives[n.ID]
+			info.ID, info.Addr = n.ID, n.Addr
+			r.addHive(info)
 		}
-		glog.V(2).Infof("%v adds hive %v@%v", r, n.ID, n.Addr)
+		r.Voters[n.ID] = true
+		delete(r.Dead, n.ID)
+		glog.V(2).Infof("%v adds voter hive %v@%v", r, n.ID, n.Addr)
 
 	case raftpb.ConfChangeRemoveNode:
-		r.delHive(cc.NodeID)
-		glog.V(2).Infof("%v deletes hive %v", r, cc.NodeID)
+		// A voter is removed from the raft group only when it is dead or cannot
+		// be promoted. The hive remains in the registry, so that it can rejoin the
+		// cluster as an observer once revived, but is not listed by hives and
+		// thus is not assigned bees or followers.
+		delete(r.Voters, cc.NodeID)
+		r.Dead[cc.NodeID] = true
+		glog.V(2).Infof("%v removes dead voter hive %v", r, cc.NodeID)
+	}
+	return nil
+}
+
+// startReplay prepares the registry for replaying the raft log from the
+// beginning, when an observer is promoted to a voter. The updates that are
+// already applied to the registry are skipped during the replay.
+func (r *registry) startReplay() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.skipUntil = r.Seq
+	r.Seq = 0
+	r.updates = nil
+}
+
+// replaying returns whether the registry is replaying updates that are already
+// applied.
+func (r *registry) replaying() bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.Seq < r.skipUntil
+}
+
+func (r *registry) seq() uint64 {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.Seq
+}
+
+// updatesSince returns the updates applied after seq. If those updates are not
+// available, it returns a snapshot of the registry instead.
+func (r *registry) updatesSince(seq uint64) (registryUpdates, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if seq >= r.Seq || r.Seq <= r.skipUntil {
+		return registryUpdates{}, nil
+	}
+
+	if len(r.updates) != 0 && r.updates[0].Seq <= seq+1 {
+		us := r.updates[seq+1-r.updates[0].Seq:]
+		return registryUpdates{
+			Updates: append([]registryUpdate(nil), us...),
+		}, nil
+	}
+
+	b, err := bhgob.Encode(r)
+	if err != nil {
+		return registryUpdates{}, err
+	}
+	return registryUpdates{Snapshot: b}, nil
+}
+
+// applyUpdates applies the updates received from a voter. It is used by
+// observers that are not in the registry's raft group.
+func (r *registry) applyUpdates(us registryUpdates) error {
+	if us.Snapshot != nil {
+		if err := r.Restore(us.Snapshot); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range us.Updates {
+		s := r.seq()
+		if u.Seq <= s {
+			continue
+		}
+		if u.Seq != s+1 {
+			return fmt.Errorf("%v misses updates %v to %v", r, s+1, u.Seq-1)
+		}
+		if u.Conf {
+			r.ApplyConfChange(u.CC, u.Node)
+			continue
+		}
+		r.Apply(u.Req)
 	}
 	return nil
 }
 
-func (r *registry) newHiveID(addr string) uint64 {
+func (r *registry) voters() []uint64 {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	voters := make([]uint64, 0, len(r.Voters))
+	for id := range r.Voters {
+		voters = append(voters, id)
+	}
+	return voters
+}
+
+func (r *registry) isVoter(id uint64) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.Voters[id]
+}
+
+func (r *registry) newHiveID(addr string, labels map[string]string) uint64 {
 	r.HiveID++
 	if addr != "" {
-		r.addHive(HiveInfo{ID: r.HiveID, Addr: addr})
+		r.addHive(HiveInfo{ID: r.HiveID, Addr: addr, Labels: labels})
 	}
 	glog.V(2).Infof("%v allocates new hive ID %v", r, r.HiveID)
 	return r.HiveID
@@ -179,11 +457,36 @@ func (r *registry) newBeeID() uint64 {
 	return r.BeeID
 }
 
-func (r *registry) delHive(id uint64) error {
-	if _, ok := r.Hives[id]; !ok {
-		return fmt.Errorf("no such hive %v", id)
+func (r *registry) updateHive(info HiveInfo) error {
+	old, ok := r.Hives[info.ID]
+	if !ok {
+		return ErrNoSuchHive
+	}
+	if old.Addr == info.Addr {
+		if !sameLabels(old.Labels, info.Labels) {
+			glog.V(2).Infof("%v updates hive %v's labels to %v", r, info.ID,
+				info.Labels)
+			r.Hives[info.ID] = info
+		}
+		return nil
+	}
+
+	for _, h := range r.Hives {
+		if h.Addr == info.Addr && h.ID != info.ID {
+			// The other hive must have moved too or is dead. Its stale address will
+			// be updated when it restarts.
+			glog.Warningf("%v has hive %v with the same address as hive %v: %v", r,
+				h.ID, info.ID, info.Addr)
+		}
+	}
+
+	glog.V(2).Infof("%v updates hive %v's address from %v to %v", r, info.ID,
+		old.Addr, info.Addr)
+	r.Hives[info.ID] = info
+	if r.hiveUpdated != nil {
+		// Called in a goroutine since r is locked.
+		go r.hiveUpdated(info)
 	}
-	delete(r.Hives, id)
 	return nil
 }
 
@@ -362,16 +665,91 @@ func (r *registry) transfer(t transferCells) error {
 	return nil
 }
 
+func (r *registry) release(rc releaseCells) error {
+	if _, ok := r.Bees[rc.Bee]; !ok {
+		return ErrNoSuchBee
+	}
+	r.Store.release(rc.App, rc.Bee)
+	return nil
+}
+
+func (r *registry) newDistTxID() uint64 {
+	r.TxID++
+	glog.V(2).Infof("%v allocates new distributed transaction ID %v", r, r.TxID)
+	r.Txs[r.TxID] = distTxInfo{Bees: make(map[uint64]bool)}
+	return r.TxID
+}
+
+func (r *registry) joinDistTx(j joinDistTx) bool {
+	tx, ok := r.Txs[j.ID]
+	if !ok || tx.Decided {
+		return false
+	}
+	tx.Bees[j.Bee] = true
+	return true
+}
+
+func (r *registry) decideDistTx(d decideDistTx) bool {
+	tx, ok := r.Txs[d.ID]
+	if !ok {
+		return false
+	}
+	if tx.Decided {
+		return tx.Commit
+	}
+	glog.V(2).Infof("%v decides distributed transaction %v: commit=%v", r, d.ID,
+		d.Commit)
+	tx.Decided = true
+	tx.Commit = d.Commit
+	if len(tx.Bees) == 0 {
+		delete(r.Txs, d.ID)
+	} else {
+		r.Txs[d.ID] = tx
+	}
+	return d.Commit
+}
+
+func (r *registry) forgetDistTx(f forgetDistTx) {
+	tx, ok := r.Txs[f.ID]
+	if !ok {
+		return
+	}
+	for _, b := range f.Bees {
+		delete(tx.Bees, b)
+	}
+	if tx.Decided && len(tx.Bees) == 0 {
+		glog.V(2).Infof("%v forgets distributed transaction %v", r, f.ID)
+		delete(r.Txs, f.ID)
+	}
+}
+
+// hives returns the hives of the registry that are not dead.
 func (r *registry) hives() []HiveInfo {
 	r.m.RLock()
 	hives := make([]HiveInfo, 0, len(r.Hives))
 	for _, h := range r.Hives {
+		if r.Dead[h.ID] {
+			continue
+		}
 		hives = append(hives, h)
 	}
 	r.m.RUnlock()
 	return hives
 }
 
+// deadHives returns the hives removed from the raft group as dead.
+func (r *registry) deadHives() []HiveInfo {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	var hives []HiveInfo
+	for id := range r.Dead {
+		if h, ok := r.Hives[id]; ok {
+			hives = append(hives, h)
+		}
+	}
+	return hives
+}
+
 func (r *registry) hive(id uint64) (HiveInfo, error) {
 	r.m.RLock()
 	i, ok := r.Hives[id]
@@ -433,6 +811,30 @@ func (r *registry) beeAndHive(id uint64) (BeeInfo, HiveInfo, error) {
 	return bi, hi, nil
 }
 
+// beesForCells returns the leaders of the colonies that own cells in app, each
+// once, and the cells that are not owned by any colony.
+func (r *registry) beesForCells(app string, cells MappedCells) (bees []uint64,
+	unowned MappedCells) {
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	seen := make(map[uint64]bool)
+	for _, k := range cells {
+		col, ok := r.Store.colony(app, k)
+		if !ok {
+			unowned = append(unowned, k)
+			continue
+		}
+		if seen[col.Leader] {
+			continue
+		}
+		seen[col.Leader] = true
+		bees = append(bees, col.Leader)
+	}
+	return bees, unowned
+}
+
 func (r *registry) beeForCells(app string, cells MappedCells) (info BeeInfo,
 	hasAll bool, err error) {
 
@@ -471,6 +873,8 @@ func init() {
 	gob.Register(noOp{})
 	gob.Register(newBeeID{})
 	gob.Register(newHiveID{})
+	gob.Register(updateHive{})
+	gob.Register(reviveHive(0))
 	gob.Register(HiveInfo{})
 	gob.Register([]HiveInfo{})
 	gob.Register(BeeInfo{})
@@ -479,5 +883,12 @@ func init() {
 	gob.Register(updateColony{})
 	gob.Register(lockMappedCell{})
 	gob.Register(transferCells{})
+	gob.Register(releaseCells{})
+	gob.Register(newDistTxID{})
+	gob.Register(joinDistTx{})
+	gob.Register(decideDistTx{})
+	gob.Register(forgetDistTx{})
 	gob.Register(cellStore{})
+	gob.Register(registryUpdates{})
+	gob.Register(registryResult{})
 }
@@ -0,0 +1,169 @@
+package beehive
+
+import (
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/raft"
+)
+
+func TestRegistryUpdateHive(t *testing.T) {
+	r := newRegistry("test")
+	r.addHive(HiveInfo{ID: 1, Addr: "127.0.0.1:1"})
+
+	ch := make(chan HiveInfo, 1)
+	r.hiveUpdated = func(info HiveInfo) {
+		ch <- info
+	}
+
+	if _, err := r.Apply(updateHive{ID: 2, Addr: "127.0.0.1:2"}); err == nil {
+		t.Error("no error for updating a non-existing hive")
+	}
+
+	if _, err := r.Apply(updateHive{ID: 1, Addr: "127.0.0.1:3"}); err != nil {
+		t.Fatalf("cannot update hive: %v", err)
+	}
+	if i, _ := r.hive(1); i.Addr != "127.0.0.1:3" {
+		t.Errorf("invalid hive address: actual=%v want=127.0.0.1:3", i.Addr)
+	}
+	if i := <-ch; i.ID != 1 || i.Addr != "127.0.0.1:3" {
+		t.Errorf("invalid hive update notification: %#v", i)
+	}
+}
+
+func TestRegistryUpdatesSince(t *testing.T) {
+	r := newRegistry("voter")
+	r.ApplyConfChange(raftpb.ConfChange{
+		Type:   raftpb.ConfChangeAddNode,
+		NodeID: 1,
+	}, raft.NodeInfo{ID: 1, Addr: "127.0.0.1:1"})
+	r.Apply(newHiveID{Addr: "127.0.0.1:2"})
+	r.Apply(newBeeID{})
+
+	o := newRegistry("observer")
+	us, err := r.updatesSince(o.seq())
+	if err != nil {
+		t.Fatalf("cannot get the updates: %v", err)
+	}
+	if len(us.Updates) != 3 || us.Snapshot != nil {
+		t.Fatalf("invalid updates: %#v", us)
+	}
+	if err := o.applyUpdates(us); err != nil {
+		t.Fatalf("cannot apply the updates: %v", err)
+	}
+	if o.seq() != r.seq() || o.BeeID != 1 || len(o.Hives) != 2 ||
+		!o.isVoter(1) || o.isVoter(2) {
+		t.Errorf("invalid observer registry: %#v", o)
+	}
+
+	if us, _ := r.updatesSince(o.seq()); len(us.Updates) != 0 {
+		t.Errorf("invalid updates for an up-to-date observer: %#v", us)
+	}
+
+	r.updates = nil
+	r.Apply(newBeeID{})
+	o = newRegistry("observer")
+	if us, _ = r.updatesSince(0); us.Snapshot == nil {
+		t.Fatal("no snapshot for a stale observer")
+	}
+	o.applyUpdates(us)
+	if o.seq() != r.seq() || o.BeeID != 2 {
+		t.Errorf("invalid restored registry: %#v", o)
+	}
+}
+
+func TestRegistryReplay(t *testing.T) {
+	r := newRegistry("test")
+	r.Apply(newBeeID{})
+	r.Apply(newBeeID{})
+	r.startReplay()
+	if !r.replaying() {
+		t.Error("registry is not replaying")
+	}
+
+	r.Apply(newBeeID{})
+	r.Apply(newBeeID{})
+	if r.replaying() || r.BeeID != 2 {
+		t.Errorf("invalid registry after replay: replaying=%v bee=%v",
+			r.replaying(), r.BeeID)
+	}
+
+	r.Apply(newBeeID{})
+	if r.BeeID != 3 || r.seq() != 3 {
+		t.Errorf("invalid registry after replay: seq=%v bee=%v", r.seq(),
+			r.BeeID)
+	}
+}
+
+func TestRegistryHiveLabels(t *testing.T) {
+	r := newRegistry("test")
+	labels := map[string]string{"zone": "z1"}
+	id := r.newHiveID("127.0.0.1:2", labels)
+	r.ApplyConfChange(raftpb.ConfChange{
+		Type:   raftpb.ConfChangeAddNode,
+		NodeID: id,
+	}, raft.NodeInfo{ID: id, Addr: "127.0.0.1:2"})
+	if i, _ := r.hive(id); i.Label("zone") != "z1" {
+		t.Errorf("invalid labels after adding the hive: %v", i.Labels)
+	}
+
+	labels = map[string]string{"zone": "z2"}
+	r.Apply(updateHive{ID: id, Addr: "127.0.0.1:2", Labels: labels})
+	if i, _ := r.hive(id); i.Label("zone") != "z2" {
+		t.Errorf("invalid labels after updating the hive: %v", i.Labels)
+	}
+}
+
+func TestRegistryRestoreMembers(t *testing.T) {
+	// A registry saved before voters were tracked.
+	old := newRegistry("old")
+	old.addHive(HiveInfo{ID: 1, Addr: "127.0.0.1:1"})
+	old.addHive(HiveInfo{ID: 2, Addr: "127.0.0.1:2"})
+	b, err := old.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRegistry("test")
+	if err := r.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	r.RestoreMembers([]uint64{1, 2})
+	if !r.isVoter(1) || !r.isVoter(2) {
+		t.Errorf("voters are not seeded from raft nodes: %v", r.voters())
+	}
+
+	r.RestoreMembers([]uint64{3})
+	if r.isVoter(3) || len(r.voters()) != 2 {
+		t.Errorf("existing voters are overwritten: %v", r.voters())
+	}
+}
+
+func TestRegistryBeesForCells(t *testing.T) {
+	r := newRegistry("test")
+	r.addHive(HiveInfo{ID: 1, Addr: "127.0.0.1:1"})
+	for i := 0; i < 2; i++ {
+		res, _ := r.Apply(newBeeID{})
+		id := res.(uint64)
+		r.Apply(addBee{ID: id, Hive: 1, App: "a", Colony: Colony{Leader: id}})
+	}
+	r.Apply(lockMappedCell{
+		Colony: Colony{Leader: 1},
+		App:    "a",
+		Cells:  MappedCells{{"D", "k1"}, {"D", "k2"}},
+	})
+	r.Apply(lockMappedCell{
+		Colony: Colony{Leader: 2},
+		App:    "a",
+		Cells:  MappedCells{{"D", "k3"}},
+	})
+
+	cells := MappedCells{{"D", "k1"}, {"D", "k2"}, {"D", "k3"}, {"D", "k4"}}
+	bees, unowned := r.beesForCells("a", cells)
+	if len(bees) != 2 || bees[0] != 1 || bees[1] != 2 {
+		t.Errorf("invalid bees: actual=%v want=[1 2]", bees)
+	}
+	if len(unowned) != 1 || unowned[0] != (CellKey{"D", "k4"}) {
+		t.Errorf("invalid unowned cells: actual=%v want=[D/k4]", unowned)
+	}
+}
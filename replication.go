@@ -1,54 +1,295 @@
 package beehive
 
-import "math/rand"
+import (
+	"math/rand"
+	"sort"
 
-type replicationStrategy interface {
-	// SelectHives selects n hives that are not blacklisted. If not possible, it
-	// returns an empty slice.
-	selectHives(blackList []uint64, n int) []uint64
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// HiveLoad represents the load of a live hive.
+type HiveLoad struct {
+	HiveInfo
+	Bees      int            `json:"bees"`      // number of bees on the hive.
+	Followers map[string]int `json:"followers"` // number of followers per app.
 }
 
-type rndRepliction struct {
-	hive *hive
+// ReplicationStrategy represents a replication algorithm that chooses the hives
+// of the followers of a colony. This interface is used only for persistent
+// applications, whenever a colony has less replicas than the replication
+// factor of the application.
+//
+// The replication strategy of an application is set by AppWithReplication. If
+// not set, the strategy of HiveConfig is used, and RandomReplication if that
+// is not set either.
+type ReplicationStrategy interface {
+	// SelectHives returns at most n hives among candidates for the new
+	// followers of colony. replicas contains the hives of the leader (as the
+	// first element) and of the current followers of colony. candidates contains
+	// the other live hives. Note that the colony is under-replicated if the
+	// strategy returns less than n hives.
+	SelectHives(app App, colony Colony, replicas []HiveLoad,
+		candidates []HiveLoad, n int) []uint64
 }
 
-func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
-	if n <= 0 {
-		return nil
+// RandomReplication is a replication strategy that places followers on random
+// hives.
+type RandomReplication struct{}
+
+func (r RandomReplication) SelectHives(app App, colony Colony,
+	replicas []HiveLoad, candidates []HiveLoad, n int) []uint64 {
+
+	if len(candidates) < n {
+		n = len(candidates)
+	}
+
+	hives := make([]uint64, 0, n)
+	for _, i := range rand.Perm(len(candidates))[:n] {
+		hives = append(hives, candidates[i].ID)
+	}
+	return hives
+}
+
+// LeastLoadedReplication is a replication strategy that places followers on
+// the hives with the least number of bees.
+type LeastLoadedReplication struct{}
+
+func (r LeastLoadedReplication) SelectHives(app App, colony Colony,
+	replicas []HiveLoad, candidates []HiveLoad, n int) []uint64 {
+
+	candidates = append([]HiveLoad(nil), candidates...)
+	sort.Stable(hiveLoadSorter{candidates, lessBees})
+	return firstHives(candidates, n)
+}
+
+// LabelSpreadReplication is a replication strategy that spreads the replicas
+// across the failure domains identified by hive labels (e.g., "zone" and
+// "rack"). Labels are in the order of priority: the replicas are first spread
+// across the values of Labels[0], then across the values of Labels[1], and so
+// on. If there are not enough failure domains, replicas share failure domains.
+type LabelSpreadReplication struct {
+	Labels []string
+}
+
+func (r LabelSpreadReplication) SelectHives(app App, colony Colony,
+	replicas []HiveLoad, candidates []HiveLoad, n int) []uint64 {
+
+	infos := func(loads []HiveLoad) []HiveInfo {
+		infos := make([]HiveInfo, 0, len(loads))
+		for _, l := range loads {
+			infos = append(infos, l.HiveInfo)
+		}
+		return infos
+	}
+
+	// Prefer the least loaded hives among the hives of the same failure
+	// domains.
+	candidates = append([]HiveLoad(nil), candidates...)
+	sort.Stable(hiveLoadSorter{candidates, lessBees})
+	hives, spread := spreadHives(r.Labels, infos(replicas), infos(candidates), n)
+	if !spread {
+		glog.Warningf("not enough failure domains to spread the replicas of %v",
+			colony)
+	}
+	return hives
+}
+
+// CoLocatedReplication is a replication strategy that places followers on the
+// hives that already host the most followers of the related applications. If
+// Apps is empty, the colonies of the same application are considered related.
+// This is useful to co-locate the replicas of colonies that are used together.
+type CoLocatedReplication struct {
+	Apps []string
+}
+
+func (r CoLocatedReplication) SelectHives(app App, colony Colony,
+	replicas []HiveLoad, candidates []HiveLoad, n int) []uint64 {
+
+	apps := r.Apps
+	if len(apps) == 0 {
+		apps = []string{app.Name()}
+	}
+
+	related := func(l HiveLoad) (f int) {
+		for _, a := range apps {
+			f += l.Followers[a]
+		}
+		return f
+	}
+
+	candidates = append([]HiveLoad(nil), candidates...)
+	sort.Stable(hiveLoadSorter{candidates, func(a, b HiveLoad) bool {
+		if ra, rb := related(a), related(b); ra != rb {
+			return ra > rb
+		}
+		return lessBees(a, b)
+	}})
+	return firstHives(candidates, n)
+}
+
+func firstHives(loads []HiveLoad, n int) []uint64 {
+	if len(loads) < n {
+		n = len(loads)
+	}
+	hives := make([]uint64, 0, n)
+	for _, l := range loads[:n] {
+		hives = append(hives, l.ID)
+	}
+	return hives
+}
+
+type hiveLoadSorter struct {
+	loads []HiveLoad
+	less  func(a, b HiveLoad) bool
+}
+
+func (s hiveLoadSorter) Len() int {
+	return len(s.loads)
+}
+
+func (s hiveLoadSorter) Less(i, j int) bool {
+	return s.less(s.loads[i], s.loads[j])
+}
+
+func (s hiveLoadSorter) Swap(i, j int) {
+	s.loads[i], s.loads[j] = s.loads[j], s.loads[i]
+}
+
+func lessBees(a, b HiveLoad) bool {
+	return a.Bees < b.Bees
+}
+
+// spreadHives selects n hives among candidates that share the least failure
+// domains with replicas and with each other. Ties are broken by the order of
+// candidates. spread is false if a selected hive shares a failure domain.
+func spreadHives(labels []string, replicas, candidates []HiveInfo,
+	n int) (hives []uint64, spread bool) {
+
+	used := make([]map[string]bool, len(labels))
+	for i, l := range labels {
+		used[i] = make(map[string]bool)
+		for _, r := range replicas {
+			used[i][r.Label(l)] = true
+		}
 	}
 
-	blmap := make(map[uint64]uint64)
-	for _, h := range blacklist {
-		blmap[h] = h
+	// shared returns the labels that c shares with the selected replicas, in
+	// the order of priority.
+	shared := func(c HiveInfo) []bool {
+		s := make([]bool, len(labels))
+		for i, l := range labels {
+			s[i] = used[i][c.Label(l)]
+		}
+		return s
+	}
+
+	candidates = append([]HiveInfo(nil), candidates...)
+	spread = true
+	for len(hives) < n && len(candidates) != 0 {
+		best := 0
+		bests := shared(candidates[0])
+		for i := 1; i < len(candidates); i++ {
+			if s := shared(candidates[i]); lessShared(s, bests) {
+				best, bests = i, s
+			}
+		}
+
+		for _, s := range bests {
+			spread = spread && !s
+		}
+
+		c := candidates[best]
+		hives = append(hives, c.ID)
+		for i, l := range labels {
+			used[i][c.Label(l)] = true
+		}
+		candidates = append(candidates[:best], candidates[best+1:]...)
 	}
+	return hives, spread
+}
 
-	lives := r.hive.registry.hives()
-	whitelist := make([]uint64, 0, len(lives))
-	for _, h := range lives {
-		if h.ID == r.hive.ID() || blmap[h.ID] != 0 {
+// lessShared returns whether sharing the labels in a is preferred over sharing
+// the labels in b.
+func lessShared(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return !a[i]
+		}
+	}
+	return false
+}
+
+// hiveLoads returns the load of the live hives.
+func (h *hive) hiveLoads() map[uint64]HiveLoad {
+	loads := make(map[uint64]HiveLoad)
+	for _, i := range h.registry.hives() {
+		loads[i.ID] = HiveLoad{
+			HiveInfo:  i,
+			Followers: make(map[string]int),
+		}
+	}
+	for _, b := range h.registry.bees() {
+		l, ok := loads[b.Hive]
+		if !ok {
 			continue
 		}
-		whitelist = append(whitelist, h.ID)
+		l.Bees++
+		if b.Colony.IsFollower(b.ID) {
+			l.Followers[b.App]++
+		}
+		loads[b.Hive] = l
 	}
+	return loads
+}
 
-	if len(whitelist) < n {
-		n = len(whitelist)
+func (h *hive) replicationStrategy(a *app) ReplicationStrategy {
+	if a.replication != nil {
+		return a.replication
 	}
+	if s := h.Config().Replication; s != nil {
+		return s
+	}
+	return RandomReplication{}
+}
 
-	if n == 0 {
+// selectFollowerHives selects n hives for the new followers of colony c of
+// app a. replicas are the hives of the leader and the current followers of c.
+func (h *hive) selectFollowerHives(a *app, c Colony, replicas []uint64,
+	n int) []uint64 {
+
+	if n <= 0 {
 		return nil
 	}
 
-	rndHives := make([]uint64, 0, n)
-	for _, i := range rand.Perm(n) {
-		rndHives = append(rndHives, whitelist[i])
+	loads := h.hiveLoads()
+	var rloads, cloads []HiveLoad
+	isReplica := make(map[uint64]bool)
+	for _, r := range replicas {
+		isReplica[r] = true
+		if l, ok := loads[r]; ok {
+			rloads = append(rloads, l)
+		}
 	}
-	return rndHives
-}
+	for _, l := range loads {
+		if !isReplica[l.ID] {
+			cloads = append(cloads, l)
+		}
+	}
+	// Pass the candidates in a deterministic order.
+	sort.Sort(hiveLoadSorter{cloads, func(a, b HiveLoad) bool {
+		return a.ID < b.ID
+	}})
+
+	var hives []uint64
+	for _, id := range h.replicationStrategy(a).SelectHives(a, c, rloads,
+		cloads, n) {
 
-func newRndReplication(h *hive) *rndRepliction {
-	r := &rndRepliction{
-		hive: h,
+		if _, ok := loads[id]; !ok || isReplica[id] || len(hives) == n {
+			glog.Errorf("%v ignores invalid hive %v selected for %v", h, id, c)
+			continue
+		}
+		isReplica[id] = true
+		hives = append(hives, id)
 	}
-	return r
+	return hives
 }
@@ -0,0 +1,176 @@
+package beehive
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/raft"
+)
+
+func labeledHive(id uint64, zone, rack string) HiveInfo {
+	return HiveInfo{
+		ID:     id,
+		Labels: map[string]string{"zone": zone, "rack": rack},
+	}
+}
+
+func TestSpreadHives(t *testing.T) {
+	labels := []string{"zone", "rack"}
+	replicas := []HiveInfo{labeledHive(1, "z1", "r1")}
+	candidates := []HiveInfo{
+		labeledHive(2, "z1", "r1"),
+		labeledHive(3, "z1", "r2"),
+		labeledHive(4, "z2", "r1"),
+		labeledHive(5, "z2", "r3"),
+	}
+
+	hives, spread := spreadHives(labels, replicas, candidates, 1)
+	if !spread {
+		t.Error("replicas are not spread")
+	}
+	if len(hives) != 1 || hives[0] != 5 {
+		t.Errorf("invalid hives: actual=%v want=[5]", hives)
+	}
+
+	hives, spread = spreadHives(labels, replicas, candidates, 2)
+	if spread {
+		t.Error("three replicas are spread in two zones")
+	}
+	if len(hives) != 2 || hives[0] != 5 || hives[1] != 3 {
+		t.Errorf("invalid hives: actual=%v want=[5 3]", hives)
+	}
+
+	candidates = []HiveInfo{
+		labeledHive(2, "z1", "r1"),
+		labeledHive(3, "z1", "r2"),
+	}
+	hives, spread = spreadHives(labels, replicas, candidates, 2)
+	if spread {
+		t.Error("replicas are spread in a single zone")
+	}
+	if len(hives) != 2 || hives[0] != 3 || hives[1] != 2 {
+		t.Errorf("invalid hives: actual=%v want=[3 2]", hives)
+	}
+}
+
+func TestLeastLoadedReplication(t *testing.T) {
+	candidates := []HiveLoad{
+		{HiveInfo: HiveInfo{ID: 2}, Bees: 3},
+		{HiveInfo: HiveInfo{ID: 3}, Bees: 1},
+		{HiveInfo: HiveInfo{ID: 4}, Bees: 2},
+	}
+	hives := LeastLoadedReplication{}.SelectHives(nil, Colony{}, nil,
+		candidates, 2)
+	if len(hives) != 2 || hives[0] != 3 || hives[1] != 4 {
+		t.Errorf("invalid hives: actual=%v want=[3 4]", hives)
+	}
+}
+
+func TestLabelSpreadReplication(t *testing.T) {
+	replicas := []HiveLoad{{HiveInfo: labeledHive(1, "z1", "r1")}}
+	candidates := []HiveLoad{
+		{HiveInfo: labeledHive(2, "z2", "r1"), Bees: 2},
+		{HiveInfo: labeledHive(3, "z2", "r2"), Bees: 2},
+		{HiveInfo: labeledHive(4, "z2", "r3"), Bees: 1},
+	}
+	s := LabelSpreadReplication{Labels: []string{"zone", "rack"}}
+	hives := s.SelectHives(nil, Colony{}, replicas, candidates, 1)
+	if len(hives) != 1 || hives[0] != 4 {
+		t.Errorf("invalid hives: actual=%v want=[4]", hives)
+	}
+}
+
+func TestCoLocatedReplication(t *testing.T) {
+	candidates := []HiveLoad{
+		{HiveInfo: HiveInfo{ID: 2}, Followers: map[string]int{"a": 1}},
+		{HiveInfo: HiveInfo{ID: 3}, Followers: map[string]int{"b": 2}},
+		{HiveInfo: HiveInfo{ID: 4}},
+	}
+	s := CoLocatedReplication{Apps: []string{"b"}}
+	hives := s.SelectHives(nil, Colony{}, nil, candidates, 2)
+	if len(hives) != 2 || hives[0] != 3 || hives[1] != 2 {
+		t.Errorf("invalid hives: actual=%v want=[3 2]", hives)
+	}
+}
+
+// oneHiveReplication selects at most one hive per call.
+type oneHiveReplication struct{}
+
+func (r oneHiveReplication) SelectHives(app App, colony Colony,
+	replicas []HiveLoad, candidates []HiveLoad, n int) []uint64 {
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	return []uint64{candidates[0].ID}
+}
+
+func TestRecruitFollowersWithFewerHives(t *testing.T) {
+	ch := make(chan uint64)
+	var hives []Hive
+	for i := 1; i <= 3; i++ {
+		cfg := DefaultCfg
+		cfg.StatePath = fmt.Sprintf("/tmp/bhtest_repl%v", i)
+		cfg.Addr = newHiveAddrForTest()
+		if i != 1 {
+			cfg.PeerAddrs = []string{hives[0].(*hive).config.Addr}
+		}
+		removeState(cfg)
+		defer removeState(cfg)
+		h := NewHiveWithConfig(cfg)
+		a := registerPersistentApp(h, ch)
+		a.(*app).replication = oneHiveReplication{}
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	// Followers are recruited when the first transaction is committed.
+	hives[0].Emit(AppTestMsg(0))
+	<-ch
+	hives[0].Emit(AppTestMsg(0))
+	id := <-ch
+	b, err := hives[0].(*hive).registry.bee(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Colony.Followers) != 2 {
+		t.Errorf("invalid number of followers: actual=%v want=2",
+			len(b.Colony.Followers))
+	}
+}
+
+func TestSelectFollowerHivesSkipsDeadVoters(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_repl_dead"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg).(*hive)
+	a := h.NewApp("dead").(*app)
+
+	for i := uint64(2); i <= 4; i++ {
+		n := raft.NodeInfo{ID: i, Addr: fmt.Sprintf("127.0.0.1:%v", i)}
+		cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: i}
+		h.registry.ApplyConfChange(cc, n)
+	}
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 3}
+	h.registry.ApplyConfChange(cc, raft.NodeInfo{ID: 3, Addr: "127.0.0.1:3"})
+
+	for i := 0; i < 16; i++ {
+		hives := h.selectFollowerHives(a, Colony{Leader: 2}, []uint64{2}, 2)
+		for _, id := range hives {
+			if id == 3 {
+				t.Fatalf("dead voter is selected as a follower hive: %v", hives)
+			}
+		}
+	}
+
+	h.registry.Apply(reviveHive(3))
+	hives := h.selectFollowerHives(a, Colony{Leader: 2}, []uint64{2}, 2)
+	if len(hives) != 2 {
+		t.Errorf("revived hive is not selected: %v", hives)
+	}
+}
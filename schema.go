@@ -0,0 +1,144 @@
+package beehive
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/raft"
+	"github.com/kandoo/beehive/state"
+)
+
+// Values stored with state.PutVersioned are tagged with the version of their
+// schema (see state.Schema), and are upgraded when read. Applications with
+// AppRewriteOutdatedValues also rewrite outdated values in the background, on
+// every sweep of their bees. As with expired keys, the rewrite is a
+// transaction that is replicated in persistent applications.
+//
+// A hive refuses to start if a stored value has a version with no upgrade
+// path: before the hive starts, it checks the state of its passive bees, and
+// the snapshots and the replicated transactions of its persistent bees.
+
+// AppRewriteOutdatedValues is an application option that rewrites the values
+// of outdated schema versions in the state of the application's bees using
+// the current versions of their schemas. Values are rewritten on every sweep
+// (see AppWithSweepInterval).
+func AppRewriteOutdatedValues() AppOption {
+	return func(a *app) {
+		a.flags |= appFlagRewriteOutdated
+	}
+}
+
+func (a *app) rewritesOutdatedValues() bool {
+	return a.flags&appFlagRewriteOutdated != 0
+}
+
+// rewriteOutdated rewrites the outdated values of the bee in a transaction.
+func (b *bee) rewriteOutdated() error {
+	if b.detached || b.proxy || !b.isLeader() || b.status != beeStatusStarted {
+		return nil
+	}
+
+	ops, err := b.stateL1.Outdated()
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+
+	glog.V(2).Infof("%v rewrites %v outdated values", b, len(ops))
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, o := range ops {
+		if o.E.IsZero() {
+			b.Dict(o.D).Put(o.K, o.V)
+			continue
+		}
+		state.PutTTL(b.Dict(o.D), o.K, o.V, o.E.Sub(now))
+	}
+	return b.CommitTx()
+}
+
+// rewriteOutdated rewrites the outdated values of the local bees.
+func (q *qee) rewriteOutdated() {
+	q.RLock()
+	bees := make([]*bee, 0, len(q.bees))
+	for _, b := range q.bees {
+		if !b.detached && !b.proxy {
+			bees = append(bees, b)
+		}
+	}
+	q.RUnlock()
+
+	for _, b := range bees {
+		if _, err := b.processCmd(cmdRewriteOutdated{}); err != nil {
+			glog.Errorf("%v cannot rewrite outdated values of %v: %v", q, b, err)
+		}
+	}
+}
+
+// checkSchemas returns an error if the state of a bee on this hive, either
+// passive or persistent, has a value with no upgrade path.
+func (h *hive) checkSchemas() error {
+	paths, err := filepath.Glob(path.Join(h.config.StatePath, "passive", "*",
+		"*"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if strings.HasSuffix(p, ".tmp") {
+			continue
+		}
+		pb, err := readPassiveBee(p)
+		if err != nil {
+			return err
+		}
+		if err := state.NewInMem().Restore(pb.State); err != nil {
+			return fmt.Errorf("invalid passive bee %v: %v", p, err)
+		}
+	}
+
+	// The state of persistent bees is in "StatePath/app/bee".
+	if paths, err = filepath.Glob(path.Join(h.config.StatePath, "*",
+		"*")); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := checkBeeSchemas(p); err != nil {
+			return fmt.Errorf("invalid bee state %v: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// checkBeeSchemas checks the snapshot and the replicated transactions of the
+// bee whose raft data is in dir. It returns nil if dir has no raft data.
+func checkBeeSchemas(dir string) error {
+	d, reqs, err := raft.ReadStore(dir)
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		if err := state.NewInMem().Restore(d); err != nil {
+			return err
+		}
+	}
+	for _, r := range reqs {
+		var ops []state.Op
+		switch r := r.(type) {
+		case commitTx:
+			ops = r.Ops
+		case txChunk:
+			ops = r.Tx.Ops
+		case prepareDistTx:
+			ops = r.Ops
+		}
+		if err := state.CheckOps(ops); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+func TestHiveRefusesOutdatedSchema(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_schema"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+
+	state.RegisterSchema(state.Schema{Name: "schematest", Version: 1})
+	s := state.NewInMem()
+	state.PutVersioned(s.Dict("D"), "k", "schematest", "v")
+	b, err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := passiveBeePath(cfg, "schema", 1)
+	if err := writePassiveBee(p, passiveBee{State: b}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 1 has no upgrade path to version 2.
+	state.RegisterSchema(state.Schema{Name: "schematest", Version: 2})
+	h := NewHiveWithConfig(cfg)
+	h.NewApp("schema")
+	if err := h.Start(); err == nil {
+		h.Stop()
+		t.Error("hive starts with a value that has no upgrade path")
+	}
+}
+
+type schemaTestMsg struct{}
+
+func TestHiveRefusesOutdatedPersistentSchema(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_schema_persistent"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+
+	state.RegisterSchema(state.Schema{Name: "schemapersistent", Version: 1})
+	h := NewHiveWithConfig(cfg)
+	ch := make(chan struct{})
+	h.NewApp("schema", Persistent(1)).HandleFunc(schemaTestMsg{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			state.PutVersioned(ctx.Dict("D"), "k", "schemapersistent", "v")
+			ch <- struct{}{}
+			return nil
+		})
+	go h.Start()
+	waitTilStareted(h)
+	h.Emit(schemaTestMsg{})
+	<-ch
+	h.Stop()
+
+	// Version 1 has no upgrade path to version 2.
+	state.RegisterSchema(state.Schema{Name: "schemapersistent", Version: 2})
+	h = NewHiveWithConfig(cfg)
+	h.NewApp("schema", Persistent(1))
+	errc := make(chan error, 1)
+	go func() { errc <- h.Start() }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("hive starts with a replicated value that has no upgrade path")
+		}
+	case <-time.After(5 * time.Second):
+		h.Stop()
+		t.Error("hive starts with a replicated value that has no upgrade path")
+	}
+}
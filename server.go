@@ -20,12 +20,16 @@ import (
 // state is served as json while other endpoints serve gob. The reason is that
 // state should be human readable.
 const (
-	serverV1StatePath   = "/api/v1/state"
-	serverV1BeesPath    = "/api/v1/bees"
-	serverV1MsgPath     = "/api/v1/msg"
-	serverV1CmdPath     = "/api/v1/cmd"
-	serverV1RaftPath    = "/api/v1/raft"
-	serverV1BeeRaftPath = "/api/v1/beeraft"
+	serverV1StatePath    = "/api/v1/state"
+	serverV1BeesPath     = "/api/v1/bees"
+	serverV1BeeStatePath = "/api/v1/bees/{id:[0-9]+}/state"
+	serverV1MsgPath      = "/api/v1/msg"
+	serverV1CmdPath      = "/api/v1/cmd"
+	serverV1RaftPath     = "/api/v1/raft"
+	serverV1BeeRaftPath  = "/api/v1/beeraft"
+	serverV1ConfigPath   = "/api/v1/config"
+	serverV1QuotasPath   = "/api/v1/quotas"
+	serverV1SnapsPath    = "/api/v1/snapshots"
 )
 
 func buildURL(scheme, addr, path string) string {
@@ -77,10 +81,16 @@ type v1Handler struct {
 func (h *v1Handler) install(r *mux.Router) {
 	r.HandleFunc(serverV1StatePath, h.handleHiveState)
 	r.HandleFunc(serverV1BeesPath, h.handleBees)
+	r.HandleFunc(serverV1BeeStatePath, h.handleBeeState).Methods("GET")
+	r.HandleFunc(serverV1BeeStatePath, h.handleBeeStateImport).Methods("POST")
 	r.HandleFunc(serverV1MsgPath, h.handleMsg)
 	r.HandleFunc(serverV1CmdPath, h.handleCmd)
 	r.HandleFunc(serverV1BeeRaftPath, h.handleBeeRaft)
 	r.HandleFunc(serverV1RaftPath, h.handleRaft)
+	r.HandleFunc(serverV1ConfigPath, h.handleConfig).Methods("GET")
+	r.HandleFunc(serverV1ConfigPath, h.handleConfigReload).Methods("POST")
+	r.HandleFunc(serverV1QuotasPath, h.handleQuotas)
+	r.HandleFunc(serverV1SnapsPath, h.handleSnapshots)
 }
 
 func (h *v1Handler) handleMsg(w http.ResponseWriter, r *http.Request) {
@@ -248,16 +258,29 @@ func (h *v1Handler) handleBeeRaft(w http.ResponseWriter, r *http.Request) {
 }
 
 type hiveState struct {
-	Id    uint64     `json:"id"`
-	Addr  string     `json:"addr"`
-	Peers []HiveInfo `json:"peers"`
+	Id     uint64     `json:"id"`
+	Addr   string     `json:"addr"`
+	Peers  []HiveInfo `json:"peers"`
+	Voters []uint64   `json:"voters,omitempty"`
+
+	MsgRate float64 `json:"msg_rate"` // messages received per second.
+
+	// Snapshot reports the snapshots of the registry on this hive.
+	Snapshot *raft.SnapshotStats `json:"snapshot,omitempty"`
 }
 
 func (h *v1Handler) handleHiveState(w http.ResponseWriter, r *http.Request) {
 	s := hiveState{
-		Id:    h.srv.hive.ID(),
-		Addr:  h.srv.hive.config.Addr,
-		Peers: h.srv.hive.registry.hives(),
+		Id:     h.srv.hive.ID(),
+		Addr:   h.srv.hive.config.Addr,
+		Peers:  h.srv.hive.registry.hives(),
+		Voters: h.srv.hive.registry.voters(),
+
+		MsgRate: h.srv.hive.rcvMeter.rate(),
+	}
+	if n := h.srv.hive.raftNode(); n != nil {
+		stats := n.SnapshotStats()
+		s.Snapshot = &stats
 	}
 
 	j, err := json.Marshal(s)
@@ -279,3 +302,47 @@ func (h *v1Handler) handleBees(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(j)
 }
+
+func (h *v1Handler) handleConfig(w http.ResponseWriter, r *http.Request) {
+	j, err := json.Marshal(h.srv.hive.Config())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// handleConfigReload reloads the configuration of the hive. If the request has
+// a body, it is parsed in the format of the config file and is overlaid on the
+// current configuration. Otherwise, the config file of the hive is reloaded.
+func (h *v1Handler) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var res ConfigReload
+	var err error
+	if b.Len() == 0 {
+		res, err = h.srv.hive.reloadConfigFile()
+	} else {
+		var cfg HiveConfig
+		if cfg, err = parseConfig(&b, h.srv.hive.Config()); err == nil {
+			res, err = h.srv.hive.ReloadConfig(cfg)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
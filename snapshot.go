@@ -0,0 +1,72 @@
+package beehive
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/kandoo/beehive/raft"
+)
+
+// AppWithSnapshots is an application option that configures how often the
+// bees of a persistent application snapshot their state, and how many
+// snapshot and WAL files they keep. By default, bees use
+// HiveConfig.BeeSnapshot.
+func AppWithSnapshots(c raft.SnapshotConfig) AppOption {
+	return func(a *app) {
+		a.snapshot = &c
+	}
+}
+
+// snapshotConfig returns the snapshot configuration of the app's bees.
+func (a *app) snapshotConfig() raft.SnapshotConfig {
+	if a.snapshot != nil {
+		return *a.snapshot
+	}
+	return a.hive.config.BeeSnapshot
+}
+
+// beeSnapshots is the JSON representation of the snapshots taken by a bee.
+type beeSnapshots struct {
+	Bee   uint64             `json:"bee"`
+	App   string             `json:"app"`
+	Stats raft.SnapshotStats `json:"stats"`
+}
+
+type beeSnapshotsByID []beeSnapshots
+
+func (s beeSnapshotsByID) Len() int           { return len(s) }
+func (s beeSnapshotsByID) Less(i, j int) bool { return s[i].Bee < s[j].Bee }
+func (s beeSnapshotsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (h *v1Handler) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	snaps := make([]beeSnapshots, 0)
+	for _, a := range h.srv.hive.apps {
+		if !a.persistent() {
+			continue
+		}
+		a.qee.RLock()
+		for _, b := range a.qee.bees {
+			if b.detached || b.proxy {
+				continue
+			}
+			if n := b.raftNode(); n != nil {
+				snaps = append(snaps, beeSnapshots{
+					Bee:   b.ID(),
+					App:   a.Name(),
+					Stats: n.SnapshotStats(),
+				})
+			}
+		}
+		a.qee.RUnlock()
+	}
+	sort.Sort(beeSnapshotsByID(snaps))
+
+	j, err := json.Marshal(snaps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
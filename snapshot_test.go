@@ -0,0 +1,59 @@
+package beehive
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/kandoo/beehive/raft"
+)
+
+type snapshotTestMsg int
+
+func TestAppWithSnapshots(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_snapshot"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan struct{})
+	a := h.NewApp("snapshot", Persistent(1),
+		AppWithSnapshots(raft.SnapshotConfig{Count: 4, Compress: true}))
+	a.HandleFunc(snapshotTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			k := strconv.Itoa(int(msg.Data().(snapshotTestMsg)))
+			ctx.Dict("D").Put(k, []byte(k))
+			ch <- struct{}{}
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < 16; i++ {
+		h.Emit(snapshotTestMsg(i))
+		<-ch
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", serverV1SnapsPath, nil)
+	h.(*hive).server.Handler.ServeHTTP(w, r)
+	var snaps []beeSnapshots
+	if err := json.Unmarshal(w.Body.Bytes(), &snaps); err != nil {
+		t.Fatalf("cannot decode snapshots: %v", err)
+	}
+	if len(snaps) != 1 {
+		t.Fatalf("invalid number of bees with snapshots: %v", len(snaps))
+	}
+	if s := snaps[0].Stats; s.Snapshots == 0 || s.Size == 0 {
+		t.Errorf("no snapshot is reported: %+v", s)
+	}
+}
@@ -3,6 +3,9 @@ package state
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
 )
 
 type IterFn func(k string, v []byte)
@@ -23,6 +26,98 @@ type Dict interface {
 	PutGob(k string, v interface{}) error
 }
 
+// TTLDict is a dictionary that can expire keys. The dictionaries of the
+// states in this package are all TTLDicts.
+type TTLDict interface {
+	Dict
+
+	// PutTTL stores v for key k in d, and expires k after ttl. Expired keys are
+	// invisible to Get and ForEach, and are eventually removed from d.
+	PutTTL(k string, v []byte, ttl time.Duration) error
+	// PutGobTTL encodes v using gob and stores it for key k in d for ttl.
+	PutGobTTL(k string, v interface{}, ttl time.Duration) error
+	// ExpiresAt returns when k expires, and whether k exists and has a TTL.
+	ExpiresAt(k string) (time.Time, bool)
+}
+
+// LookupDict is a dictionary that can look up its secondary indexes (see
+// Indexer).
+type LookupDict interface {
+	Dict
+
+	// Lookup returns the sorted keys indexed under ik in index. It returns
+	// ErrNoIndex if the dictionary has no such index.
+	Lookup(index, ik string) ([]string, error)
+}
+
+// AtomicDict is a dictionary with read-modify-write operations. In a
+// transaction, these operations are staged and replicated as such instead of
+// as the resulting puts.
+type AtomicDict interface {
+	Dict
+
+	// Add adds delta to the integer stored for k (see GetInt), and returns the
+	// new integer. A missing key is 0. Add keeps the expiry of k.
+	Add(k string, delta int64) (int64, error)
+	// Append appends v to the value stored for k. Append keeps the expiry of k.
+	Append(k string, v []byte) error
+	// PutIfAbsent stores v for key k if k does not exist, and returns whether v
+	// is stored.
+	PutIfAbsent(k string, v []byte) (bool, error)
+	// CompareAndSwap stores v for key k if the value of k is old, and returns
+	// whether v is stored.
+	CompareAndSwap(k string, old, v []byte) (bool, error)
+}
+
+// ErrNoTTL is returned when storing a key with a TTL in a dictionary that is
+// not a TTLDict.
+var ErrNoTTL = errors.New("dictionary does not support TTLs")
+
+// PutTTL stores v for key k in d, and expires k after ttl. It returns ErrNoTTL
+// if d is not a TTLDict.
+func PutTTL(d Dict, k string, v []byte, ttl time.Duration) error {
+	td, ok := d.(TTLDict)
+	if !ok {
+		return ErrNoTTL
+	}
+	return td.PutTTL(k, v, ttl)
+}
+
+// ExpiresAt returns when k expires in d, and whether k exists and has a TTL.
+// It returns false if d is not a TTLDict.
+func ExpiresAt(d Dict, k string) (time.Time, bool) {
+	td, ok := d.(TTLDict)
+	if !ok {
+		return time.Time{}, false
+	}
+	return td.ExpiresAt(k)
+}
+
+// Lookup returns the sorted keys indexed under ik in index of d. It returns
+// ErrNoIndex if d is not a LookupDict or has no such index.
+func Lookup(d Dict, index, ik string) ([]string, error) {
+	ld, ok := d.(LookupDict)
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	return ld.Lookup(index, ik)
+}
+
+// GetInt retrieves the integer stored for k in d using Add or PutInt. It
+// returns ErrNotInt if the value is not an integer.
+func GetInt(d Dict, k string) (int64, error) {
+	v, err := d.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	return DecodeInt(v)
+}
+
+// PutInt stores integer i for key k in d.
+func PutInt(d Dict, k string, i int64) error {
+	return d.Put(k, EncodeInt(i))
+}
+
 func GetGob(d Dict, k string, v interface{}) error {
 	dv, err := d.Get(k)
 	if err != nil {
@@ -42,3 +137,74 @@ func PutGob(d Dict, k string, v interface{}) error {
 	d.Put(k, buf.Bytes())
 	return nil
 }
+
+func PutGobTTL(d Dict, k string, v interface{}, ttl time.Duration) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return PutTTL(d, k, buf.Bytes(), ttl)
+}
+
+// expiringDict is a dictionary that can store a key with an absolute expiry
+// time. Operations of transactions carry absolute expiry times, so that all
+// replicas expire a key at the same time.
+type expiringDict interface {
+	putExpiring(k string, v []byte, exp time.Time) error
+}
+
+// applyPut applies put operation o on d.
+func applyPut(d Dict, o Op) error {
+	if o.E.IsZero() {
+		return d.Put(o.K, o.V)
+	}
+	if ed, ok := d.(expiringDict); ok {
+		return ed.putExpiring(o.K, o.V, o.E)
+	}
+	return PutTTL(d, o.K, o.V, o.E.Sub(time.Now()))
+}
+
+// applyOp applies operation o on d. Read-modify-write operations are applied
+// using Get and Put if d is not an AtomicDict.
+func applyOp(d Dict, o Op) error {
+	switch o.T {
+	case Put:
+		return applyPut(d, o)
+	case Del:
+		return d.Del(o.K)
+	}
+	ad, ok := d.(AtomicDict)
+	if !ok {
+		v, err := d.Get(o.K)
+		v, _, err = o.Result(v, err == nil)
+		if err != nil {
+			return err
+		}
+		return d.Put(o.K, v)
+	}
+	switch o.T {
+	case Add:
+		i, err := DecodeInt(o.V)
+		if err != nil {
+			return err
+		}
+		_, err = ad.Add(o.K, i)
+		return err
+	case Append:
+		return ad.Append(o.K, o.V)
+	case PutIfAbsent:
+		ok, err := ad.PutIfAbsent(o.K, o.V)
+		if err == nil && !ok {
+			err = ErrPrecondition
+		}
+		return err
+	case CAS:
+		ok, err := ad.CompareAndSwap(o.K, o.P, o.V)
+		if err == nil && !ok {
+			err = ErrPrecondition
+		}
+		return err
+	}
+	return fmt.Errorf("unknown operation %v", o.T)
+}
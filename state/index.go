@@ -0,0 +1,105 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrNoIndex is returned when looking up an index that does not exist.
+var ErrNoIndex = errors.New("no such index")
+
+// IndexFn extracts the index keys of value v stored for key k. A key is
+// indexed under all the returned index keys, and is not indexed if there is
+// none.
+type IndexFn func(k string, v []byte) []string
+
+// Indexer is a state that maintains secondary indexes on its dictionaries.
+type Indexer interface {
+	// AddIndex adds index name on dictionary dict. The index is built for the
+	// keys that already exist in the dictionary and is kept up to date on every
+	// modification of the dictionary, including restores.
+	AddIndex(dict, name string, f IndexFn) error
+}
+
+// indexedDict is a dictionary that can return the extractor of its indexes.
+// Transactions use the extractors to index the keys they stage.
+type indexedDict interface {
+	indexFn(name string) (IndexFn, bool)
+}
+
+// index maps index keys to the keys of a dictionary.
+type index struct {
+	fn   IndexFn
+	keys map[string]map[string]bool
+}
+
+func newIndex(f IndexFn) *index {
+	return &index{
+		fn:   f,
+		keys: make(map[string]map[string]bool),
+	}
+}
+
+func (i *index) add(k string, v []byte) {
+	for _, ik := range i.fn(k, v) {
+		keys, ok := i.keys[ik]
+		if !ok {
+			keys = make(map[string]bool)
+			i.keys[ik] = keys
+		}
+		keys[k] = true
+	}
+}
+
+func (i *index) del(k string, v []byte) {
+	for _, ik := range i.fn(k, v) {
+		keys := i.keys[ik]
+		delete(keys, k)
+		if len(keys) == 0 {
+			delete(i.keys, ik)
+		}
+	}
+}
+
+// lookupTx returns the keys indexed under ik in d, as seen in the staged
+// operations of tx.
+func lookupTx(d Dict, ops map[string]Op, index, ik string) ([]string,
+	error) {
+
+	keys, err := Lookup(d, index, ik)
+	if err != nil || len(ops) == 0 {
+		return keys, err
+	}
+
+	var res []string
+	for _, k := range keys {
+		if _, ok := ops[k]; !ok {
+			res = append(res, k)
+		}
+	}
+
+	id, ok := d.(indexedDict)
+	if !ok {
+		return res, nil
+	}
+	f, ok := id.indexFn(index)
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	now := time.Now()
+	for k, o := range ops {
+		v, ok := staged(d, o, now)
+		if !ok {
+			continue
+		}
+		for _, i := range f(k, v) {
+			if i == ik {
+				res = append(res, k)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
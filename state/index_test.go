@@ -0,0 +1,81 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// userIndex indexes the sessions stored as "user:data" by user.
+func userIndex(k string, v []byte) []string {
+	return []string{strings.SplitN(string(v), ":", 2)[0]}
+}
+
+func expectLookup(t *testing.T, d Dict, ik string, want []string) {
+	keys, err := Lookup(d, "user", ik)
+	if err != nil {
+		t.Fatalf("cannot lookup %v: %v", ik, err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid keys for %v: actual=%v want=%v", ik, keys, want)
+	}
+}
+
+func TestInMemIndex(t *testing.T) {
+	s := NewInMem()
+	d := s.Dict("sessions")
+	d.Put("s1", []byte("u1:a"))
+	d.Put("s2", []byte("u2:b"))
+
+	if _, err := Lookup(d, "user", "u1"); err != ErrNoIndex {
+		t.Errorf("invalid error for a missing index: %v", err)
+	}
+
+	// The index is built on existing keys.
+	s.AddIndex("sessions", "user", userIndex)
+	expectLookup(t, d, "u1", []string{"s1"})
+
+	d.Put("s3", []byte("u1:c"))
+	d.Put("s2", []byte("u1:d"))
+	expectLookup(t, d, "u1", []string{"s1", "s2", "s3"})
+	expectLookup(t, d, "u2", nil)
+
+	d.Del("s1")
+	expectLookup(t, d, "u1", []string{"s2", "s3"})
+
+	b, err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewInMem()
+	r.AddIndex("sessions", "user", userIndex)
+	if err := r.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, r.Dict("sessions"), "u1", []string{"s2", "s3"})
+}
+
+func TestTxIndex(t *testing.T) {
+	s := NewInMem()
+	s.AddIndex("sessions", "user", userIndex)
+	s.Dict("sessions").Put("s1", []byte("u1:a"))
+	s.Dict("sessions").Put("s2", []byte("u1:b"))
+
+	tx := NewTransactional(s)
+	tx.BeginTx()
+	d := tx.Dict("sessions")
+	d.Put("s2", []byte("u2:b"))
+	d.Put("s3", []byte("u1:c"))
+	expectLookup(t, d, "u1", []string{"s1", "s3"})
+	expectLookup(t, d, "u2", []string{"s2"})
+	expectLookup(t, s.Dict("sessions"), "u1", []string{"s1", "s2"})
+
+	tx.CommitTx()
+	expectLookup(t, s.Dict("sessions"), "u1", []string{"s1", "s3"})
+
+	tx.BeginTx()
+	tx.Dict("sessions").Del("s1")
+	expectLookup(t, tx.Dict("sessions"), "u1", []string{"s3"})
+	tx.AbortTx()
+	expectLookup(t, s.Dict("sessions"), "u1", []string{"s1", "s3"})
+}
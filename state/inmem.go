@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"sort"
+	"time"
 )
 
 // InMem is a simple dictionary that uses in memory maps.
 type InMem struct {
 	Dicts map[string]*inMemDict
+
+	indexes map[string]map[string]IndexFn // indexes of each dictionary.
 }
 
 // NewInMem creates a new InMem state.
@@ -27,10 +31,47 @@ func (s *InMem) Save() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Restore restores the state from b. The state is not modified if b is
+// invalid or has a value with no upgrade path.
 func (s *InMem) Restore(b []byte) error {
+	r := NewInMem()
 	buf := bytes.NewBuffer(b)
 	dec := gob.NewDecoder(buf)
-	return dec.Decode(s)
+	if err := dec.Decode(r); err != nil {
+		return err
+	}
+	for n, d := range r.Dicts {
+		for k, v := range d.Dict {
+			if err := checkValue(v); err != nil {
+				return fmt.Errorf("cannot restore %v/%v: %v", n, k, err)
+			}
+		}
+	}
+	s.Dicts = r.Dicts
+	for n, d := range s.Dicts {
+		d.indexes = nil
+		for i, f := range s.indexes[n] {
+			d.addIndex(i, f)
+		}
+		d.size = 0
+		for k, v := range d.Dict {
+			d.size += len(k) + len(v)
+		}
+	}
+	return nil
+}
+
+// AddIndex adds index name on dictionary dict.
+func (s *InMem) AddIndex(dict, name string, f IndexFn) error {
+	if s.indexes == nil {
+		s.indexes = make(map[string]map[string]IndexFn)
+	}
+	if s.indexes[dict] == nil {
+		s.indexes[dict] = make(map[string]IndexFn)
+	}
+	s.indexes[dict][name] = f
+	s.inMemDict(dict).addIndex(name, f)
+	return nil
 }
 
 func (s *InMem) Dict(name string) Dict {
@@ -40,15 +81,89 @@ func (s *InMem) Dict(name string) Dict {
 func (s *InMem) inMemDict(name string) *inMemDict {
 	d, ok := s.Dicts[name]
 	if !ok {
-		d = &inMemDict{name, make(map[string][]byte)}
+		d = &inMemDict{DictName: name, Dict: make(map[string][]byte)}
+		for i, f := range s.indexes[name] {
+			d.addIndex(i, f)
+		}
 		s.Dicts[name] = d
 	}
 	return d
 }
 
+func (s *InMem) DictNames() []string {
+	names := make([]string, 0, len(s.Dicts))
+	for n := range s.Dicts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *InMem) Expired(now time.Time) []Op {
+	var ops []Op
+	for n, d := range s.Dicts {
+		for k, exp := range d.Expiry {
+			if !exp.After(now) {
+				ops = append(ops, Op{T: Del, D: n, K: k})
+			}
+		}
+	}
+	return ops
+}
+
+func (s *InMem) Outdated() ([]Op, error) {
+	var ops []Op
+	for n, d := range s.Dicts {
+		for k, v := range d.Dict {
+			nv, ok, err := upgradeValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("cannot upgrade %v/%v: %v", n, k, err)
+			}
+			if ok {
+				ops = append(ops, Op{T: Put, D: n, K: k, V: nv, E: d.Expiry[k]})
+			}
+		}
+	}
+	return ops, nil
+}
+
+func (s *InMem) Empty() bool {
+	for _, d := range s.Dicts {
+		if len(d.Dict) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size returns the number of bytes used by the keys and the values. Expired
+// keys are accounted for until they are removed. The size of each dictionary
+// is updated on put and delete, so Size does not iterate over the keys.
+func (s *InMem) Size() int {
+	size := 0
+	for _, d := range s.Dicts {
+		size += d.size
+	}
+	return size
+}
+
+// DictSize returns the number of bytes used by the keys and the values of
+// dictionary name.
+func (s *InMem) DictSize(name string) int {
+	d, ok := s.Dicts[name]
+	if !ok {
+		return 0
+	}
+	return d.size
+}
+
 type inMemDict struct {
 	DictName string
 	Dict     map[string][]byte
+	Expiry   map[string]time.Time // Expiry of the keys stored with a TTL.
+
+	indexes map[string]*index
+	size    int // bytes used by the keys and the values of the dictionary.
 }
 
 func (d inMemDict) Name() string {
@@ -57,24 +172,119 @@ func (d inMemDict) Name() string {
 
 func (d *inMemDict) Get(k string) ([]byte, error) {
 	v, ok := d.Dict[k]
-	if !ok {
-		return v, fmt.Errorf("%v does not exist", k)
+	if !ok || d.expired(k, time.Now()) {
+		return nil, fmt.Errorf("%v does not exist", k)
 	}
 	return v, nil
 }
 
 func (d *inMemDict) Put(k string, v []byte) error {
-	d.Dict[k] = v
+	d.set(k, v)
+	delete(d.Expiry, k)
+	return nil
+}
+
+func (d *inMemDict) PutTTL(k string, v []byte, ttl time.Duration) error {
+	return d.putExpiring(k, v, time.Now().Add(ttl))
+}
+
+func (d *inMemDict) putExpiring(k string, v []byte, exp time.Time) error {
+	d.set(k, v)
+	if d.Expiry == nil {
+		d.Expiry = make(map[string]time.Time)
+	}
+	d.Expiry[k] = exp
 	return nil
 }
 
+func (d *inMemDict) ExpiresAt(k string) (time.Time, bool) {
+	if _, err := d.Get(k); err != nil {
+		return time.Time{}, false
+	}
+	exp, ok := d.Expiry[k]
+	return exp, ok
+}
+
+func (d *inMemDict) expired(k string, now time.Time) bool {
+	exp, ok := d.Expiry[k]
+	return ok && !exp.After(now)
+}
+
+// set stores v for k and updates the indexes of the dictionary.
+func (d *inMemDict) set(k string, v []byte) {
+	old, ok := d.Dict[k]
+	for _, i := range d.indexes {
+		if ok {
+			i.del(k, old)
+		}
+		i.add(k, v)
+	}
+	if ok {
+		d.size -= len(k) + len(old)
+	}
+	d.size += len(k) + len(v)
+	d.Dict[k] = v
+}
+
 func (d *inMemDict) Del(k string) error {
+	if v, ok := d.Dict[k]; ok {
+		for _, i := range d.indexes {
+			i.del(k, v)
+		}
+		d.size -= len(k) + len(v)
+	}
 	delete(d.Dict, k)
+	delete(d.Expiry, k)
 	return nil
 }
 
+// update applies o on the value of k, keeping the expiry of k.
+func (d *inMemDict) update(o Op) error {
+	v, err := d.Get(o.K)
+	exists := err == nil
+	nv, _, err := o.Result(v, exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return d.Put(o.K, nv)
+	}
+	d.set(o.K, nv)
+	return nil
+}
+
+func (d *inMemDict) Add(k string, delta int64) (int64, error) {
+	if err := d.update(Op{T: Add, K: k, V: EncodeInt(delta)}); err != nil {
+		return 0, err
+	}
+	return DecodeInt(d.Dict[k])
+}
+
+func (d *inMemDict) Append(k string, v []byte) error {
+	return d.update(Op{T: Append, K: k, V: v})
+}
+
+func (d *inMemDict) PutIfAbsent(k string, v []byte) (bool, error) {
+	if _, err := d.Get(k); err == nil {
+		return false, nil
+	}
+	return true, d.Put(k, v)
+}
+
+func (d *inMemDict) CompareAndSwap(k string, old, v []byte) (bool, error) {
+	cur, err := d.Get(k)
+	if err != nil || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	return true, d.Put(k, v)
+}
+
 func (d *inMemDict) ForEach(f IterFn) {
+	now := time.Now()
 	for k, v := range d.Dict {
+		if d.expired(k, now) {
+			continue
+		}
 		f(k, v)
 	}
 }
@@ -86,3 +296,44 @@ func (d *inMemDict) GetGob(k string, v interface{}) error {
 func (d *inMemDict) PutGob(k string, v interface{}) error {
 	return PutGob(d, k, v)
 }
+
+func (d *inMemDict) PutGobTTL(k string, v interface{},
+	ttl time.Duration) error {
+
+	return PutGobTTL(d, k, v, ttl)
+}
+
+func (d *inMemDict) addIndex(name string, f IndexFn) {
+	i := newIndex(f)
+	for k, v := range d.Dict {
+		i.add(k, v)
+	}
+	if d.indexes == nil {
+		d.indexes = make(map[string]*index)
+	}
+	d.indexes[name] = i
+}
+
+func (d *inMemDict) indexFn(name string) (IndexFn, bool) {
+	i, ok := d.indexes[name]
+	if !ok {
+		return nil, false
+	}
+	return i.fn, true
+}
+
+func (d *inMemDict) Lookup(index, ik string) ([]string, error) {
+	i, ok := d.indexes[index]
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	now := time.Now()
+	var keys []string
+	for k := range i.keys[ik] {
+		if !d.expired(k, now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -3,6 +3,7 @@ package state
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 func testInMemTx(t *testing.T, abort bool) {
@@ -164,3 +165,83 @@ func TestInMemNoTx(t *testing.T) {
 		t.Error("value fount for deleted key")
 	}
 }
+
+func TestInMemTTL(t *testing.T) {
+	d := "d"
+	inm := NewInMem()
+	PutTTL(inm.Dict(d), "k1", []byte("v1"), -time.Second)
+	PutTTL(inm.Dict(d), "k2", []byte("v2"), time.Hour)
+	inm.Dict(d).Put("k3", []byte("v3"))
+
+	if _, err := inm.Dict(d).Get("k1"); err == nil {
+		t.Error("expired key is visible")
+	}
+	if v, err := inm.Dict(d).Get("k2"); err != nil || string(v) != "v2" {
+		t.Errorf("invalid value: actual=%s want=v2 (err=%v)", v, err)
+	}
+	n := 0
+	inm.Dict(d).ForEach(func(k string, v []byte) { n++ })
+	if n != 2 {
+		t.Errorf("invalid number of keys: actual=%v want=2", n)
+	}
+
+	ops := inm.Expired(time.Now())
+	if len(ops) != 1 || ops[0].T != Del || ops[0].K != "k1" {
+		t.Errorf("invalid expired ops: %v", ops)
+	}
+
+	// Put without TTL removes the expiry.
+	inm.Dict(d).Put("k2", []byte("v2"))
+	if ops := inm.Expired(time.Now().Add(2 * time.Hour)); len(ops) != 1 {
+		t.Errorf("invalid expired ops: %v", ops)
+	}
+}
+
+func TestTxTTL(t *testing.T) {
+	d := "d"
+	inm := NewInMem()
+	state := NewTransactional(inm)
+	state.BeginTx()
+	PutTTL(state.Dict(d), "k", []byte("v"), time.Hour)
+	ops := state.TxOps()
+	if len(ops) != 1 || ops[0].E.IsZero() {
+		t.Fatalf("invalid tx ops: %v", ops)
+	}
+	state.CommitTx()
+
+	exp := ops[0].E
+	if got := inm.Dicts[d].Expiry["k"]; !got.Equal(exp) {
+		t.Errorf("invalid expiry: actual=%v want=%v", got, exp)
+	}
+	if got, ok := ExpiresAt(inm.Dict(d), "k"); !ok || !got.Equal(exp) {
+		t.Errorf("invalid expiry: actual=%v want=%v", got, exp)
+	}
+
+	// Append keeps the expiry and Put removes it.
+	state.BeginTx()
+	state.Dict(d).(AtomicDict).Append("k", []byte("v"))
+	if got, ok := ExpiresAt(state.Dict(d), "k"); !ok || !got.Equal(exp) {
+		t.Errorf("invalid expiry after append: actual=%v want=%v", got, exp)
+	}
+	state.Dict(d).Put("k", []byte("v"))
+	if _, ok := ExpiresAt(state.Dict(d), "k"); ok {
+		t.Error("put keeps the expiry")
+	}
+	state.AbortTx()
+
+	// Replicas apply the same expiry time.
+	replica := NewInMem()
+	NewTransactional(replica).Apply(ops)
+	if got := replica.Dicts[d].Expiry["k"]; !got.Equal(exp) {
+		t.Errorf("invalid replicated expiry: actual=%v want=%v", got, exp)
+	}
+
+	state.BeginTx()
+	for _, o := range state.Expired(exp) {
+		state.Dict(o.D).Del(o.K)
+	}
+	state.CommitTx()
+	if !state.Empty() {
+		t.Error("state is not empty after removing the expired keys")
+	}
+}
@@ -1,19 +1,104 @@
 package state
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
 // OpType is the type of an operation in a transaction.
 type OpType int
 
 // Valid values for OpType.
 const (
-	Unknown OpType = iota
-	Put            = iota
-	Del            = iota
+	Unknown     OpType = iota
+	Put                = iota
+	Del                = iota
+	Add                = iota // Adds the integer in V to the integer of the key.
+	Append             = iota // Appends V to the value of the key.
+	PutIfAbsent        = iota // Puts V if the key does not exist.
+	CAS                = iota // Puts V if the value of the key is P.
+)
+
+var (
+	// ErrNotInt is returned when the value of a key is not an integer.
+	ErrNotInt = errors.New("value is not an integer")
+	// ErrPrecondition is returned when the precondition of a PutIfAbsent or a
+	// CAS operation does not hold.
+	ErrPrecondition = errors.New("precondition does not hold")
 )
 
 // Op is a state operation in a transaction.
 type Op struct {
 	T OpType
-	D string // Dictionary.
-	K string // Key.
-	V []byte // Value.
+	D string    // Dictionary.
+	K string    // Key.
+	V []byte    // Value.
+	E time.Time // Expiry of the key for Put, zero if the key never expires.
+	P []byte    // Expected value of the key for CAS.
+}
+
+func (o Op) expired(now time.Time) bool {
+	return !o.E.IsZero() && !o.E.After(now)
+}
+
+// Result returns the value of the key after applying o on v, and whether the
+// key exists. exists is whether the key exists before applying o. Result
+// returns ErrPrecondition if o is a conditional operation that does not hold
+// for v, and ErrNotInt if o is an Add and v is not an integer.
+func (o Op) Result(v []byte, exists bool) ([]byte, bool, error) {
+	switch o.T {
+	case Put:
+		return o.V, true, nil
+	case Del:
+		return nil, false, nil
+	case Add:
+		i, err := intValue(v, exists)
+		if err != nil {
+			return nil, false, err
+		}
+		d, err := DecodeInt(o.V)
+		if err != nil {
+			return nil, false, err
+		}
+		return EncodeInt(i + d), true, nil
+	case Append:
+		nv := make([]byte, 0, len(v)+len(o.V))
+		return append(append(nv, v...), o.V...), true, nil
+	case PutIfAbsent:
+		if exists {
+			return nil, false, ErrPrecondition
+		}
+		return o.V, true, nil
+	case CAS:
+		if !exists || !bytes.Equal(v, o.P) {
+			return nil, false, ErrPrecondition
+		}
+		return o.V, true, nil
+	}
+	return nil, false, errors.New("unknown operation")
+}
+
+// EncodeInt encodes i as stored by Add.
+func EncodeInt(i int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
+
+// DecodeInt decodes an integer stored by Add.
+func DecodeInt(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, ErrNotInt
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+// intValue returns the integer of a key with value v. Missing keys are 0.
+func intValue(v []byte, exists bool) (int64, error) {
+	if !exists {
+		return 0, nil
+	}
+	return DecodeInt(v)
 }
@@ -0,0 +1,238 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+)
+
+// Schema describes the versions of a type of values stored in dictionaries.
+// Values stored with PutVersioned are tagged with the name and the current
+// version of their schema. Values of older versions are upgraded when they are
+// read using GetVersioned, and are eventually rewritten to the current version
+// (see Upgrader).
+type Schema struct {
+	Name    string
+	Version int
+	// Upgrades[v] upgrades the gob encoding of a value of version v to a value
+	// of version v+1.
+	Upgrades map[int]UpgradeFn
+}
+
+// UpgradeFn upgrades a value of a version, given its gob encoding, to a value
+// of the next version.
+type UpgradeFn func(v []byte) (interface{}, error)
+
+// Upgrader is a state that can list its values with an outdated schema
+// version.
+type Upgrader interface {
+	// Outdated returns the operations that rewrite the values of outdated
+	// versions using the current versions of their schemas.
+	Outdated() ([]Op, error)
+}
+
+var (
+	ErrNoSchema      = errors.New("no such schema")
+	ErrNoUpgradePath = errors.New("no upgrade path")
+	ErrNotVersioned  = errors.New("value is not versioned")
+)
+
+// Versioned values are encoded as versionMagic, the CRC-32 checksum of the
+// rest of the value, the length and the name of the schema, the version, and
+// the gob encoding of the value. A value is versioned only if both its magic
+// and its checksum match, so that values stored with Put that happen to start
+// with versionMagic are not mistaken for versioned values.
+
+// versionMagic prefixes the values stored with a schema version.
+const versionMagic = "\xff\xfebhver"
+
+var schemas = struct {
+	sync.RWMutex
+	m map[string]Schema
+}{m: make(map[string]Schema)}
+
+// RegisterSchema registers s. Registering a schema with the name of an
+// existing schema replaces it.
+func RegisterSchema(s Schema) {
+	schemas.Lock()
+	defer schemas.Unlock()
+	schemas.m[s.Name] = s
+}
+
+func schema(name string) (Schema, error) {
+	schemas.RLock()
+	defer schemas.RUnlock()
+	s, ok := schemas.m[name]
+	if !ok {
+		return Schema{}, fmt.Errorf("%v: %v", ErrNoSchema, name)
+	}
+	return s, nil
+}
+
+// PutVersioned encodes v using gob and stores it for key k in d, tagged with
+// the current version of schema.
+func PutVersioned(d Dict, k string, schema string, v interface{}) error {
+	b, err := encodeVersioned(schema, v)
+	if err != nil {
+		return err
+	}
+	return d.Put(k, b)
+}
+
+// GetVersioned retrieves the value stored for key k in d, upgrades it to the
+// current version of schema and decodes it into v.
+func GetVersioned(d Dict, k string, schema string, v interface{}) error {
+	b, err := d.Get(k)
+	if err != nil {
+		return err
+	}
+	name, ver, data, err := decodeVersioned(b)
+	if err != nil {
+		return err
+	}
+	if name != schema {
+		return fmt.Errorf("%v is of schema %v not %v", k, name, schema)
+	}
+	if data, _, err = upgrade(name, ver, data); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+func encodeVersioned(name string, v interface{}) ([]byte, error) {
+	s, err := schema(name)
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(v); err != nil {
+		return nil, err
+	}
+	return versioned(name, s.Version, data.Bytes()), nil
+}
+
+// versioned returns the gob encoded data tagged with schema name and version
+// ver.
+func versioned(name string, ver int, data []byte) []byte {
+	hdr := make([]byte, 2*binary.MaxVarintLen64)
+	var buf bytes.Buffer
+	buf.Write(hdr[:binary.PutUvarint(hdr, uint64(len(name)))])
+	buf.WriteString(name)
+	buf.Write(hdr[:binary.PutUvarint(hdr, uint64(ver))])
+	buf.Write(data)
+
+	sum := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(buf.Bytes()))
+	b := append([]byte(versionMagic), sum...)
+	return append(b, buf.Bytes()...)
+}
+
+// isVersioned returns whether b is stored with a schema version.
+func isVersioned(b []byte) bool {
+	n := len(versionMagic) + crc32.Size
+	if len(b) < n || !bytes.HasPrefix(b, []byte(versionMagic)) {
+		return false
+	}
+	sum := binary.BigEndian.Uint32(b[len(versionMagic):n])
+	return crc32.ChecksumIEEE(b[n:]) == sum
+}
+
+func decodeVersioned(b []byte) (name string, ver int, data []byte, err error) {
+	if !isVersioned(b) {
+		return "", 0, nil, ErrNotVersioned
+	}
+	buf := bytes.NewBuffer(b[len(versionMagic)+crc32.Size:])
+	l, err := binary.ReadUvarint(buf)
+	if err != nil || uint64(buf.Len()) < l {
+		return "", 0, nil, ErrNotVersioned
+	}
+	name = string(buf.Next(int(l)))
+	v, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return "", 0, nil, ErrNotVersioned
+	}
+	return name, int(v), buf.Bytes(), nil
+}
+
+// checkVersion returns an error if there is no upgrade path from version ver
+// to the current version of schema name.
+func checkVersion(name string, ver int) error {
+	s, err := schema(name)
+	if err != nil {
+		return err
+	}
+	if ver > s.Version {
+		return fmt.Errorf("%v: %v v%v is newer than v%v", ErrNoUpgradePath, name,
+			ver, s.Version)
+	}
+	for ; ver < s.Version; ver++ {
+		if _, ok := s.Upgrades[ver]; !ok {
+			return fmt.Errorf("%v: %v v%v", ErrNoUpgradePath, name, ver)
+		}
+	}
+	return nil
+}
+
+// upgrade upgrades the gob encoded data of version ver to the current version
+// of schema name. It returns whether the data is upgraded.
+func upgrade(name string, ver int, data []byte) ([]byte, bool, error) {
+	if err := checkVersion(name, ver); err != nil {
+		return nil, false, err
+	}
+	s, _ := schema(name)
+	for v := ver; v < s.Version; v++ {
+		nv, err := s.Upgrades[v](data)
+		if err != nil {
+			return nil, false, err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(nv); err != nil {
+			return nil, false, err
+		}
+		data = buf.Bytes()
+	}
+	return data, ver != s.Version, nil
+}
+
+// checkValue returns an error if b is versioned and has no upgrade path.
+// Values that are not stored by PutVersioned are never checked.
+func checkValue(b []byte) error {
+	name, ver, _, err := decodeVersioned(b)
+	if err != nil {
+		return nil
+	}
+	return checkVersion(name, ver)
+}
+
+// CheckOps returns an error if ops write a value of a schema version with no
+// upgrade path.
+func CheckOps(ops []Op) error {
+	for _, o := range ops {
+		if err := checkValue(o.V); err != nil {
+			return fmt.Errorf("invalid value for %v/%v: %v", o.D, o.K, err)
+		}
+	}
+	return nil
+}
+
+// upgradeValue returns b upgraded to the current version of its schema, and
+// whether it is upgraded.
+func upgradeValue(b []byte) ([]byte, bool, error) {
+	if !isVersioned(b) {
+		return b, false, nil
+	}
+	name, ver, data, err := decodeVersioned(b)
+	if err != nil {
+		return nil, false, err
+	}
+	data, ok, err := upgrade(name, ver, data)
+	if err != nil || !ok {
+		return b, false, err
+	}
+	s, _ := schema(name)
+	return versioned(name, s.Version, data), true, nil
+}
@@ -0,0 +1,115 @@
+package state
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+type sessionV1 struct {
+	User string
+}
+
+type sessionV2 struct {
+	User string
+	TTL  int
+}
+
+func registerSessionSchema(ver int) {
+	RegisterSchema(Schema{
+		Name:    "session",
+		Version: ver,
+		Upgrades: map[int]UpgradeFn{
+			1: func(b []byte) (interface{}, error) {
+				var s sessionV1
+				if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&s); err != nil {
+					return nil, err
+				}
+				return sessionV2{User: s.User, TTL: 60}, nil
+			},
+		},
+	})
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	registerSessionSchema(1)
+	s := NewInMem()
+	d := s.Dict("sessions")
+	if err := PutVersioned(d, "s1", "session", sessionV1{User: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if ops, err := s.Outdated(); err != nil || len(ops) != 0 {
+		t.Errorf("invalid outdated values: %v, %v", ops, err)
+	}
+
+	registerSessionSchema(2)
+	var v2 sessionV2
+	if err := GetVersioned(d, "s1", "session", &v2); err != nil {
+		t.Fatal(err)
+	}
+	if v2.User != "u1" || v2.TTL != 60 {
+		t.Errorf("invalid upgraded value: %+v", v2)
+	}
+
+	ops, err := s.Outdated()
+	if err != nil || len(ops) != 1 {
+		t.Fatalf("invalid outdated values: %v, %v", ops, err)
+	}
+	d.Put(ops[0].K, ops[0].V)
+	if ops, err := s.Outdated(); err != nil || len(ops) != 0 {
+		t.Errorf("value is not rewritten: %v, %v", ops, err)
+	}
+	v2 = sessionV2{}
+	if err := GetVersioned(d, "s1", "session", &v2); err != nil || v2.TTL != 60 {
+		t.Errorf("invalid rewritten value: %+v, %v", v2, err)
+	}
+}
+
+func TestSchemaNoUpgradePath(t *testing.T) {
+	RegisterSchema(Schema{Name: "account", Version: 1})
+	s := NewInMem()
+	PutVersioned(s.Dict("accounts"), "a1", "account", 1)
+	b, err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterSchema(Schema{Name: "account", Version: 2})
+	r := NewInMem()
+	r.Dict("accounts").Put("a0", []byte("v"))
+	if err := r.Restore(b); err == nil {
+		t.Error("restored a value with no upgrade path")
+	}
+	if v, err := r.Dict("accounts").Get("a0"); err != nil || string(v) != "v" {
+		t.Errorf("failed restore modifies the state: %q, %v", v, err)
+	}
+	if _, err := r.Dict("accounts").Get("a1"); err == nil {
+		t.Error("failed restore partially restores the state")
+	}
+	var v int
+	if err := GetVersioned(s.Dict("accounts"), "a1", "account",
+		&v); err == nil {
+		t.Error("read a value with no upgrade path")
+	}
+}
+
+func TestSchemaRawValueWithMagic(t *testing.T) {
+	s := NewInMem()
+	raw := append([]byte(versionMagic), "\x00\x00\x00\x00\x07unknown\x01"...)
+	s.Dict("raw").Put("k", raw)
+	if err := CheckOps([]Op{{T: Put, D: "raw", K: "k", V: raw}}); err != nil {
+		t.Errorf("raw value is checked as a versioned value: %v", err)
+	}
+	b, err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewInMem().Restore(b); err != nil {
+		t.Errorf("cannot restore a raw value with the version magic: %v", err)
+	}
+	var v int
+	if err := GetVersioned(s.Dict("raw"), "k", "unknown",
+		&v); err != ErrNotVersioned {
+		t.Errorf("invalid error for a raw value: %v", err)
+	}
+}
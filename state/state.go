@@ -1,5 +1,7 @@
 package state
 
+import "time"
+
 // State is a collection of dictionaries.
 type State interface {
 	// Returns a dictionary for this state. Creates one if it does not exist.
@@ -9,3 +11,17 @@ type State interface {
 	// Restore restores the state from b.
 	Restore(b []byte) error
 }
+
+// Expirer is a state that can list its expired keys.
+type Expirer interface {
+	// Expired returns the operations that delete the keys expired at now.
+	Expired(now time.Time) []Op
+	// Empty returns whether there is no key in the state.
+	Empty() bool
+}
+
+// Lister is a state that can list its dictionaries.
+type Lister interface {
+	// DictNames returns the sorted names of the dictionaries in the state.
+	DictNames() []string
+}
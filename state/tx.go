@@ -1,8 +1,10 @@
 package state
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 )
@@ -17,8 +19,9 @@ const (
 )
 
 var (
-	ErrOpenTx error = errors.New("transaction is already open")
-	ErrNoTx   error = errors.New("no open transaction")
+	ErrOpenTx      error = errors.New("transaction is already open")
+	ErrNoTx        error = errors.New("no open transaction")
+	ErrNoSavepoint error = errors.New("no such savepoint")
 )
 
 // Tx represents the side effects of an operation: messages emitted during the
@@ -62,9 +65,16 @@ func NewTransactional(s State) *Transactional {
 
 // Transactional wraps any state dictionary and makes it transactional.
 type Transactional struct {
-	State  State
-	stage  map[string]*TxDict
-	status TxStatus
+	State      State
+	stage      map[string]*TxDict
+	status     TxStatus
+	savepoints []savepoint
+}
+
+// savepoint is a named snapshot of the staged operations of a transaction.
+type savepoint struct {
+	name string
+	ops  map[string]map[string]Op // staged operations of each dictionary.
 }
 
 func (t *Transactional) TxStatus() TxStatus {
@@ -135,6 +145,7 @@ func (t *Transactional) AbortTx() error {
 
 func (t *Transactional) Reset() {
 	t.status = TxNone
+	t.savepoints = nil
 	if len(t.stage) == 0 {
 		return
 	}
@@ -143,25 +154,200 @@ func (t *Transactional) Reset() {
 	}
 }
 
+// Savepoint marks the operations staged so far in the open transaction as
+// savepoint name. If there are multiple savepoints with the same name, the most
+// recent one is used.
+func (t *Transactional) Savepoint(name string) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	sp := savepoint{
+		name: name,
+		ops:  make(map[string]map[string]Op, len(t.stage)),
+	}
+	for n, d := range t.stage {
+		sp.ops[n] = d.savepoint()
+	}
+	t.savepoints = append(t.savepoints, sp)
+	return nil
+}
+
+// RollbackTo discards the operations staged after savepoint name, and releases
+// the savepoints created after it. The savepoint itself is kept.
+func (t *Transactional) RollbackTo(name string) error {
+	i := t.savepointIndex(name)
+	if i < 0 {
+		return ErrNoSavepoint
+	}
+	sp := t.savepoints[i]
+	for n, d := range t.stage {
+		d.rollback(sp.ops[n])
+	}
+	t.savepoints = t.savepoints[:i+1]
+	return nil
+}
+
+// ReleaseSavepoint removes savepoint name and the savepoints created after it,
+// keeping the staged operations.
+func (t *Transactional) ReleaseSavepoint(name string) error {
+	i := t.savepointIndex(name)
+	if i < 0 {
+		return ErrNoSavepoint
+	}
+	t.savepoints = t.savepoints[:i]
+	return nil
+}
+
+func (t *Transactional) savepointIndex(name string) int {
+	if t.status != TxOpen {
+		return -1
+	}
+	for i := len(t.savepoints) - 1; i >= 0; i-- {
+		if t.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
 func (t *Transactional) HasEmptyTx() bool {
 	return len(t.stage) == 0
 }
 
+// Apply applies ops on the state. The operations are applied atomically:
+// Apply checks the preconditions of all operations first, and applies none of
+// them if one fails.
 func (t *Transactional) Apply(ops []Op) error {
 	if t.status == TxOpen {
 		return ErrOpenTx
 	}
+	if err := t.check(ops); err != nil {
+		return err
+	}
+	for _, o := range ops {
+		if err := applyOp(t.Dict(o.D), o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns the error of the first operation in ops that cannot be applied
+// on the state, without modifying the state.
+func (t *Transactional) check(ops []Op) error {
+	type dictKey struct{ d, k string }
+	type value struct {
+		v      []byte
+		exists bool
+	}
+	vals := make(map[dictKey]value)
 	for _, o := range ops {
-		switch o.T {
-		case Put:
-			t.Dict(o.D).Put(o.K, o.V)
-		case Del:
-			t.Dict(o.D).Del(o.K)
+		dk := dictKey{o.D, o.K}
+		val, ok := vals[dk]
+		if !ok {
+			v, err := t.Dict(o.D).Get(o.K)
+			val = value{v, err == nil}
 		}
+		v, exists, err := o.Result(val.v, val.exists)
+		if err != nil {
+			glog.V(2).Infof("cannot apply %v on %v: %v", o.K, o.D, err)
+			return err
+		}
+		vals[dk] = value{v, exists}
 	}
 	return nil
 }
 
+// Expired returns the operations that delete the keys expired at now, if the
+// underlying state is an Expirer.
+func (t *Transactional) Expired(now time.Time) []Op {
+	e, ok := t.State.(Expirer)
+	if !ok {
+		return nil
+	}
+	return e.Expired(now)
+}
+
+// Outdated returns the operations that rewrite the outdated values of the
+// underlying state, if it is an Upgrader.
+func (t *Transactional) Outdated() ([]Op, error) {
+	u, ok := t.State.(Upgrader)
+	if !ok {
+		return nil, nil
+	}
+	return u.Outdated()
+}
+
+// DictNames returns the sorted names of the dictionaries of the underlying
+// state, if it is a Lister.
+func (t *Transactional) DictNames() []string {
+	l, ok := t.State.(Lister)
+	if !ok {
+		return nil
+	}
+	return l.DictNames()
+}
+
+// Empty returns whether there is no key in the underlying state. It returns
+// false if the underlying state is not an Expirer.
+func (t *Transactional) Empty() bool {
+	e, ok := t.State.(Expirer)
+	if !ok {
+		return false
+	}
+	return e.Empty()
+}
+
+// Size returns the number of bytes used by the keys and the values of the
+// state, as seen in the open transaction. It returns 0 if the underlying state
+// cannot report its size. The staged operations are accounted for as they are
+// staged, so Size does not iterate over the state or the transaction.
+func (t *Transactional) Size() int {
+	s, ok := t.State.(interface {
+		Size() int
+	})
+	if !ok {
+		return 0
+	}
+
+	size := s.Size()
+	if t.status != TxOpen {
+		return size
+	}
+	for _, d := range t.stage {
+		size += d.delta
+	}
+	return size
+}
+
+// DictSize returns the size of dictionary name, as seen in the open
+// transaction. It returns 0 if the underlying state cannot report the size of
+// its dictionaries.
+func (t *Transactional) DictSize(name string) int {
+	s, ok := t.State.(interface {
+		DictSize(name string) int
+	})
+	if !ok {
+		return 0
+	}
+
+	size := s.DictSize(name)
+	if d, ok := t.stage[name]; ok && t.status == TxOpen {
+		size += d.delta
+	}
+	return size
+}
+
+// AddIndex adds index name on dictionary dict of the underlying state, if it
+// is an Indexer.
+func (t *Transactional) AddIndex(dict, name string, f IndexFn) error {
+	i, ok := t.State.(Indexer)
+	if !ok {
+		return errors.New("state does not support indexes")
+	}
+	return i.AddIndex(dict, name, f)
+}
+
 func (t *Transactional) Save() ([]byte, error) {
 	if t.status == TxOpen {
 		glog.Warningf("transactional has an open tx when the snapshot is taken")
@@ -200,6 +386,8 @@ type TxDict struct {
 	Dict   Dict
 	Status TxStatus
 	Ops    map[string]Op
+
+	delta int // change in the size of Dict made by Ops.
 }
 
 func (d *TxDict) Name() string {
@@ -207,54 +395,208 @@ func (d *TxDict) Name() string {
 }
 
 func (d *TxDict) Put(k string, v []byte) error {
-	d.Ops[k] = Op{
+	d.stage(Op{
 		T: Put,
 		D: d.Dict.Name(),
 		K: k,
 		V: v,
-	}
+	})
+	return nil
+}
+
+func (d *TxDict) PutTTL(k string, v []byte, ttl time.Duration) error {
+	d.stage(Op{
+		T: Put,
+		D: d.Dict.Name(),
+		K: k,
+		V: v,
+		E: time.Now().Add(ttl),
+	})
 	return nil
 }
 
 func (d *TxDict) Get(k string) ([]byte, error) {
 	op, ok := d.Ops[k]
 	if ok {
-		switch op.T {
-		case Put:
-			return op.V, nil
-		case Del:
+		v, ok := staged(d.Dict, op, time.Now())
+		if !ok {
 			return nil, errors.New("No such key")
 		}
+		return v, nil
 	}
 	return d.Dict.Get(k)
 }
 
+// staged returns the value of o.K in d after applying the staged operation o,
+// and whether the key exists.
+func staged(d Dict, o Op, now time.Time) ([]byte, bool) {
+	switch o.T {
+	case Put:
+		return o.V, !o.expired(now)
+	case Del:
+		return nil, false
+	}
+	v, err := d.Get(o.K)
+	exists := err == nil
+	nv, ok, err := o.Result(v, exists)
+	if err != nil {
+		return v, exists
+	}
+	return nv, ok
+}
+
 func (d *TxDict) Del(k string) error {
-	d.Ops[k] = Op{
+	d.stage(Op{
 		T: Del,
 		D: d.Dict.Name(),
 		K: k,
-	}
+	})
 	return nil
 }
 
 func (d *TxDict) ForEach(f IterFn) {
+	now := time.Now()
 	d.Dict.ForEach(func(k string, v []byte) {
 		op, ok := d.Ops[k]
 		if ok {
-			switch op.T {
-			case Put:
-				f(op.K, op.V)
-				return
-			case Del:
-				return
+			if v, ok := staged(d.Dict, op, now); ok {
+				f(op.K, v)
 			}
+			return
 		}
 
 		f(k, v)
 	})
 }
 
+// Add stages an Add operation, unless there is a staged operation for k other
+// than Add. In that case, it stages a Put with the new integer.
+func (d *TxDict) Add(k string, delta int64) (int64, error) {
+	v, err := d.Get(k)
+	i, err := intValue(v, err == nil)
+	if err != nil {
+		return 0, err
+	}
+	i += delta
+
+	op, ok := d.Ops[k]
+	switch {
+	case !ok:
+		op = Op{T: Add, D: d.Dict.Name(), K: k, V: EncodeInt(delta)}
+	case op.T == Add:
+		od, _ := DecodeInt(op.V)
+		op.V = EncodeInt(od + delta)
+	default:
+		op = d.putOp(op, k, EncodeInt(i))
+	}
+	d.stage(op)
+	return i, nil
+}
+
+// Append stages an Append operation, unless there is a staged operation for k
+// other than Append. In that case, it stages a Put with the new value.
+func (d *TxDict) Append(k string, v []byte) error {
+	op, ok := d.Ops[k]
+	switch {
+	case !ok:
+		op = Op{T: Append, D: d.Dict.Name(), K: k, V: v}
+	case op.T == Append:
+		op.V = append(append([]byte{}, op.V...), v...)
+	default:
+		cur, _ := d.Get(k)
+		op = d.putOp(op, k, append(append([]byte{}, cur...), v...))
+	}
+	d.stage(op)
+	return nil
+}
+
+// PutIfAbsent stages a PutIfAbsent operation if k does not exist in the
+// transaction.
+func (d *TxDict) PutIfAbsent(k string, v []byte) (bool, error) {
+	if _, err := d.Get(k); err == nil {
+		return false, nil
+	}
+	op := Op{T: PutIfAbsent, D: d.Dict.Name(), K: k, V: v}
+	if _, ok := d.Ops[k]; ok {
+		op.T = Put
+	}
+	d.stage(op)
+	return true, nil
+}
+
+// CompareAndSwap stages a CAS operation if the value of k is old in the
+// transaction.
+func (d *TxDict) CompareAndSwap(k string, old, v []byte) (bool, error) {
+	cur, err := d.Get(k)
+	if err != nil || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	op := Op{T: CAS, D: d.Dict.Name(), K: k, V: v, P: old}
+	if _, ok := d.Ops[k]; ok {
+		op = Op{T: Put, D: d.Dict.Name(), K: k, V: v}
+	}
+	d.stage(op)
+	return true, nil
+}
+
+// stage stages o for o.K, replacing the staged operation of o.K if any.
+func (d *TxDict) stage(o Op) {
+	d.delta -= d.stagedSize(o.K)
+	d.Ops[o.K] = o
+	d.delta += d.stagedSize(o.K)
+}
+
+// stagedSize returns the number of bytes used by k and its value in the
+// transaction.
+func (d *TxDict) stagedSize(k string) int {
+	v, err := d.Get(k)
+	if err != nil {
+		return 0
+	}
+	return len(k) + len(v)
+}
+
+// putOp returns a Put operation that replaces the staged operation op of k,
+// keeping the expiry of a staged Put.
+func (d *TxDict) putOp(op Op, k string, v []byte) Op {
+	p := Op{T: Put, D: d.Dict.Name(), K: k, V: v}
+	if op.T == Put && !op.expired(time.Now()) {
+		p.E = op.E
+	}
+	return p
+}
+
+// ExpiresAt returns the expiry of k in the transaction. Add and Append keep
+// the expiry of k, and the other operations replace it.
+func (d *TxDict) ExpiresAt(k string) (time.Time, bool) {
+	op, ok := d.Ops[k]
+	if !ok {
+		return ExpiresAt(d.Dict, k)
+	}
+	if _, err := d.Get(k); err != nil {
+		return time.Time{}, false
+	}
+	switch op.T {
+	case Put:
+		return op.E, !op.E.IsZero()
+	case Add, Append:
+		return ExpiresAt(d.Dict, k)
+	}
+	return time.Time{}, false
+}
+
+func (d *TxDict) Lookup(index, ik string) ([]string, error) {
+	return lookupTx(d.Dict, d.Ops, index, ik)
+}
+
+func (d *TxDict) indexFn(name string) (IndexFn, bool) {
+	id, ok := d.Dict.(indexedDict)
+	if !ok {
+		return nil, false
+	}
+	return id.indexFn(name)
+}
+
 func (d *TxDict) GetGob(k string, v interface{}) error {
 	return GetGob(d, k, v)
 }
@@ -263,6 +605,10 @@ func (d *TxDict) PutGob(k string, v interface{}) error {
 	return PutGob(d, k, v)
 }
 
+func (d *TxDict) PutGobTTL(k string, v interface{}, ttl time.Duration) error {
+	return PutGobTTL(d, k, v, ttl)
+}
+
 func (d *TxDict) BeginTx() error {
 	if d.Status == TxOpen {
 		return ErrOpenTx
@@ -275,12 +621,15 @@ func (d *TxDict) CommitTx() error {
 	if d.Status == TxNone {
 		return ErrNoTx
 	}
+	// The preconditions of the operations are checked when they are staged, and
+	// the dictionary is not modified while the transaction is open: the bee
+	// owning the dictionary is the only writer, and distributed transactions
+	// refuse to stage conflicting operations. The only exception is a key
+	// expiring while the transaction is open, in which case the operation on
+	// that key is dropped and the rest of the transaction is committed.
 	for _, o := range d.Ops {
-		switch o.T {
-		case Put:
-			d.Dict.Put(o.K, o.V)
-		case Del:
-			d.Dict.Del(o.K)
+		if err := applyOp(d.Dict, o); err != nil {
+			glog.Errorf("cannot apply %v on %v: %v", o.K, o.D, err)
 		}
 	}
 	d.reset()
@@ -295,8 +644,27 @@ func (d *TxDict) AbortTx() error {
 	return nil
 }
 
+// savepoint returns a copy of the operations staged in the dictionary.
+func (d *TxDict) savepoint() map[string]Op {
+	ops := make(map[string]Op, len(d.Ops))
+	for k, o := range d.Ops {
+		ops[k] = o
+	}
+	return ops
+}
+
+// rollback replaces the operations staged in the dictionary with ops.
+func (d *TxDict) rollback(ops map[string]Op) {
+	d.Ops = make(map[string]Op, len(ops))
+	d.delta = 0
+	for _, o := range ops {
+		d.stage(o)
+	}
+}
+
 func (d *TxDict) reset() {
 	d.Status = TxNone
+	d.delta = 0
 	if len(d.Ops) == 0 {
 		return
 	}
@@ -54,6 +54,135 @@ func TestLayeredTxCommit(t *testing.T) {
 	testTx(t, inm, tx1, true)
 }
 
+func TestTxSavepoint(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	if err := tx.Savepoint("s1"); err != ErrNoTx {
+		t.Errorf("invalid error for savepoint with no tx: %v", err)
+	}
+
+	tx.BeginTx()
+	tx.Dict("d1").Put("k1", []byte("v1"))
+	tx.Savepoint("s1")
+	tx.Dict("d1").Put("k1", []byte("v2"))
+	tx.Dict("d2").Put("k2", []byte("v2"))
+	tx.Savepoint("s2")
+	tx.Dict("d1").Del("k1")
+
+	if err := tx.RollbackTo("s1"); err != nil {
+		t.Fatalf("cannot rollback to s1: %v", err)
+	}
+	if v, err := tx.Dict("d1").Get("k1"); err != nil || string(v) != "v1" {
+		t.Errorf("invalid value after rollback: actual=%s want=v1", v)
+	}
+	if _, err := tx.Dict("d2").Get("k2"); err == nil {
+		t.Error("value is in the dictionary after rollback")
+	}
+	if err := tx.RollbackTo("s2"); err != ErrNoSavepoint {
+		t.Errorf("savepoint s2 is not released: %v", err)
+	}
+
+	tx.Dict("d1").Put("k3", []byte("v3"))
+	if err := tx.ReleaseSavepoint("s1"); err != nil {
+		t.Fatalf("cannot release s1: %v", err)
+	}
+	if err := tx.RollbackTo("s1"); err != ErrNoSavepoint {
+		t.Errorf("savepoint s1 is not released: %v", err)
+	}
+	if _, err := tx.Dict("d1").Get("k3"); err != nil {
+		t.Error("value is not in the dictionary after release")
+	}
+	if err := tx.CommitTx(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tx.State.Dict("d1").(*inMemDict).Dict); n != 2 {
+		t.Errorf("invalid number of keys after commit: actual=%v want=2", n)
+	}
+}
+
+func TestTxRichOps(t *testing.T) {
+	leader := NewTransactional(NewInMem())
+	leader.BeginTx()
+	d := leader.Dict("d")
+	PutInt(d, "existing", 1)
+	leader.CommitTx()
+
+	leader.BeginTx()
+	ad := leader.Dict("d").(AtomicDict)
+	ad.Add("counter", 2)
+	if i, err := ad.Add("counter", 3); err != nil || i != 5 {
+		t.Errorf("invalid counter: actual=%v want=5 (err=%v)", i, err)
+	}
+	ad.Add("existing", 1)
+	ad.Append("log", []byte("a"))
+	ad.Append("log", []byte("b"))
+	if ok, _ := ad.PutIfAbsent("existing", []byte("v")); ok {
+		t.Error("put if absent overwrites an existing key")
+	}
+	if ok, _ := ad.PutIfAbsent("absent", []byte("v")); !ok {
+		t.Error("put if absent does not put an absent key")
+	}
+	if ok, _ := ad.CompareAndSwap("absent", []byte("x"), []byte("w")); ok {
+		t.Error("cas swaps a key with a different value")
+	}
+	if ok, _ := ad.CompareAndSwap("absent", []byte("v"), []byte("w")); !ok {
+		t.Error("cas does not swap a key with the expected value")
+	}
+
+	ops := leader.TxOps()
+	for _, o := range ops {
+		if o.K == "counter" && (o.T != Add || len(o.V) != 8) {
+			t.Errorf("invalid op for the counter: %+v", o)
+		}
+	}
+	leader.CommitTx()
+
+	follower := NewTransactional(NewInMem())
+	follower.Apply([]Op{{T: Put, D: "d", K: "existing", V: EncodeInt(1)}})
+	follower.Apply(ops)
+	for _, s := range []State{leader, follower} {
+		d := s.Dict("d")
+		if i, err := GetInt(d, "counter"); err != nil || i != 5 {
+			t.Errorf("invalid counter: actual=%v want=5 (err=%v)", i, err)
+		}
+		if i, err := GetInt(d, "existing"); err != nil || i != 2 {
+			t.Errorf("invalid integer: actual=%v want=2 (err=%v)", i, err)
+		}
+		if v, _ := d.Get("log"); string(v) != "ab" {
+			t.Errorf("invalid appended value: actual=%s want=ab", v)
+		}
+		if v, _ := d.Get("absent"); string(v) != "w" {
+			t.Errorf("invalid swapped value: actual=%s want=w", v)
+		}
+	}
+
+	if _, err := follower.Dict("d").(AtomicDict).Add("log", 1); err != ErrNotInt {
+		t.Errorf("add on a non-integer value returns %v", err)
+	}
+}
+
+func TestTxApplyAtomic(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	ops := []Op{
+		{T: Put, D: "d", K: "k1", V: []byte("v1")},
+		{T: PutIfAbsent, D: "d", K: "k2", V: []byte("v2")},
+		{T: CAS, D: "d", K: "k2", P: []byte("x"), V: []byte("v3")},
+	}
+	if err := state.Apply(ops); err != ErrPrecondition {
+		t.Errorf("invalid error for a failed precondition: %v", err)
+	}
+	if _, err := state.Dict("d").Get("k1"); err == nil {
+		t.Error("apply applies operations when a precondition fails")
+	}
+
+	ops[2].P = []byte("v2")
+	if err := state.Apply(ops); err != nil {
+		t.Errorf("cannot apply ops: %v", err)
+	}
+	if v, _ := state.Dict("d").Get("k2"); string(v) != "v3" {
+		t.Errorf("invalid swapped value: actual=%s want=v3", v)
+	}
+}
+
 func BenchmarkTransactions(b *testing.B) {
 	inm := NewInMem()
 	tx := NewTransactional(inm)
@@ -66,3 +195,67 @@ func BenchmarkTransactions(b *testing.B) {
 		tx.CommitTx()
 	}
 }
+
+func TestTxSize(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	state.BeginTx()
+	state.Dict("d").Put("k1", []byte("v1"))
+	state.Dict("d").Put("k2", []byte("v2"))
+	state.CommitTx()
+	if s := state.Size(); s != 8 {
+		t.Errorf("invalid size: actual=%v want=8", s)
+	}
+
+	state.BeginTx()
+	state.Dict("d").Put("k1", []byte("value1"))
+	state.Dict("d").Del("k2")
+	state.Dict("d").Put("k3", []byte("v3"))
+	if s := state.Size(); s != 12 {
+		t.Errorf("invalid size in tx: actual=%v want=12", s)
+	}
+
+	// An L2 transaction on top of the open transaction.
+	l2 := NewTransactional(state)
+	l2.BeginTx()
+	l2.Dict("d").Del("k1")
+	if s := l2.Size(); s != 4 {
+		t.Errorf("invalid size in L2 tx: actual=%v want=4", s)
+	}
+}
+
+func TestTxSizeRollback(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	state.BeginTx()
+	state.Dict("d").Put("k1", []byte("v1"))
+	state.Savepoint("sp")
+	state.Dict("d").Put("k1", []byte("value1"))
+	state.Dict("d").(AtomicDict).Append("k2", []byte("v2"))
+	state.Dict("e").Put("k", []byte("v"))
+	if s := state.Size(); s != 14 {
+		t.Errorf("invalid size in tx: actual=%v want=14", s)
+	}
+	if s := state.DictSize("d"); s != 12 {
+		t.Errorf("invalid dict size in tx: actual=%v want=12", s)
+	}
+	state.RollbackTo("sp")
+	if s := state.Size(); s != 4 {
+		t.Errorf("invalid size after rollback: actual=%v want=4", s)
+	}
+	state.CommitTx()
+
+	b, err := state.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewInMem()
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if s := restored.Size(); s != 4 {
+		t.Errorf("invalid size after restore: actual=%v want=4", s)
+	}
+	restored.Dict("d").Del("k1")
+	if s := restored.Size(); s != 0 {
+		t.Errorf("invalid size after delete: actual=%v want=0", s)
+	}
+}
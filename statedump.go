@@ -0,0 +1,273 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/state"
+)
+
+// The state of a local bee can be exported as JSON from
+// "/api/v1/bees/{id}/state", and can be imported by posting the same JSON
+// representation to that endpoint. By default, the imported keys are patched
+// into the state of the bee: keys with a value are put, keys marked as deleted
+// are removed, and the other keys are kept. With "?mode=overwrite", the
+// dictionaries in the request replace the dictionaries of the bee. Imports are
+// committed in a transaction on the leader of the bee's colony, and are thus
+// replicated in persistent applications. Dictionaries internal to beehive are
+// neither exported nor imported. Keys stored with a TTL are exported with their
+// expiry time, and are imported with a TTL that expires them at that time.
+// Decoded values are only for reading: the value of a key is always imported
+// from its raw value, and an import is refused if a decoded value differs from
+// the decoding of its raw value.
+
+// DictDecoder decodes the values of a dictionary into values that can be
+// marshaled into JSON.
+type DictDecoder func(v []byte) (interface{}, error)
+
+// GobDictDecoder returns a DictDecoder that decodes gob-encoded values into
+// values of the same type as v.
+func GobDictDecoder(v interface{}) DictDecoder {
+	t := reflect.TypeOf(v)
+	return func(b []byte) (interface{}, error) {
+		d := reflect.New(t)
+		dec := gob.NewDecoder(bytes.NewBuffer(b))
+		if err := dec.Decode(d.Interface()); err != nil {
+			return nil, err
+		}
+		return d.Elem().Interface(), nil
+	}
+}
+
+// AppWithDictDecoder is an application option that decodes the values of
+// dictionary dict using d when the state of a bee is exported as JSON.
+// Otherwise, values are exported as raw bytes.
+func AppWithDictDecoder(dict string, d DictDecoder) AppOption {
+	return func(a *app) {
+		if a.dictDecoders == nil {
+			a.dictDecoders = make(map[string]DictDecoder)
+		}
+		a.dictDecoders[dict] = d
+	}
+}
+
+// beeState is the JSON representation of the state of a bee.
+type beeState struct {
+	Bee   uint64                          `json:"bee"`
+	App   string                          `json:"app"`
+	Dicts map[string]map[string]dictValue `json:"dicts"`
+}
+
+// dictValue is the JSON representation of a value in a dictionary.
+type dictValue struct {
+	Value   []byte      `json:"value"`             // raw value (base64 in JSON).
+	Decoded interface{} `json:"decoded,omitempty"` // value decoded for export.
+	Error   string      `json:"error,omitempty"`   // error in decoding value.
+	Expiry  *time.Time  `json:"expiry,omitempty"`  // expiry of a key with a TTL.
+	Deleted bool        `json:"deleted,omitempty"` // deletes the key on import.
+}
+
+// exportState returns the JSON representation of the state of the bee.
+func (b *bee) exportState() beeState {
+	s := beeState{
+		Bee:   b.ID(),
+		App:   b.app.Name(),
+		Dicts: make(map[string]map[string]dictValue),
+	}
+	for _, n := range b.stateL1.DictNames() {
+		if internalDict(n) {
+			continue
+		}
+		dec := b.app.dictDecoders[n]
+		vals := make(map[string]dictValue)
+		d := b.stateL1.Dict(n)
+		d.ForEach(func(k string, v []byte) {
+			dv := dictValue{Value: v}
+			if exp, ok := state.ExpiresAt(d, k); ok {
+				dv.Expiry = &exp
+			}
+			if dec != nil {
+				var err error
+				if dv.Decoded, err = dec(v); err != nil {
+					dv.Error = err.Error()
+				}
+			}
+			vals[k] = dv
+		})
+		s.Dicts[n] = vals
+	}
+	return s
+}
+
+// importState imports dicts into the state of the bee in a transaction. If
+// overwrite is true, the keys of dicts that are not imported are deleted.
+func (b *bee) importState(dicts map[string]map[string]dictValue,
+	overwrite bool) error {
+
+	if b.detached || b.proxy || !b.isLeader() {
+		return fmt.Errorf("%v is not the leader of its colony", b)
+	}
+
+	for n, vals := range dicts {
+		if internalDict(n) {
+			return fmt.Errorf("cannot import internal dictionary %v", n)
+		}
+		for k, dv := range vals {
+			if err := b.checkDecoded(n, dv); err != nil {
+				return fmt.Errorf("cannot import %v/%v: %v", n, k, err)
+			}
+		}
+	}
+
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	for n, vals := range dicts {
+		d := b.Dict(n)
+		if overwrite {
+			var keys []string
+			d.ForEach(func(k string, v []byte) {
+				if _, ok := vals[k]; !ok {
+					keys = append(keys, k)
+				}
+			})
+			for _, k := range keys {
+				d.Del(k)
+			}
+		}
+		for k, dv := range vals {
+			var err error
+			switch {
+			case dv.Deleted:
+				err = d.Del(k)
+			case dv.Expiry != nil:
+				err = state.PutTTL(d, k, dv.Value, dv.Expiry.Sub(time.Now()))
+			default:
+				err = d.Put(k, dv.Value)
+			}
+			if err != nil {
+				b.AbortTx()
+				return err
+			}
+		}
+	}
+	glog.V(2).Infof("%v imports %v dictionaries", b, len(dicts))
+	return b.CommitTx()
+}
+
+// checkDecoded returns an error if the decoded value of dv, if any, is not the
+// decoding of its raw value in dictionary dict.
+func (b *bee) checkDecoded(dict string, dv dictValue) error {
+	if dv.Decoded == nil || dv.Deleted {
+		return nil
+	}
+	dec := b.app.dictDecoders[dict]
+	if dec == nil {
+		return errors.New("decoded value in a dictionary without a decoder")
+	}
+	v, err := dec(dv.Value)
+	if err != nil {
+		return err
+	}
+	// Decoded is unmarshaled from JSON, so v is compared in the same form.
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var jv interface{}
+	if err := json.Unmarshal(j, &jv); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(jv, dv.Decoded) {
+		return errors.New("decoded value differs from the raw value")
+	}
+	return nil
+}
+
+// localBeeForState returns the local bee whose state is exported or imported
+// in r.
+func (h *v1Handler) localBeeForState(r *http.Request) (*bee, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bee id: %v", err)
+	}
+	bi, err := h.srv.hive.bee(id)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := h.srv.hive.app(bi.App)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot find app %v", h.srv.hive, bi.App)
+	}
+	b, ok := a.qee.localBee(id)
+	if !ok || b.proxy || b.detached {
+		return nil, fmt.Errorf("bee %v is not local to %v (see hive %v)", id,
+			h.srv.hive, bi.Hive)
+	}
+	return b, nil
+}
+
+func (h *v1Handler) handleBeeState(w http.ResponseWriter, r *http.Request) {
+	b, err := h.localBeeForState(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res, err := b.processCmd(cmdExportState{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func (h *v1Handler) handleBeeStateImport(w http.ResponseWriter,
+	r *http.Request) {
+
+	b, err := h.localBeeForState(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var s beeState
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var overwrite bool
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "patch":
+	case "overwrite":
+		overwrite = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid import mode %q", mode),
+			http.StatusBadRequest)
+		return
+	}
+
+	cmd := cmdImportState{Dicts: s.Dicts, Overwrite: overwrite}
+	if _, err := b.processCmd(cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type stateDumpTestMsg string
+
+func TestExportImportState(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_statedump"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan uint64)
+	a := h.NewApp("statedump", AppWithDictDecoder("G", GobDictDecoder("")))
+	a.HandleFunc(stateDumpTestMsg(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			v := string(msg.Data().(stateDumpTestMsg))
+			ctx.Dict("D").Put("k1", []byte(v))
+			ctx.Dict("D").Put("k2", []byte(v))
+			ctx.Dict("G").PutGob("k", v)
+			ctx.Dict("__D").Put("k", []byte(v))
+			state.PutTTL(ctx.Dict("T"), "k", []byte(v), time.Hour)
+			ch <- ctx.ID()
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(stateDumpTestMsg("v"))
+	id := <-ch
+
+	srv := h.(*hive).server
+	path := fmt.Sprintf("/api/v1/bees/%v/state", id)
+	export := func() beeState {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		srv.Handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot export state: %v %v", w.Code, w.Body)
+		}
+		var s beeState
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	imprt := func(mode, body string) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", path+"?mode="+mode,
+			strings.NewReader(body))
+		srv.Handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("cannot import state: %v %v", w.Code, w.Body)
+		}
+	}
+
+	s := export()
+	if s.Bee != id || s.App != "statedump" {
+		t.Errorf("invalid bee in the exported state: %v/%v", s.App, s.Bee)
+	}
+	if v := s.Dicts["D"]["k1"]; !bytes.Equal(v.Value, []byte("v")) ||
+		v.Decoded != nil {
+		t.Errorf("invalid exported value: %+v", v)
+	}
+	if v := s.Dicts["G"]["k"]; v.Decoded != "v" {
+		t.Errorf("invalid decoded value: %+v", v)
+	}
+	if _, ok := s.Dicts["__D"]; ok {
+		t.Error("internal dictionary is exported")
+	}
+
+	exp := s.Dicts["T"]["k"].Expiry
+	if exp == nil {
+		t.Fatal("no expiry for a key with a TTL")
+	}
+
+	refuse := func(body string) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		srv.Handler.ServeHTTP(w, r)
+		if w.Code != http.StatusConflict {
+			t.Errorf("invalid import is accepted: %v %v", w.Code, w.Body)
+		}
+	}
+	refuse(`{"dicts": {"__D": {"k": {"value": "dw=="}}}}`)
+	// The decoded value does not match the raw value.
+	refuse(`{"dicts": {"G": {"k": {"value": "` +
+		base64.StdEncoding.EncodeToString(s.Dicts["G"]["k"].Value) +
+		`", "decoded": "w"}}}}`)
+	refuse(`{"dicts": {"D": {"k1": {"value": "dw==", "decoded": "w"}}}}`)
+
+	// The exported state, including expiries, can be imported back.
+	j, _ := json.Marshal(beeState{Dicts: map[string]map[string]dictValue{
+		"G": s.Dicts["G"], "T": s.Dicts["T"]}})
+	imprt("patch", string(j))
+	s = export()
+	// Expiries are imported as TTLs, and may shift by the time of the import.
+	if v := s.Dicts["T"]["k"]; v.Expiry == nil ||
+		v.Expiry.Sub(*exp) > time.Second || exp.Sub(*v.Expiry) > time.Second {
+		t.Errorf("invalid expiry after import: actual=%v want=%v", v.Expiry,
+			exp)
+	}
+
+	// "dw==" is "w" in base64.
+	imprt("patch", `{"dicts": {"D": {"k1": {"value": "dw=="},
+		"k2": {"deleted": true}, "k3": {"value": "dw=="}}}}`)
+	s = export()
+	if len(s.Dicts["D"]) != 2 ||
+		!bytes.Equal(s.Dicts["D"]["k1"].Value, []byte("w")) ||
+		!bytes.Equal(s.Dicts["D"]["k3"].Value, []byte("w")) {
+		t.Errorf("invalid state after patch: %+v", s.Dicts["D"])
+	}
+
+	imprt("overwrite", `{"dicts": {"D": {"k4": {"value": "dw=="}}}}`)
+	s = export()
+	if _, ok := s.Dicts["D"]["k4"]; !ok || len(s.Dicts["D"]) != 1 {
+		t.Errorf("invalid state after overwrite: %+v", s.Dicts["D"])
+	}
+	if _, ok := s.Dicts["G"]["k"]; !ok {
+		t.Error("overwrite removes a dictionary that is not imported")
+	}
+}
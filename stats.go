@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
 	"time"
 
@@ -16,18 +15,23 @@ import (
 )
 
 type collector interface {
-	collect(bee uint64, in *msg, out []*msg)
+	// collect records that bee has handled in and emitted out, and that the
+	// size of its state is stateSize.
+	collect(bee uint64, in *msg, out []*msg, stateSize int)
 }
 
 type noOpStatCollector struct{}
 
-func (c *noOpStatCollector) collect(bee uint64, in *msg, out []*msg) {}
+func (c *noOpStatCollector) collect(bee uint64, in *msg, out []*msg,
+	stateSize int) {
+}
 
 const (
 	appCollector  = "bh_collector"
 	dictLocalStat = "LocalStatDict"
 	dictLocalProv = "LocalProvDict"
 	dictOptimizer = "OptimizerDict"
+	dictOptScores = "OptimizerScoreDict"
 
 	defaultMinScore = 3
 )
@@ -41,12 +45,11 @@ func newAppStatCollector(h *hive) collector {
 	a := h.NewApp(appCollector, AppNonTransactional())
 	a.Handle(beeRecord{}, localCollector{})
 	a.Handle(cmdMigrate{}, localCollector{})
-	a.Handle(pollLocalStat{}, localStatPoller{
-		thresh: uint64(h.config.OptimizeThresh),
-	})
+	a.Handle(pollLocalStat{}, localStatPoller{})
 
 	a.Handle(beeMatrixUpdate{}, optimizerCollector{})
-	a.Handle(pollOptimizer{}, optimizer{defaultMinScore})
+	a.Handle(pollOptimizer{}, optimizer{NewDefaultOptimizerPolicy(defaultMinScore)})
+	a.Handle(migrationResult{}, migrationTracker{})
 
 	a.Detached(NewTimer(1*time.Second, func() {
 		h.Emit(pollOptimizer{})
@@ -57,14 +60,21 @@ func newAppStatCollector(h *hive) collector {
 	s.Handle(statRequest{}, statRequestHandler{})
 	a.HandleHTTP("/stats", &statHttpHandler{sync: s})
 
+	s.Handle(recommendationsRequest{}, recommendationsHandler{})
+	s.Handle(recommendationDecision{}, recommendationsHandler{})
+	rh := &recommendationHttpHandler{sync: s}
+	a.HandleHTTP("/recommendations", rh).Methods("GET")
+	a.HandleHTTP("/recommendations/{id}/{action}", rh).Methods("POST")
+
 	glog.V(1).Infof("%v installs app stat collector", h)
 	return c
 }
 
 type beeRecord struct {
-	Bee uint64
-	In  *msg
-	Out []*msg
+	Bee       uint64
+	In        *msg
+	Out       []*msg
+	StateSize int // size of the bee's state after handling In.
 }
 
 func formatBeeID(id uint64) string {
@@ -79,9 +89,11 @@ func parseBeeID(str string) uint64 {
 	return id
 }
 
-func (c *collectorApp) collect(bee uint64, in *msg, out []*msg) {
+func (c *collectorApp) collect(bee uint64, in *msg, out []*msg,
+	stateSize int) {
+
 	switch in.Data().(type) {
-	case beeMatrixUpdate, cmdMigrate:
+	case beeMatrixUpdate, cmdMigrate, migrationResult:
 		return
 	}
 
@@ -92,12 +104,13 @@ func (c *collectorApp) collect(bee uint64, in *msg, out []*msg) {
 	// TODO(soheil): We should batch here.
 	oc := make([]*msg, len(out))
 	copy(oc, out)
-	c.hive.Emit(beeRecord{Bee: bee, In: in, Out: oc})
+	c.hive.Emit(beeRecord{Bee: bee, In: in, Out: oc, StateSize: stateSize})
 }
 
 type beeMatrix struct {
-	Bee    uint64
-	Matrix map[uint64]uint64
+	Bee       uint64
+	Matrix    map[uint64]uint64
+	StateSize int
 }
 
 type localBeeMatrix struct {
@@ -120,23 +133,35 @@ func (c localCollector) Rcv(msg Msg, ctx RcvContext) error {
 		c.updateMatrix(br, ctx)
 		c.updateProvenance(br, ctx)
 	case cmdMigrate:
-		bi, err := beeInfoFromContext(ctx, br.Bee)
+		res := migrationResult{Bee: br.Bee, To: br.To}
+		newb, err := c.migrate(br, ctx)
 		if err != nil {
-			return fmt.Errorf("%v cannot find bee %v to migrate", ctx, br.Bee)
-		}
-		a, ok := ctx.(*bee).hive.app(bi.App)
-		if !ok {
-			return fmt.Errorf("%v cannot find app %v", ctx, a)
-		}
-		if _, err := a.qee.processCmd(br); err != nil {
-			return fmt.Errorf(
-				"%v cannot migrate bee %v to %v as instructed by optimizer: %v",
+			glog.Errorf("%v cannot migrate bee %v to %v as instructed by optimizer: %v",
 				ctx, br.Bee, br.To, err)
+			res.Err = err.Error()
 		}
+		res.NewBee = newb
+		ctx.Emit(res)
 	}
 	return nil
 }
 
+func (c localCollector) migrate(cm cmdMigrate, ctx RcvContext) (uint64, error) {
+	bi, err := beeInfoFromContext(ctx, cm.Bee)
+	if err != nil {
+		return Nil, fmt.Errorf("cannot find bee %v", cm.Bee)
+	}
+	a, ok := ctx.(*bee).hive.app(bi.App)
+	if !ok {
+		return Nil, fmt.Errorf("cannot find app %v", bi.App)
+	}
+	res, err := a.qee.processCmd(cm)
+	if err != nil {
+		return Nil, err
+	}
+	return res.(uint64), nil
+}
+
 func (c localCollector) updateMatrix(r beeRecord, ctx RcvContext) {
 	d := ctx.Dict(dictLocalStat)
 	k := formatBeeID(r.Bee)
@@ -147,6 +172,7 @@ func (c localCollector) updateMatrix(r beeRecord, ctx RcvContext) {
 		lm.UpdateTime = time.Now()
 	}
 	lm.BeeMatrix.Matrix[r.In.From()]++
+	lm.BeeMatrix.StateSize = r.StateSize
 	lm.UpdateMsgCnt++
 	if err := d.PutGob(k, &lm); err != nil {
 		glog.Fatalf("cannot store matrix: %v", err)
@@ -178,15 +204,14 @@ func (c localCollector) updateProvenance(r beeRecord, ctx RcvContext) {
 
 type pollLocalStat struct{}
 
-type localStatPoller struct {
-	thresh uint64
-}
+type localStatPoller struct{}
 
 func (p localStatPoller) Map(msg Msg, ctx MapContext) MappedCells {
 	return MappedCells{}
 }
 
 func (p localStatPoller) Rcv(msg Msg, ctx RcvContext) error {
+	thresh := ctx.Hive().(*hive).optimizeThresh()
 	d := ctx.Dict(dictLocalStat)
 	d.ForEach(func(k string, v []byte) {
 		var lm localBeeMatrix
@@ -198,7 +223,7 @@ func (p localStatPoller) Rcv(msg Msg, ctx RcvContext) error {
 		if dur == 0 {
 			dur = 1
 		}
-		if lm.UpdateMsgCnt/dur < p.thresh {
+		if lm.UpdateMsgCnt/dur < thresh {
 			return
 		}
 
@@ -210,24 +235,20 @@ func (p localStatPoller) Rcv(msg Msg, ctx RcvContext) error {
 	return nil
 }
 
-// TODO(soheil): implement migration status: none, initiated, and done.
 type optimizerStat struct {
 	Bee       uint64
 	Collector uint64
 	Matrix    map[uint64]uint64
-	Migrated  bool
-	Score     int
-	LastMax   uint64
+	StateSize int
+
+	Migration migrationState // state of the bee's migration.
+	To        uint64         // destination of the current migration.
+	Attempts  int            // failed attempts of the current migration.
+	Updated   time.Time      // when the migration state last changed.
 }
 
 type optimizerCollector struct{}
 
-func (c optimizerCollector) isMigrated(b uint64, optDict state.Dict) bool {
-	var os optimizerStat
-	err := optDict.GetGob(formatBeeID(b), &os)
-	return err == nil && os.Migrated
-}
-
 func (c optimizerCollector) Rcv(msg Msg, ctx RcvContext) error {
 	up := msg.Data().(beeMatrixUpdate)
 	glog.V(3).Infof("optimizer receives stat update: %+v", up)
@@ -238,6 +259,7 @@ func (c optimizerCollector) Rcv(msg Msg, ctx RcvContext) error {
 	os.Bee = up.Bee
 	os.Collector = msg.From()
 	os.Matrix = up.Matrix
+	os.StateSize = up.StateSize
 	return dict.PutGob(k, &os)
 }
 
@@ -262,7 +284,7 @@ func (s beeHiveStat) Less(i, j int) bool { return s[i].Cnt < s[j].Cnt }
 type pollOptimizer struct{}
 
 type optimizer struct {
-	minScore int
+	policy OptimizerPolicy
 }
 
 func getOptimizerStats(dict state.Dict) (stats map[uint64]optimizerStat) {
@@ -280,125 +302,124 @@ func getOptimizerStats(dict state.Dict) (stats map[uint64]optimizerStat) {
 }
 
 func (o optimizer) Rcv(msg Msg, ctx RcvContext) error {
-	dict := ctx.Dict(dictOptimizer)
-	stats := getOptimizerStats(dict)
-
-	infos := make(map[uint64]BeeInfo)
-	for id, os := range stats {
-		infos[id] = BeeInfo{}
+	h := ctx.Hive().(*hive)
+	ms := newMigrations(ctx)
+	ms.expire()
+	ms.dispatch()
+
+	in := OptimizerInput{
+		Traffic:    make(map[uint64]map[uint64]uint64),
+		Bees:       make(map[uint64]BeeInfo),
+		StateSizes: make(map[uint64]int),
+		HiveLoads:  h.hiveLoads(),
+		Sticky:     make(map[uint64]bool),
+		Migrating:  make(map[uint64]bool),
+	}
+	for id, os := range ms.stats {
+		if os.migrating() {
+			in.Migrating[id] = true
+		}
+		if ms.coolingDown(id) {
+			in.Sticky[id] = true
+		}
+		if os.Matrix == nil {
+			continue
+		}
+		in.Traffic[id] = os.Matrix
+		in.StateSizes[id] = os.StateSize
+		in.Bees[id] = BeeInfo{}
 		for bid := range os.Matrix {
-			infos[bid] = BeeInfo{}
+			in.Bees[bid] = BeeInfo{}
 		}
 	}
-
-	var err error
-	for id := range infos {
-		infos[id], err = beeInfoFromContext(ctx, id)
+	for id := range in.Bees {
+		bi, err := beeInfoFromContext(ctx, id)
 		if err != nil {
-			delete(infos, id)
+			delete(in.Bees, id)
+			continue
+		}
+		in.Bees[id] = bi
+		if a, ok := h.app(bi.App); ok && a.sticky() {
+			in.Sticky[id] = true
 		}
 	}
 
-	bhmx := make(map[uint64]map[uint64]uint64)
-	for b, os := range stats {
-		if os.Migrated {
-			continue
-		}
-		bi, ok := infos[b]
-		if !ok || bi.Detached {
+	dryRun := ms.cfg.OptimizeDryRun
+	for _, m := range o.plan(h, in, ctx.Dict(dictOptScores)) {
+		if dryRun {
+			glog.V(1).Infof("%v recommends migration of bee %v to hive %v: %v", ctx,
+				m.Bee, m.To, m.Reason)
+			if err := recommend(ctx.Dict(dictOptimizerRecs), m,
+				in.Bees[m.Bee].Hive); err != nil {
+				return err
+			}
 			continue
 		}
-		if app, ok := ctx.Hive().(*hive).app(bi.App); ok && app.sticky() {
-			continue
+
+		glog.Infof("%v decides to migrate bee %v to hive %v: %v", ctx, m.Bee, m.To,
+			m.Reason)
+		if err := ms.start(m.Bee, m.To); err != nil {
+			return err
 		}
-		for fromb, cnt := range os.Matrix {
-			if stats[fromb].Migrated {
-				continue
-			}
-			frombi, ok := infos[fromb]
-			if !ok {
-				continue
-			}
+	}
+	ms.dispatch()
+	return nil
+}
 
-			hmx, ok := bhmx[b]
-			if !ok {
-				hmx = make(map[uint64]uint64)
-				bhmx[b] = hmx
+// plan returns the migrations planned by the policies of applications. The
+// bees of applications without a policy are planned by the default policy.
+// The scores of scoring policies are loaded from and saved in scores.
+func (o optimizer) plan(h *hive, in OptimizerInput,
+	scores state.Dict) []Migration {
+
+	var plan []Migration
+	planned := make(map[uint64]bool)
+	add := func(p OptimizerPolicy, key string, owns func(app string) bool) {
+		pin := in
+		pin.foreign = make(map[uint64]bool)
+		for id, bi := range in.Bees {
+			if !owns(bi.App) {
+				pin.foreign[id] = true
 			}
-			hmx[frombi.Hive] += cnt
+		}
 
-			if frombi.Detached {
-				continue
-			}
-			hmx, ok = bhmx[fromb]
-			if !ok {
-				hmx = make(map[uint64]uint64)
-				bhmx[fromb] = hmx
+		sp, scoring := p.(scoringPolicy)
+		if scoring {
+			s := make(map[uint64]optimizerScore)
+			scores.GetGob(key, &s)
+			sp.loadScores(s)
+		}
+		ms := p.Plan(pin)
+		if scoring {
+			if err := scores.PutGob(key, sp.savedScores()); err != nil {
+				glog.Errorf("cannot save the optimizer scores of %v: %v", key, err)
 			}
-			hmx[bi.Hive] += cnt
 		}
-	}
 
-	sorted := make(beeHiveStat, 0, len(stats))
-	for b, hmx := range bhmx {
-		bi := infos[b]
-		local := hmx[bi.Hive]
-		max := uint64(0)
-		maxh := uint64(0)
-		for h, cnt := range hmx {
-			if h == bi.Hive {
+		for _, m := range ms {
+			if planned[m.Bee] || !validMigration(m, in) {
 				continue
 			}
-			if max < cnt {
-				max = cnt
-				maxh = h
+			if !owns(in.Bees[m.Bee].App) {
+				continue
 			}
+			planned[m.Bee] = true
+			plan = append(plan, m)
 		}
-		if max <= 2*local {
-			continue
-		}
-		os := stats[b]
-		if max == os.LastMax {
-			continue
-		}
-		os.Score++
-		os.LastMax = max
-		k := formatBeeID(b)
-		dict.PutGob(k, &os)
-		if os.Score <= o.minScore {
-			continue
-		}
-		sorted = append(sorted, beeHiveCnt{
-			Bee:  b,
-			Hive: maxh,
-			Cnt:  max,
-		})
 	}
-	if len(sorted) == 0 {
-		return nil
-	}
-	sort.Sort(sorted)
 
-	blacklist := make(map[uint64]struct{})
-	for _, bhc := range sorted {
-		bi, ok := infos[bhc.Bee]
-		if !ok {
+	for _, a := range h.apps {
+		if a.optimizer == nil {
 			continue
 		}
-		if _, ok := blacklist[bi.Hive]; ok {
-			continue
-		}
-		blacklist[bhc.Hive] = struct{}{}
-
-		glog.Infof("%v initiates migration of bee %v to hive %v", ctx, bhc.Bee,
-			bhc.Hive)
-		os := stats[bhc.Bee]
-		ctx.SendToBee(cmdMigrate{Bee: bhc.Bee, To: bhc.Hive}, os.Collector)
-		os.Migrated = true
-		k := formatBeeID(bhc.Bee)
-		dict.PutGob(k, &os)
+		name := a.Name()
+		add(a.optimizer, "app/"+name, func(app string) bool { return app == name })
 	}
-	return nil
+	add(o.policy, "default", func(app string) bool {
+		a, ok := h.app(app)
+		return !ok || a.optimizer == nil
+	})
+	return plan
 }
 
 func (o optimizer) Map(msg Msg, ctx MapContext) MappedCells {
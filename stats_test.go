@@ -1,6 +1,10 @@
 package beehive
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+	"time"
+)
 
 func testStatUpdate(t *testing.T, ctx *MockRcvContext, infos []BeeInfo,
 	up beeMatrixUpdate, minScore int) (*MockRcvContext, optimizerStat, error) {
@@ -14,6 +18,7 @@ func testStatUpdate(t *testing.T, ctx *MockRcvContext, infos []BeeInfo,
 		}
 		for _, i := range infos {
 			reg.addBee(i)
+			reg.addHive(HiveInfo{ID: i.Hive, Addr: fmt.Sprintf("127.0.0.1:%v", i.Hive)})
 		}
 		h := &hive{
 			registry: reg,
@@ -34,7 +39,7 @@ func testStatUpdate(t *testing.T, ctx *MockRcvContext, infos []BeeInfo,
 		return ctx, os, err
 	}
 
-	o = optimizer{minScore: minScore}
+	o = optimizer{NewDefaultOptimizerPolicy(minScore)}
 	o.Rcv(&MockMsg{}, ctx)
 	if err := d.GetGob(formatBeeID(up.Bee), &os); err != nil {
 		t.Errorf("error in loading the optimizer stat: %v", err)
@@ -68,13 +73,13 @@ func TestStatUpdateMigration(t *testing.T) {
 		return
 	}
 	stats := getOptimizerStats(ctx.Dict(dictOptimizer))
-	if stats[1].Migrated {
+	if stats[1].Migration != migrationNone {
 		t.Error("1 should not be migrated")
 	}
-	if !stats[2].Migrated {
+	if stats[2].Migration != migrationInProgress {
 		t.Error("2 should be migrated")
 	}
-	if !stats[3].Migrated {
+	if stats[3].Migration != migrationInProgress {
 		t.Error("3 should be migrated")
 	}
 
@@ -132,7 +137,7 @@ func TestStatUpdateNoMigration(t *testing.T) {
 		if err != nil {
 			return
 		}
-		if os.Migrated {
+		if os.Migration != migrationNone {
 			t.Errorf("invalid migrated flag in the optimizer state")
 		}
 		if len(ctx.CtxMsgs) != 0 {
@@ -219,3 +224,296 @@ func TestProvenanceUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestMatrixUpdateStateSize(t *testing.T) {
+	ctx := MockRcvContext{}
+	c := localCollector{}
+	for _, size := range []int{10, 4} {
+		r := beeRecord{Bee: 1, In: &msg{MsgFrom: 2}, StateSize: size}
+		c.updateMatrix(r, &ctx)
+		var lm localBeeMatrix
+		ctx.Dict(dictLocalStat).GetGob(formatBeeID(r.Bee), &lm)
+		if lm.BeeMatrix.StateSize != size {
+			t.Errorf("invalid state size: actual=%v want=%v",
+				lm.BeeMatrix.StateSize, size)
+		}
+	}
+}
+
+type fixedOptimizerPolicy []Migration
+
+func (p fixedOptimizerPolicy) Plan(in OptimizerInput) []Migration {
+	return p
+}
+
+func TestOptimizerAppPolicy(t *testing.T) {
+	infos := []BeeInfo{
+		{ID: 1, Hive: 1, App: "a"},
+		{ID: 2, Hive: 2, App: "b"},
+	}
+	reg := newRegistry("")
+	reg.BeeID = 2
+	for _, i := range infos {
+		reg.addBee(i)
+		reg.addHive(HiveInfo{ID: i.Hive, Addr: fmt.Sprintf("127.0.0.1:%v", i.Hive)})
+	}
+	p := fixedOptimizerPolicy{
+		{Bee: 1, To: 2},
+		{Bee: 2, To: 1},
+		{Bee: 1, To: 3},
+	}
+	h := &hive{
+		registry: reg,
+		apps: map[string]*app{
+			"a": &app{name: "a", optimizer: p},
+		},
+	}
+	ctx := &MockRcvContext{CtxHive: h}
+	for _, up := range []beeMatrixUpdate{
+		{Bee: 1, Matrix: map[uint64]uint64{2: 1}},
+		{Bee: 2, Matrix: map[uint64]uint64{1: 1}},
+	} {
+		optimizerCollector{}.Rcv(&MockMsg{MsgData: up}, ctx)
+	}
+
+	o := optimizer{NewDefaultOptimizerPolicy(100)}
+	o.Rcv(&MockMsg{}, ctx)
+	if len(ctx.CtxMsgs) != 1 {
+		t.Fatalf("invalid number of migrations: actual=%v want=1",
+			len(ctx.CtxMsgs))
+	}
+	cmd := ctx.CtxMsgs[0].Data().(cmdMigrate)
+	if cmd.Bee != 1 || cmd.To != 2 {
+		t.Errorf("invalid migration: actual=%+v want={Bee:1 To:2}", cmd)
+	}
+}
+
+func TestOptimizerForeignBees(t *testing.T) {
+	infos := []BeeInfo{
+		{ID: 1, Hive: 1, App: "a"},
+		{ID: 2, Hive: 2, App: "a"},
+		{ID: 3, Hive: 2, App: "b"},
+		{ID: 4, Hive: 3, App: "a"},
+	}
+	reg := newRegistry("")
+	reg.BeeID = 4
+	for _, i := range infos {
+		reg.addBee(i)
+		reg.addHive(HiveInfo{ID: i.Hive, Addr: fmt.Sprintf("127.0.0.1:%v", i.Hive)})
+	}
+	h := &hive{
+		registry: reg,
+		apps: map[string]*app{
+			"a": &app{name: "a", optimizer: fixedOptimizerPolicy{}},
+		},
+	}
+	ctx := &MockRcvContext{CtxHive: h}
+	for _, up := range []beeMatrixUpdate{
+		{Bee: 1, Matrix: map[uint64]uint64{2: 3}},
+		{Bee: 3, Matrix: map[uint64]uint64{4: 10}},
+	} {
+		optimizerCollector{}.Rcv(&MockMsg{MsgData: up}, ctx)
+	}
+
+	// The bees of app "a" must not blacklist the hives of bee 3.
+	o := optimizer{NewDefaultOptimizerPolicy(0)}
+	o.Rcv(&MockMsg{}, ctx)
+	if len(ctx.CtxMsgs) != 1 {
+		t.Fatalf("invalid number of migrations: actual=%v want=1",
+			len(ctx.CtxMsgs))
+	}
+	cmd := ctx.CtxMsgs[0].Data().(cmdMigrate)
+	if cmd.Bee != 3 || cmd.To != 3 {
+		t.Errorf("invalid migration: actual=%+v want={Bee:3 To:3}", cmd)
+	}
+}
+
+func TestOptimizerScoresSurviveRestart(t *testing.T) {
+	infos := []BeeInfo{
+		{ID: 1, Hive: 1},
+		{ID: 2, Hive: 2},
+	}
+	reg := newRegistry("")
+	reg.BeeID = 2
+	for _, i := range infos {
+		reg.addBee(i)
+		reg.addHive(HiveInfo{ID: i.Hive, Addr: fmt.Sprintf("127.0.0.1:%v", i.Hive)})
+	}
+	ctx := &MockRcvContext{CtxHive: &hive{registry: reg}}
+	for _, cnt := range []uint64{3, 5} {
+		up := beeMatrixUpdate{Bee: 1, Matrix: map[uint64]uint64{2: cnt}}
+		optimizerCollector{}.Rcv(&MockMsg{MsgData: up}, ctx)
+		// A new policy in each round, as if the optimizer bee has moved.
+		o := optimizer{NewDefaultOptimizerPolicy(1)}
+		o.Rcv(&MockMsg{}, ctx)
+	}
+	if len(ctx.CtxMsgs) != 1 {
+		t.Errorf("invalid number of migrations: actual=%v want=1",
+			len(ctx.CtxMsgs))
+	}
+}
+
+func TestOptimizerDryRun(t *testing.T) {
+	infos := []BeeInfo{
+		{ID: 1, Hive: 1},
+		{ID: 2, Hive: 2},
+		{ID: 3, Hive: 3},
+	}
+	up := beeMatrixUpdate{
+		Bee: 1,
+		Matrix: map[uint64]uint64{
+			2: 1,
+			3: 2,
+		},
+	}
+	reg := newRegistry("")
+	reg.BeeID = 3
+	for _, i := range infos {
+		reg.addBee(i)
+		reg.addHive(HiveInfo{ID: i.Hive, Addr: fmt.Sprintf("127.0.0.1:%v", i.Hive)})
+	}
+	h := &hive{registry: reg}
+	h.config.OptimizeDryRun = true
+	ctx := &MockRcvContext{CtxHive: h}
+	optimizerCollector{}.Rcv(&MockMsg{MsgData: up, MsgFrom: 10}, ctx)
+	o := optimizer{NewDefaultOptimizerPolicy(0)}
+	o.Rcv(&MockMsg{}, ctx)
+	if len(ctx.CtxMsgs) != 0 {
+		t.Fatalf("optimizer migrated bees in the dry-run mode")
+	}
+
+	recs := getRecommendations(ctx.Dict(dictOptimizerRecs))
+	if len(recs) != 2 {
+		t.Fatalf("invalid number of recommendations: actual=%v want=2",
+			len(recs))
+	}
+	for _, r := range recs {
+		if r.Status != recPending {
+			t.Errorf("invalid recommendation status: actual=%v want=%v", r.Status,
+				recPending)
+		}
+		if r.Migration.To != 1 || r.From != r.Migration.Bee {
+			t.Errorf("invalid recommendation: %+v", r)
+		}
+		if r.Migration.Traffic[1] == 0 || r.Migration.Score == 0 {
+			t.Errorf("recommendation has no reasoning: %+v", r)
+		}
+	}
+
+	// Recommendations are not duplicated.
+	o.Rcv(&MockMsg{}, ctx)
+	if n := len(getRecommendations(ctx.Dict(dictOptimizerRecs))); n != 2 {
+		t.Errorf("invalid number of recommendations: actual=%v want=2", n)
+	}
+
+	rh := recommendationsHandler{}
+	approve := recommendationDecision{ID: recs[0].ID, Approve: true}
+	if err := rh.Rcv(&MockMsg{MsgData: approve, MsgFrom: 1}, ctx); err != nil {
+		t.Fatalf("cannot approve recommendation: %v", err)
+	}
+	if err := rh.Rcv(&MockMsg{MsgData: approve, MsgFrom: 1}, ctx); err == nil {
+		t.Error("recommendation is approved twice")
+	}
+	reject := recommendationDecision{ID: recs[1].ID}
+	if err := rh.Rcv(&MockMsg{MsgData: reject, MsgFrom: 1}, ctx); err != nil {
+		t.Fatalf("cannot reject recommendation: %v", err)
+	}
+
+	var migrated []cmdMigrate
+	for _, msg := range ctx.CtxMsgs {
+		if cmd, ok := msg.Data().(cmdMigrate); ok {
+			migrated = append(migrated, cmd)
+		}
+	}
+	if len(migrated) != 1 || migrated[0].Bee != recs[0].Migration.Bee ||
+		migrated[0].To != 1 {
+		t.Errorf("invalid migrations: actual=%+v want=[{Bee:%v To:1}]", migrated,
+			recs[0].Migration.Bee)
+	}
+	stats := getOptimizerStats(ctx.Dict(dictOptimizer))
+	if stats[recs[0].Migration.Bee].Migration != migrationInProgress {
+		t.Errorf("bee %v is not marked as migrated", recs[0].Migration.Bee)
+	}
+	for _, r := range getRecommendations(ctx.Dict(dictOptimizerRecs)) {
+		want := recApproved
+		if r.ID == recs[1].ID {
+			want = recRejected
+		}
+		if r.Status != want {
+			t.Errorf("invalid status of recommendation %v: actual=%v want=%v", r.ID,
+				r.Status, want)
+		}
+	}
+}
+
+func TestMigrationLifecycle(t *testing.T) {
+	h := &hive{registry: newRegistry("")}
+	h.config.MaxMigrations = 1
+	h.config.MigrationRetries = 1
+	h.config.MigrationCooldown = time.Minute
+	ctx := &MockRcvContext{CtxHive: h}
+	ms := newMigrations(ctx)
+
+	check := func(b uint64, want migrationState) {
+		if s := ms.stats[b].Migration; s != want {
+			t.Errorf("invalid migration state of bee %v: actual=%v want=%v", b, s,
+				want)
+		}
+	}
+	sent := func(want int) {
+		if len(ctx.CtxMsgs) != want {
+			t.Fatalf("invalid number of migrations: actual=%v want=%v",
+				len(ctx.CtxMsgs), want)
+		}
+	}
+
+	ms.start(1, 2)
+	ms.start(2, 2)
+	ms.dispatch()
+	sent(1)
+	check(1, migrationInProgress)
+	check(2, migrationPending)
+
+	ms.finish(migrationResult{Bee: 1, To: 2, Err: "error"})
+	check(1, migrationPending)
+	ms.dispatch()
+	sent(2)
+	check(1, migrationPending)
+	check(2, migrationInProgress)
+
+	ms.now = ms.now.Add(migrationRetryDelay)
+	ms.finish(migrationResult{Bee: 2, To: 2, NewBee: 5})
+	if _, ok := ms.stats[2]; ok {
+		t.Error("the stat of the migrated bee is not removed")
+	}
+	check(5, migrationDone)
+	if !ms.coolingDown(5) {
+		t.Error("migrated bee is not cooling down")
+	}
+	ms.dispatch()
+	sent(3)
+	check(1, migrationInProgress)
+	ms.finish(migrationResult{Bee: 1, To: 2, Err: "error"})
+	check(1, migrationFailed)
+	if !ms.coolingDown(1) {
+		t.Error("failed bee is not cooling down")
+	}
+
+	ms.start(3, 2)
+	ms.dispatch()
+	sent(4)
+	ms.now = ms.now.Add(time.Minute)
+	ms.expire()
+	check(1, migrationNone)
+	check(5, migrationNone)
+	check(3, migrationPending)
+	if a := ms.stats[3].Attempts; a != 1 {
+		t.Errorf("invalid attempts of timed out migration: actual=%v want=1", a)
+	}
+
+	stats := getOptimizerStats(ctx.Dict(dictOptimizer))
+	if s := stats[3].Migration; s != migrationPending {
+		t.Errorf("invalid persisted migration state: actual=%v want=%v", s,
+			migrationPending)
+	}
+}
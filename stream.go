@@ -23,6 +23,9 @@ type streamer interface {
 	sendCmd(c cmd, to uint64) (interface{}, error)
 	sendRaft(ms []raftpb.Message) error
 	sendBeeRaft(ms []raftpb.Message) error
+	// resetHive stops the connections to the given hive. New connections are
+	// established using the hive's address in the registry.
+	resetHive(id uint64)
 	stop()
 	// TODO(soheil): do we need start()?
 }
@@ -109,13 +112,18 @@ func (lb *loadBalancer) sendMsg(ms []msg) error {
 	}
 
 	for _, m := range ms {
-		if m.To() == Nil {
+		to := m.To()
+		if m.isMulticast() {
+			// All the bees of a multicast message are on the same hive.
+			to = m.MsgBees[0]
+		}
+		if to == Nil {
 			glog.Error("loadbalancer cannot send b-case message")
 			continue
 		}
-		btchr, err := lb.beeBatcher(m.To())
+		btchr, err := lb.beeBatcher(to)
 		if err != nil {
-			glog.Errorf("cannot create batcher for bee %v: %v", m.To(), err)
+			glog.Errorf("cannot create batcher for bee %v: %v", to, err)
 			continue
 		}
 		btchr.enqueMsg(m)
@@ -175,6 +183,27 @@ func (lb *loadBalancer) sendBeeRaft(ms []raftpb.Message) error {
 	return nil
 }
 
+func (lb *loadBalancer) resetHive(id uint64) {
+	lb.Lock()
+	defer lb.Unlock()
+
+	rrb, ok := lb.htob[id]
+	if !ok {
+		return
+	}
+
+	glog.V(2).Infof("%v resets its batchers to hive %v", lb.h, id)
+	delete(lb.htob, id)
+	for _, btchr := range rrb.bts {
+		btchr.stop()
+	}
+	for bee, btchr := range lb.btob {
+		if btchr.to == id {
+			delete(lb.btob, bee)
+		}
+	}
+}
+
 func (lb *loadBalancer) stop() {
 	close(lb.done)
 }
@@ -226,10 +255,10 @@ const (
 )
 
 type batcher struct {
-	h *hive
+	h  *hive
+	to uint64
 
-	batchTick time.Duration
-	weights   [4]int
+	weights [4]int
 
 	msgs   chan msg
 	cmds   chan cmdAndChannel
@@ -248,15 +277,15 @@ func newBatcher(h *hive, to uint64) (*batcher, error) {
 		return nil, err
 	}
 	b := &batcher{
-		h:         h,
-		batchTick: h.config.BatcherTimeout,
-		weights:   [4]int{1, 5, 10, 10},
-		msgs:      make(chan msg, h.config.DataChBufSize),
-		cmds:      make(chan cmdAndChannel, h.config.CmdChBufSize),
-		rafts:     make(chan raftpb.Message, h.config.DataChBufSize),
-		bRafts:    make(chan raftpb.Message, h.config.DataChBufSize),
-		done:      make(chan struct{}),
-		prx:       prx,
+		h:       h,
+		to:      to,
+		weights: [4]int{1, 5, 10, 10},
+		msgs:    make(chan msg, h.config.DataChBufSize),
+		cmds:    make(chan cmdAndChannel, h.config.CmdChBufSize),
+		rafts:   make(chan raftpb.Message, h.config.DataChBufSize),
+		bRafts:  make(chan raftpb.Message, h.config.DataChBufSize),
+		done:    make(chan struct{}),
+		prx:     prx,
 	}
 	go b.start()
 	return b, nil
@@ -268,7 +297,6 @@ func (b *batcher) batchRaft(wg *sync.WaitGroup) {
 	var raftBuf bytes.Buffer
 	raftEnc := raft.NewEncoder(&raftBuf)
 
-	raftd := b.batchTick * time.Duration(b.weights[batcherRaftIndex])
 	var tch <-chan time.Time
 
 	for {
@@ -280,7 +308,7 @@ func (b *batcher) batchRaft(wg *sync.WaitGroup) {
 				reset = true
 			}
 			if tch == nil {
-				tch = time.After(raftd)
+				tch = time.After(b.tick(batcherRaftIndex))
 			}
 
 		case <-tch:
@@ -313,7 +341,6 @@ func (b *batcher) batchBeeRaft(wg *sync.WaitGroup) {
 	var bRaftBuf bytes.Buffer
 	bRaftEnc := raft.NewEncoder(&bRaftBuf)
 
-	braftd := b.batchTick * time.Duration(b.weights[batcherBeeRaftIndex])
 	var tch <-chan time.Time
 
 	for {
@@ -326,7 +353,7 @@ func (b *batcher) batchBeeRaft(wg *sync.WaitGroup) {
 			}
 
 			if tch == nil {
-				tch = time.After(braftd)
+				tch = time.After(b.tick(batcherBeeRaftIndex))
 			}
 
 		case <-tch:
@@ -359,7 +386,6 @@ func (b *batcher) batchMsg(wg *sync.WaitGroup) {
 	var msgBuf bytes.Buffer
 	msgEnc := gob.NewEncoder(&msgBuf)
 
-	msgd := b.batchTick * time.Duration(b.weights[batcherMsgIndex])
 	var tch <-chan time.Time
 
 	for {
@@ -372,7 +398,7 @@ func (b *batcher) batchMsg(wg *sync.WaitGroup) {
 			}
 
 			if tch == nil {
-				tch = time.After(msgd)
+				tch = time.After(b.tick(batcherMsgIndex))
 			}
 
 		case <-tch:
@@ -406,7 +432,6 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 	var cmdBuf bytes.Buffer
 	cmdEnc := gob.NewEncoder(&cmdBuf)
 
-	cmdd := b.batchTick * time.Duration(b.weights[batcherCmdIndex])
 	var tch <-chan time.Time
 
 	for {
@@ -426,7 +451,7 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 			}
 
 			if tch == nil {
-				tch = time.After(cmdd)
+				tch = time.After(b.tick(batcherCmdIndex))
 			}
 
 		case <-tch:
@@ -463,6 +488,11 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 			reset = true
 
 		case <-b.done:
+			for _, cc := range cmds {
+				if cc.ch != nil {
+					cc.ch <- cmdResult{Err: errStreamerStopped}
+				}
+			}
 			return
 		}
 
@@ -475,6 +505,12 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 	}
 }
 
+// tick returns the batching timeout of the given index. The batcher timeout
+// can be changed by reloading the hive configuration.
+func (b *batcher) tick(i int) time.Duration {
+	return b.h.batcherTimeout() * time.Duration(b.weights[i])
+}
+
 func (b *batcher) start() {
 
 	var wg sync.WaitGroup
@@ -518,8 +554,23 @@ func (b *batcher) sendCmd(c cmd, to uint64) (interface{}, error) {
 		cmd: c,
 		ch:  ch,
 	}
-	b.cmds <- cc
-	return (<-ch).get()
+	select {
+	case b.cmds <- cc:
+	case <-b.done:
+		return nil, errStreamerStopped
+	}
+	select {
+	case res := <-ch:
+		return res.get()
+	case <-b.done:
+		// The result may have been sent before the batcher was stopped.
+		select {
+		case res := <-ch:
+			return res.get()
+		default:
+			return nil, errStreamerStopped
+		}
+	}
 }
 
 func (b *batcher) sendRaft(ms []raftpb.Message) error {
@@ -562,6 +613,12 @@ func (b *batcher) enqueBeeRaft(m raftpb.Message) error {
 	return nil
 }
 
+func (b *batcher) resetHive(id uint64) {
+	if id == b.to && !b.stopped() {
+		b.stop()
+	}
+}
+
 func (b *batcher) stop() {
 	close(b.done)
 }
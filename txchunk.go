@@ -0,0 +1,143 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Transactions of persistent applications are replicated as raft entries.
+// Transactions larger than HiveConfig.MaxTxSize are aborted with
+// ErrTxTooLarge, and transactions larger than HiveConfig.TxChunkSize are
+// replicated in chunks. Replicas store the chunks of a transaction in their
+// state, and apply the whole transaction atomically once its last chunk is
+// applied. Since a bee replicates one transaction at a time, the first chunk of
+// a transaction discards the chunks of any transaction that was left
+// incomplete (e.g., when the leader failed in the middle of it). Measuring a
+// transaction gob-encodes its messages, so both limits are disabled by
+// default.
+
+// ErrTxTooLarge is returned when a transaction exceeds the maximum
+// transaction size of the hive.
+var ErrTxTooLarge = errors.New("transaction is too large")
+
+// txChunkDict is the dictionary that stores the chunks of the transaction
+// being replicated.
+const txChunkDict = "__tx_chunks__"
+
+// opOverhead is the estimated encoding overhead of an operation.
+const opOverhead = 16
+
+// txChunk is a part of a transaction that is replicated in chunks.
+type txChunk struct {
+	ID   uint64 // ID of the transaction.
+	Seq  int    // Sequence of the chunk in the transaction.
+	Last bool   // Whether this is the last chunk of the transaction.
+	Tx   tx     // Operations and messages of the chunk.
+}
+
+// txRequests returns the raft requests that replicate t.
+func (b *bee) txRequests(t tx) ([]interface{}, error) {
+	max, chunk := b.hive.config.MaxTxSize, b.hive.config.TxChunkSize
+	if max <= 0 && chunk <= 0 {
+		return []interface{}{commitTx(t)}, nil
+	}
+
+	opSizes := make([]int, len(t.Ops))
+	msgSizes := make([]int, len(t.Msgs))
+	size := 0
+	for i, o := range t.Ops {
+		opSizes[i] = len(o.D) + len(o.K) + len(o.V) + len(o.P) + opOverhead
+		size += opSizes[i]
+	}
+	for i, m := range t.Msgs {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+			return nil, err
+		}
+		msgSizes[i] = buf.Len()
+		size += msgSizes[i]
+	}
+
+	if max > 0 && size > max {
+		glog.Errorf("%v has a transaction of %v bytes (max %v)", b, size, max)
+		return nil, ErrTxTooLarge
+	}
+	if chunk <= 0 || size <= chunk {
+		return []interface{}{commitTx(t)}, nil
+	}
+
+	id := uint64(time.Now().UnixNano())
+	var reqs []interface{}
+	c := txChunk{ID: id}
+	csize := 0
+	add := func(s int) {
+		if csize != 0 && csize+s > chunk {
+			reqs = append(reqs, c)
+			c = txChunk{ID: id, Seq: c.Seq + 1}
+			csize = 0
+		}
+		csize += s
+	}
+	for i, o := range t.Ops {
+		add(opSizes[i])
+		c.Tx.Ops = append(c.Tx.Ops, o)
+	}
+	for i, m := range t.Msgs {
+		add(msgSizes[i])
+		c.Tx.Msgs = append(c.Tx.Msgs, m)
+	}
+	c.Last = true
+	reqs = append(reqs, c)
+	glog.V(2).Infof("%v replicates a transaction of %v bytes in %v chunks", b,
+		size, len(reqs))
+	return reqs, nil
+}
+
+// applyTxChunk stores c, and applies its transaction if c is the last chunk.
+func (b *bee) applyTxChunk(c txChunk) error {
+	d := b.stateL1.State.Dict(txChunkDict)
+	if c.Seq == 0 {
+		var keys []string
+		d.ForEach(func(k string, v []byte) {
+			keys = append(keys, k)
+		})
+		for _, k := range keys {
+			d.Del(k)
+		}
+	} else {
+		var prev txChunk
+		if err := d.GetGob(strconv.Itoa(c.Seq-1), &prev); err != nil ||
+			prev.ID != c.ID {
+			glog.Errorf("%v drops chunk %v of incomplete transaction %v", b, c.Seq,
+				c.ID)
+			return nil
+		}
+	}
+
+	if !c.Last {
+		return d.PutGob(strconv.Itoa(c.Seq), c)
+	}
+
+	var t tx
+	for i := 0; i < c.Seq; i++ {
+		var p txChunk
+		if err := d.GetGob(strconv.Itoa(i), &p); err != nil {
+			return err
+		}
+		t.Ops = append(t.Ops, p.Tx.Ops...)
+		t.Msgs = append(t.Msgs, p.Tx.Msgs...)
+		d.Del(strconv.Itoa(i))
+	}
+	t.Ops = append(t.Ops, c.Tx.Ops...)
+	t.Msgs = append(t.Msgs, c.Tx.Msgs...)
+	return b.applyTx(t)
+}
+
+func init() {
+	gob.Register(txChunk{})
+}
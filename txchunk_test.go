@@ -0,0 +1,76 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type txChunkPut struct {
+	Prefix string
+	N      int
+}
+
+type txChunkCount struct {
+	Prefix string
+}
+
+func TestChunkedTx(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_txchunk"
+	cfg.Addr = newHiveAddrForTest()
+	cfg.TxChunkSize = 64
+	cfg.MaxTxSize = 2048
+	cfg.BatchSize = 1
+	removeState(cfg)
+	defer removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan int)
+	a := h.NewApp("txchunk", Persistent(1), Transactional())
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	a.HandleFunc(txChunkPut{}, mf, func(msg Msg, ctx RcvContext) error {
+		p := msg.Data().(txChunkPut)
+		for i := 0; i < p.N; i++ {
+			ctx.Dict("D").Put(p.Prefix+strconv.Itoa(i), []byte("0123456789"))
+		}
+		return nil
+	})
+	a.HandleFunc(txChunkCount{}, mf, func(msg Msg, ctx RcvContext) error {
+		n := 0
+		for i := 0; i < 100; i++ {
+			k := msg.Data().(txChunkCount).Prefix + strconv.Itoa(i)
+			if _, err := ctx.Dict("D").Get(k); err == nil {
+				n++
+			}
+		}
+		ch <- n
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	count := func(prefix string) int {
+		h.Emit(txChunkCount{Prefix: prefix})
+		select {
+		case n := <-ch:
+			return n
+		case <-time.After(10 * time.Second):
+			t.Fatal("no response")
+		}
+		return 0
+	}
+
+	h.Emit(txChunkPut{Prefix: "a", N: 20})
+	if n := count("a"); n != 20 {
+		t.Errorf("invalid number of keys of a chunked tx: actual=%v want=20", n)
+	}
+
+	h.Emit(txChunkPut{Prefix: "b", N: 100})
+	if n := count("b"); n != 0 {
+		t.Errorf("a tx larger than the max tx size is committed: %v keys", n)
+	}
+}
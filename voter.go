@@ -0,0 +1,323 @@
+package beehive
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/raft"
+)
+
+// When HiveConfig.RegVoters is set, only that many hives are voters in the
+// raft group of the registry. The other hives are observers: they have no raft
+// node, forward their registry requests to the voters, and pull the updates of
+// the registry from the voters. The leader of the registry pings the voters and
+// replaces the dead voters with live observers. Dead voters are not assigned
+// bees or followers until they respond to the pings of the leader again.
+//
+// Note that a voter is never demoted while it is alive, and lowering RegVoters
+// does not shrink the raft group.
+
+var (
+	// ErrNotVoter is returned when a raft message is sent to an observer.
+	ErrNotVoter = errors.New("hive is not a voter in the registry")
+	// ErrNoVoter is returned when no voter of the registry can be reached.
+	ErrNoVoter = errors.New("no voter is reachable")
+)
+
+// deadVoterPings is the number of consecutive failed pings after which the
+// leader of the registry considers a voter dead.
+const deadVoterPings = 3
+
+// processRaft processes req in the registry. If the hive is an observer, req
+// is forwarded to a voter and processRaft blocks until the update is received
+// from the voters.
+func (h *hive) processRaft(ctx context.Context, req interface{}) (interface{},
+	error) {
+
+	if n := h.raftNode(); n != nil && !h.registry.replaying() {
+		return n.Process(ctx, req)
+	}
+
+	res, err := h.sendToVoter(cmd{Data: cmdProcessRegistry{Req: req}})
+	if err != nil {
+		return nil, err
+	}
+	rr := res.(registryResult)
+	if rr.Err != nil {
+		return rr.Data, rr.Err
+	}
+	if err := h.waitForRegistry(ctx, rr.Seq); err != nil {
+		return nil, err
+	}
+	return rr.Data, nil
+}
+
+// waitForRegistry blocks until the registry applies the update with seq.
+func (h *hive) waitForRegistry(ctx context.Context, seq uint64) error {
+	for {
+		if !h.registry.replaying() && h.registry.seq() >= seq {
+			return nil
+		}
+
+		if err := h.syncRegistry(); err != nil {
+			glog.Errorf("%v cannot sync the registry: %v", h, err)
+		}
+		if !h.registry.replaying() && h.registry.seq() >= seq {
+			return nil
+		}
+
+		select {
+		case <-time.After(h.config.RaftTick):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.done:
+			return raft.ErrStopped
+		}
+	}
+}
+
+// syncRegistry pulls the updates of the registry from a voter. It is a no-op
+// if the hive is a voter.
+func (h *hive) syncRegistry() error {
+	h.syncM.Lock()
+	defer h.syncM.Unlock()
+
+	if h.raftNode() != nil {
+		return nil
+	}
+
+	since := h.registry.seq()
+	res, err := h.sendToVoter(cmd{Data: cmdRegistryUpdates{Since: since}})
+	if err != nil {
+		return err
+	}
+	return h.registry.applyUpdates(res.(registryUpdates))
+}
+
+// observe periodically syncs the registry until the hive is stopped or
+// promoted to a voter.
+func (h *hive) observe() {
+	glog.V(2).Infof("%v starts as an observer of the registry", h)
+	t := time.NewTicker(h.config.RaftTick)
+	defer t.Stop()
+	for h.raftNode() == nil {
+		select {
+		case <-t.C:
+		case <-h.done:
+			return
+		}
+
+		if err := h.syncRegistry(); err != nil {
+			glog.V(2).Infof("%v cannot sync the registry: %v", h, err)
+		}
+	}
+}
+
+// voterAddrs returns the addresses of the voters. If the registry has no
+// voters (e.g., an observer that has not synced yet), it returns the addresses
+// of the peers.
+func (h *hive) voterAddrs() []string {
+	var addrs []string
+	for _, v := range h.registry.voters() {
+		if v == h.id {
+			continue
+		}
+		if i, err := h.registry.hive(v); err == nil {
+			addrs = append(addrs, i.Addr)
+		}
+	}
+	if len(addrs) != 0 {
+		return addrs
+	}
+
+	for _, p := range h.meta.Peers {
+		if p.ID != h.id {
+			addrs = append(addrs, p.Addr)
+		}
+	}
+	for _, a := range h.config.PeerAddrs {
+		if a != h.config.Addr {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// sendToVoter sends c to the first voter that responds.
+func (h *hive) sendToVoter(c cmd) (interface{}, error) {
+	err := ErrNoVoter
+	for _, a := range h.voterAddrs() {
+		p := newProxyWithRetry(h.httpClient(), a, 100*time.Millisecond, 3)
+		var res interface{}
+		if res, err = sendCmd(p, c); err == nil {
+			return res, nil
+		}
+		glog.V(2).Infof("%v cannot send %#v to voter %v: %v", h, c.Data, a, err)
+	}
+	return nil, err
+}
+
+// addHive adds a new hive to the cluster. The hive is added as a voter if the
+// registry has less than HiveConfig.RegVoters voters.
+func (h *hive) addHive(info raft.NodeInfo) (voter bool, err error) {
+	n := h.raftNode()
+	if n == nil {
+		res, err := h.sendToVoter(cmd{Data: cmdAddHive{Info: info}})
+		if err != nil {
+			return false, err
+		}
+		return res.(bool), nil
+	}
+
+	if max := h.Config().RegVoters; max != 0 && len(h.registry.voters()) >= max {
+		glog.V(2).Infof("%v adds hive %v as an observer", h, info.ID)
+		return false, nil
+	}
+	return true, n.AddNode(context.TODO(), info.ID, info.Addr)
+}
+
+// promote turns an observer into a voter. The leader of the registry has
+// already added the hive to the raft group.
+func (h *hive) promote() error {
+	h.syncM.Lock()
+	defer h.syncM.Unlock()
+
+	if h.raftNode() != nil {
+		return nil
+	}
+
+	glog.Infof("%v is promoted to a voter of the registry", h)
+	// The raft state of the hive, if any, is from when it was a voter before.
+	for _, d := range []string{"wal", "snap"} {
+		if err := os.RemoveAll(path.Join(h.config.StatePath, d)); err != nil {
+			return err
+		}
+	}
+	h.registry.startReplay()
+	h.newRaftNode(nil)
+
+	h.meta.Observer = false
+	saveMeta(h.meta, h.config)
+	return nil
+}
+
+// maintainVoters replaces the dead voters of the registry with live
+// observers. It is only effective on the leader of the registry.
+func (h *hive) maintainVoters() {
+	t := time.NewTicker(h.config.RaftElectTimeout())
+	defer t.Stop()
+	client := newHTTPClient(h.config.RaftElectTimeout())
+	failed := make(map[uint64]int)
+	for {
+		select {
+		case <-t.C:
+		case <-h.done:
+			return
+		}
+
+		n := h.raftNode()
+		if n == nil || n.Leader() != h.id || h.registry.replaying() {
+			continue
+		}
+		h.checkVoters(n, client, failed)
+	}
+}
+
+func (h *hive) checkVoters(n *raft.Node, client *http.Client,
+	failed map[uint64]int) {
+
+	if len(h.registry.voters()) == 0 {
+		// The voters are not known yet, and every hive would look like an
+		// observer.
+		return
+	}
+
+	ctx, cnl := context.WithTimeout(context.Background(),
+		10*h.config.RaftElectTimeout())
+	defer cnl()
+
+	for _, v := range h.registry.voters() {
+		if v == h.id {
+			continue
+		}
+		i, err := h.registry.hive(v)
+		if err == nil && isHiveAlive(client, i.Addr) {
+			delete(failed, v)
+			continue
+		}
+
+		if failed[v]++; failed[v] < deadVoterPings {
+			continue
+		}
+
+		glog.Warningf("%v removes dead voter %v from the registry", h, v)
+		if err := n.RemoveNode(ctx, v, i.Addr); err != nil {
+			glog.Errorf("%v cannot remove voter %v: %v", h, v, err)
+			return
+		}
+		delete(failed, v)
+	}
+
+	for _, i := range h.registry.deadHives() {
+		if !isHiveAlive(client, i.Addr) {
+			continue
+		}
+		glog.Infof("%v revives hive %v", h, i.ID)
+		if _, err := n.Process(ctx, reviveHive(i.ID)); err != nil {
+			glog.Errorf("%v cannot revive hive %v: %v", h, i.ID, err)
+			return
+		}
+	}
+
+	for len(h.registry.voters()) < h.Config().RegVoters {
+		o, ok := h.liveObserver(client)
+		if !ok {
+			glog.V(2).Infof("%v finds no live observer to promote", h)
+			return
+		}
+
+		glog.Infof("%v promotes hive %v to a voter", h, o.ID)
+		if err := n.AddNode(ctx, o.ID, o.Addr); err != nil {
+			glog.Errorf("%v cannot add voter %v: %v", h, o.ID, err)
+			return
+		}
+		p := newProxyWithRetry(h.httpClient(), o.Addr, 100*time.Millisecond, 3)
+		if _, err := sendCmd(p, cmd{Data: cmdPromote{}}); err != nil {
+			glog.Errorf("%v cannot promote hive %v: %v", h, o.ID, err)
+			if err := n.RemoveNode(ctx, o.ID, o.Addr); err != nil {
+				glog.Errorf("%v cannot remove voter %v: %v", h, o.ID, err)
+			}
+			return
+		}
+	}
+}
+
+// liveObserver returns the live observer with the smallest ID.
+func (h *hive) liveObserver(client *http.Client) (HiveInfo, bool) {
+	hives := h.registry.hives()
+	sort.Sort(hiveInfoByID(hives))
+	for _, i := range hives {
+		if h.registry.isVoter(i.ID) || !isHiveAlive(client, i.Addr) {
+			continue
+		}
+		return i, true
+	}
+	return HiveInfo{}, false
+}
+
+func isHiveAlive(client *http.Client, addr string) bool {
+	_, err := sendCmd(newProxy(client, addr), cmd{Data: cmdPing{}})
+	return err == nil
+}
+
+type hiveInfoByID []HiveInfo
+
+func (s hiveInfoByID) Len() int           { return len(s) }
+func (s hiveInfoByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s hiveInfoByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -46,6 +46,20 @@ var (
 			script: matrixScript,
 			style:  matrixStyle,
 		},
+		{
+			title:  "Migrations",
+			url:    "/migrations",
+			onMenu: true,
+			script: migrationsScript,
+			style:  migrationsStyle,
+		},
+		{
+			title:  "Quotas",
+			url:    "/quotas",
+			onMenu: true,
+			script: quotasScript,
+			style:  migrationsStyle,
+		},
 		{
 			title:  "About",
 			url:    "/about",
@@ -440,6 +454,138 @@ var (
 			}
 		}
 	`
+	migrationsStyle = `
+		table {
+			border-collapse: collapse;
+			margin: 20px;
+		}
+
+		td, th {
+			border-bottom: 1px solid #345;
+			padding: 5px 10px 5px 10px;
+			text-align: left;
+		}
+
+		button {
+			background: #345;
+			border: none;
+			color: #EEE;
+			font-family: 'Ubuntu Mono';
+			margin-right: 5px;
+		}
+
+		button:hover {
+			color: #FFF;
+		}
+	`
+	migrationsScript = `
+		var REC_URL = '/apps/bh_collector/recommendations';
+
+		$(document).ready(function() {
+			loadRecommendations();
+		});
+
+		function loadRecommendations() {
+			$.ajax({
+				url: REC_URL,
+				context: document.body
+			}).done(function(data) {
+				writeRecommendations(data);
+			}).error(function() {
+				$('body').append('cannot fetch data');
+			});
+		}
+
+		function decide(id, action) {
+			$.ajax({
+				url: REC_URL + '/' + id + '/' + action,
+				type: 'POST'
+			}).done(function() {
+				loadRecommendations();
+			}).error(function(xhr) {
+				alert('cannot ' + action + ' recommendation ' + id + ': ' +
+							xhr.responseText);
+			});
+		}
+
+		function escapeHTML(s) {
+			return $('<div>').text(String(s)).html();
+		}
+
+		function formatTraffic(traffic) {
+			var hives = [];
+			for (var h in traffic) {
+				hives.push('hive ' + h + ': ' + traffic[h]);
+			}
+			return hives.join('<br>');
+		}
+
+		function writeRecommendations(recs) {
+			$('table').remove();
+			var table = $('<table>').appendTo('body');
+			table.append('<tr><th>ID</th><th>Bee</th><th>From</th><th>To</th>' +
+									 '<th>Score</th><th>Traffic</th><th>Reason</th>' +
+									 '<th>Status</th><th></th></tr>');
+			recs.reverse();
+			for (var i in recs) {
+				var r = recs[i];
+				var row = $('<tr>').appendTo(table);
+				row.append('<td>' + r.id + '</td><td>' + r.bee + '</td><td>' +
+									 r.from + '</td><td>' + r.to + '</td><td>' + r.score +
+									 '</td><td>' + formatTraffic(r.traffic) + '</td><td>' +
+									 escapeHTML(r.reason) + '</td><td>' + escapeHTML(r.status) +
+									 '</td>');
+				var actions = $('<td>').appendTo(row);
+				if (r.status != 'pending') {
+					continue;
+				}
+				$.each(['approve', 'reject'], function(j, action) {
+					var id = r.id;
+					$('<button>', {'text': action}).click(function() {
+						decide(id, action);
+					}).appendTo(actions);
+				});
+			}
+		}
+	`
+
+	quotasScript = `
+		$(document).ready(function() {
+			$.ajax({
+				url: '/api/v1/quotas',
+				context: document.body
+			}).done(function(data) {
+				writeQuotas(data);
+			}).error(function() {
+				$('body').append('cannot fetch data');
+			});
+		});
+
+		function formatLimit(l) {
+			return l ? l : '-';
+		}
+
+		function writeQuotas(quotas) {
+			var table = $('<table>').appendTo('body');
+			table.append('<tr><th>App</th><th>Bees</th><th>Bees/Hive</th>' +
+									 '<th>Bees/Cluster</th><th>State Bytes</th>' +
+									 '<th>Queued Msgs</th><th>Dead Letter</th>' +
+									 '<th>Violations (bees/state/queue)</th></tr>');
+			for (var i in quotas) {
+				var q = quotas[i];
+				var v = q.violations;
+				table.append('<tr><td>' + q.app + '</td><td>' + q.bees +
+										 '</td><td>' + formatLimit(q.quota.max_bees_per_hive) +
+										 '</td><td>' + formatLimit(q.quota.max_bees) +
+										 '</td><td>' + formatLimit(q.quota.max_state_bytes) +
+										 '</td><td>' + formatLimit(q.quota.max_queued_msgs) +
+										 '</td><td>' + (q.quota.dead_letter ? 'YES' : 'NO') +
+										 '</td><td>' + v.bees + '/' + v.state_bytes + '/' +
+										 v.queued_msgs + '</td></tr>');
+			}
+		}
+	`
+
 	aboutBody = `<div style="margin: 20px;">
 								 Beehive Distributed Programming Framework
 							 </div>`